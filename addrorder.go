@@ -0,0 +1,104 @@
+package dane
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+)
+
+//
+// AddressOrder - the order in which the connect functions try the
+// addresses of a server.
+//
+type AddressOrder int
+
+//
+// Address orders: as returned by GetAddresses (IPv6 followed by IPv4),
+// randomly shuffled, or sorted by the precedence of the RFC 6724 default
+// policy table.
+//
+const (
+	OrderAsReturned AddressOrder = iota
+	OrderShuffle
+	OrderRFC6724
+)
+
+//
+// rfc6724Policy - an entry in the RFC 6724, Section 2.1 default policy
+// table, used for destination address precedence.
+//
+type rfc6724Policy struct {
+	prefix     *net.IPNet
+	precedence int
+}
+
+var rfc6724Table = func() []rfc6724Policy {
+
+	var table []rfc6724Policy
+
+	// Ordered from the longest prefix to the shortest, so that the
+	// first matching entry is the most specific.
+	for _, p := range []struct {
+		prefix     string
+		precedence int
+	}{
+		{"::1/128", 50},
+		{"::ffff:0:0/96", 35},
+		{"::/96", 1},
+		{"2001::/32", 5},
+		{"2002::/16", 30},
+		{"3ffe::/16", 1},
+		{"fec0::/10", 1},
+		{"fc00::/7", 3},
+		{"::/0", 40},
+	} {
+		_, prefix, _ := net.ParseCIDR(p.prefix)
+		table = append(table, rfc6724Policy{prefix, p.precedence})
+	}
+	return table
+}()
+
+//
+// rfc6724Precedence returns the precedence of the given address from the
+// RFC 6724 default policy table. IPv4 addresses are looked up as IPv4
+// mapped IPv6 addresses.
+//
+func rfc6724Precedence(ip net.IP) int {
+
+	ip16 := ip.To16()
+	for _, p := range rfc6724Table {
+		if p.prefix.Contains(ip16) {
+			return p.precedence
+		}
+	}
+	return 0
+}
+
+//
+// orderAddresses returns the given list of addresses in the given order,
+// truncated to at most max addresses if max is greater than zero. The
+// RFC 6724 order only applies the precedence rule (Rule 6) of destination
+// address selection, since the other rules depend on the source addresses
+// available on the host; addresses of equal precedence keep their order.
+//
+func orderAddresses(iplist []net.IP, order AddressOrder, max int) []net.IP {
+
+	ordered := make([]net.IP, len(iplist))
+	copy(ordered, iplist)
+
+	switch order {
+	case OrderShuffle:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case OrderRFC6724:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return rfc6724Precedence(ordered[i]) > rfc6724Precedence(ordered[j])
+		})
+	}
+
+	if max > 0 && len(ordered) > max {
+		ordered = ordered[:max]
+	}
+	return ordered
+}
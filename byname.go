@@ -2,9 +2,12 @@ package dane
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -17,39 +20,197 @@ type Response struct {
 	err    error
 }
 
-// IPv6 connect headstart (delay IPv4 connections by this amount)
+//
+// Config returns the dane Config used for the connection attempt.
+//
+func (r *Response) Config() *Config {
+	return r.config
+}
+
+//
+// Conn returns the TLS connection, if the connection attempt succeeded
+// and the connection was retained.
+//
+func (r *Response) Conn() *tls.Conn {
+	return r.conn
+}
+
+//
+// Err returns the error from the connection attempt, or nil on success.
+//
+func (r *Response) Err() error {
+	return r.err
+}
+
+// IPv6 connect headstart (delay IPv4 connections by this amount). This
+// is the default for connects whose ConnectOptions don't set Headstart,
+// and is read once at the start of each connect.
+//
+// Deprecated: Set ConnectOptions.Headstart instead. Changing this variable
+// while connects are in progress is a data race.
 var IPv6Headstart = 25 * time.Millisecond
 
-// Maximum number of parallel connections attempted
+// Maximum number of parallel connections attempted. This is the default
+// for connects whose ConnectOptions don't set MaxParallel, and is read once
+// at the start of each connect.
+//
+// Deprecated: Set ConnectOptions.MaxParallel instead. Changing this
+// variable while connects are in progress is a data race.
 var MaxParallelConnections = 30
 
+//
+// ConnectOptions - per-connect options for ConnectByNameOptions and
+// ConnectByNameAllOptions. The zero value uses the system default resolver,
+// requires DANE (no PKIX fallback), and uses the package IPv6Headstart and
+// MaxParallelConnections values.
+//
+type ConnectOptions struct {
+	Resolver     *Resolver     // Resolver to use (nil: system default)
+	PKIXfallback bool          // Use PKIX if there are no secure TLSA records
+	Headstart    time.Duration // IPv6 headstart (0: use IPv6Headstart)
+	NoHeadstart  bool          // Don't delay IPv4 connections at all
+	MaxParallel  int           // Max parallel connections (0: MaxParallelConnections)
+	MaxAddrs     int           // Max number of addresses to try (0: all)
+	Order        AddressOrder  // Order in which to try the addresses
+	UseSVCB      bool          // Use port and ALPN from secure HTTPS records
+	Retries      int           // Retries per address for transient failures
+}
+
+//
+// NewConnectOptions returns a ConnectOptions structure with PKIX
+// fallback enabled, matching the behavior of ConnectByName.
+//
+func NewConnectOptions() *ConnectOptions {
+	return &ConnectOptions{PKIXfallback: true}
+}
+
+//
+// headstart returns the delay to apply to IPv4 connection attempts.
+//
+func (o *ConnectOptions) headstart() time.Duration {
+	if o.NoHeadstart {
+		return 0
+	}
+	if o.Headstart > 0 {
+		return o.Headstart
+	}
+	return IPv6Headstart
+}
+
+//
+// maxParallel returns the maximum number of parallel connection attempts.
+//
+func (o *ConnectOptions) maxParallel() int {
+	if o.MaxParallel > 0 {
+		return o.MaxParallel
+	}
+	return MaxParallelConnections
+}
+
+//
+// transientError returns whether the error of a connection attempt with
+// the given dane Config is a transient network failure, such as a reset
+// connection or timeout, that occurred before the server's certificates
+// were received. Authentication failures are never transient, since
+// retrying won't change the result.
+//
+func transientError(config *Config, err error) bool {
+
+	var nerr net.Error
+
+	if err == nil || config.PeerChain != nil {
+		return false
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return true
+	}
+	return false
+}
+
+//
+// dialRetry is DialTLS, retrying up to the given number of times if the
+// connection attempt fails with a transient error. The Config's results
+// are reset before each retry, keeping the lookup timings.
+//
+func dialRetry(config *Config, retries int) (*tls.Conn, error) {
+
+	for attempt := 0; ; attempt++ {
+		conn, err := DialTLS(config)
+		if attempt >= retries || !transientError(config, err) {
+			return conn, err
+		}
+		logf(config.Logger, "Retrying connection to %s: %s",
+			config.Server.Address(), err.Error())
+		config.resetAttempt()
+	}
+}
+
+//
+// resolver returns the Resolver to use, which is the system default if
+// none is set.
+//
+func (o *ConnectOptions) resolver() (*Resolver, error) {
+
+	if o.Resolver != nil {
+		return o.Resolver, nil
+	}
+	resolver, err := GetResolver("")
+	if err != nil {
+		return nil, fmt.Errorf("error obtaining resolver address: %s", err.Error())
+	}
+	return resolver, nil
+}
+
 //
 // ConnectByName takes a hostname and port, resolves the addresses for
 // the hostname (IPv6 followed by IPv4), and then attempts to connect to
 // them and establish TLS using DANE or PKIX authentication - DANE is
 // attempted if there are secure TLSA records, otherwise it falls back to
 // PKIX authentication. It returns a TLS connection and dane config for
-// the first address that succeeds.
+// the first address that succeeds. If all addresses fail, the error is a
+// *ConnectError, which holds the error for each address.
 //
 // Uses a default DANE configuration. For a custom DANE configuration,
 // use the DialTLS or DialStartTLS functions instead.
 //
 func ConnectByName(hostname string, port int) (*tls.Conn, *Config, error) {
 
-	var conn *tls.Conn
-
 	resolver, err := GetResolver("")
 	if err != nil {
 		return nil, nil, fmt.Errorf("error obtaining resolver address: %s", err.Error())
 	}
 
+	return ConnectByNameResolver(resolver, hostname, port)
+}
+
+//
+// ConnectByNameResolver is the same as ConnectByName, but uses the given
+// Resolver rather than the system default. The address families that are
+// tried can be restricted with the Resolver's IPv4 and IPv6 settings, e.g.
+// setting IPv4 to false will only attempt connections over IPv6, and fail
+// if no IPv6 addresses are found.
+//
+func ConnectByNameResolver(resolver *Resolver, hostname string, port int) (*tls.Conn, *Config, error) {
+
+	var conn *tls.Conn
+
+	start := time.Now()
 	tlsa, err := GetTLSA(resolver, hostname, port)
+	timings := Timings{TLSALookup: time.Since(start)}
 	if err != nil {
 		return nil, nil, err
 	}
 
 	needSecure := (tlsa != nil)
+	start = time.Now()
 	iplist, err := GetAddresses(resolver, hostname, needSecure)
+	timings.AddressLookup = time.Since(start)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -58,20 +219,23 @@ func ConnectByName(hostname string, port int) (*tls.Conn, *Config, error) {
 		return nil, nil, fmt.Errorf("%s: no addresses found", hostname)
 	}
 
+	connerr := &ConnectError{Hostname: hostname}
 	for _, ip := range iplist {
 		config := NewConfig(hostname, ip, port)
 		config.SetTLSA(tlsa)
+		config.SetLogger(resolver.Logger)
+		config.Timings = timings
 		conn, err = DialTLS(config)
 		if err != nil {
-			fmt.Printf("Connection failed to %s: %s\n", config.Server.Address(),
-				err.Error())
+			logf(resolver.Logger, "Connection failed to %s: %s",
+				config.Server.Address(), err.Error())
+			connerr.add(config.Server.Address(), err)
 			continue
 		}
 		return conn, config, err
 	}
 
-	return conn, nil, fmt.Errorf("failed to connect to any server address for %s",
-		hostname)
+	return nil, nil, connerr
 }
 
 //
@@ -80,39 +244,106 @@ func ConnectByName(hostname string, port int) (*tls.Conn, *Config, error) {
 //
 func ConnectByNameAsyncBase(hostname string, port int, pkixfallback bool) (*tls.Conn, *Config, error) {
 
-	var conn *tls.Conn
+	resolver, err := GetResolver("")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error obtaining resolver address: %s", err.Error())
+	}
+
+	return ConnectByNameAsyncResolver(resolver, hostname, port, pkixfallback)
+}
+
+//
+// ConnectByNameAsyncResolver is the same as ConnectByNameAsync2, but uses
+// the given Resolver rather than the system default. As with
+// ConnectByNameResolver, the Resolver's IPv4 and IPv6 settings determine
+// which address families are tried.
+//
+func ConnectByNameAsyncResolver(resolver *Resolver, hostname string, port int, pkixfallback bool) (*tls.Conn, *Config, error) {
+
+	opts := &ConnectOptions{Resolver: resolver, PKIXfallback: pkixfallback}
+	return ConnectByNameOptions(hostname, port, opts)
+}
+
+//
+// ConnectByNameOptions is the same as ConnectByNameAsync2, but takes its
+// resolver, PKIX fallback and IPv6 headstart settings from the given
+// ConnectOptions rather than from package globals. This allows, for
+// example, the IPv6 headstart to be disabled for an individual connect
+// on networks where IPv6 is broken, without changing IPv6Headstart.
+//
+// If UseSVCB is set, the secure HTTPS records of the hostname (if any) are
+// looked up first, and the port and ALPN protocols of the highest priority
+// record for the hostname itself are used, so that the TLSA records are
+// looked up for the port that will actually be connected to. If the HTTPS
+// record lookup fails, the failure is logged and the given port is used
+// with no ALPN protocols.
+//
+// The number of addresses tried, and the order in which they are tried,
+// can be controlled with MaxAddrs and Order. The IPv6 headstart applies in
+// any order, so IPv4 addresses are always slightly delayed. Connection
+// attempts to each address that fail with transient network errors (but
+// not authentication failures) are retried up to Retries times.
+//
+func ConnectByNameOptions(hostname string, port int, opts *ConnectOptions) (*tls.Conn, *Config, error) {
+
 	var ip net.IP
 	var wg sync.WaitGroup
-	var numParallel = MaxParallelConnections
-	var tokens = make(chan struct{}, numParallel)
 	var results = make(chan *Response)
 	var done = make(chan struct{})
 
 	defer close(done)
 
-	resolver, err := GetResolver("")
+	if opts == nil {
+		opts = &ConnectOptions{}
+	}
+	resolver, err := opts.resolver()
 	if err != nil {
-		return nil, nil, fmt.Errorf("error obtaining resolver address: %s", err.Error())
+		return nil, nil, err
 	}
+	tokens := make(chan struct{}, opts.maxParallel())
+	pkixfallback := opts.PKIXfallback
+	headstart := opts.headstart()
 
+	var alpn []string
+	if opts.UseSVCB {
+		svcb, err := GetSVCB(resolver, hostname)
+		if err != nil {
+			logf(resolver.Logger, "HTTPS record lookup for %s failed, using defaults: %s",
+				hostname, err.Error())
+		}
+		if s := selectSVCB(svcb, hostname); s != nil {
+			if s.Port != 0 {
+				port = s.Port
+			}
+			alpn = s.tcpALPN()
+		}
+	}
+
+	start := time.Now()
 	tlsa, err := GetTLSA(resolver, hostname, port)
+	timings := Timings{TLSALookup: time.Since(start)}
 	if err != nil {
 		return nil, nil, err
 	}
 
 	if !pkixfallback && (tlsa == nil) {
-		return nil, nil, fmt.Errorf("no TLSA records found")
+		return nil, nil, &DANERequiredError{Hostname: hostname, Err: ErrNoTLSA}
 	}
 
 	needSecure := (tlsa != nil)
-	iplist, err := GetAddresses(resolver, hostname, needSecure)
+	lookup := start
+	start = time.Now()
+	iplist, infos, err := GetAddressesInfo(resolver, hostname, needSecure)
+	timings.AddressLookup = time.Since(start)
 	if err != nil {
 		return nil, nil, err
 	}
+	dnsexpires := dnsExpiry(lookup, tlsa, infos)
 
 	if len(iplist) == 0 {
 		return nil, nil, fmt.Errorf("%s: no addresses found", hostname)
 	}
+	iplist = orderAddresses(iplist, opts.Order, opts.MaxAddrs)
 
 	go func() {
 		for _, ip = range iplist {
@@ -120,19 +351,29 @@ func ConnectByNameAsyncBase(hostname string, port int, pkixfallback bool) (*tls.
 			tokens <- struct{}{}
 			go func(hostname string, ip net.IP, port int) {
 				defer wg.Done()
+				defer func() { <-tokens }()
 				config := NewConfig(hostname, ip, port)
 				config.SetTLSA(tlsa)
+				config.SetLogger(resolver.Logger)
+				config.Timings = timings
+				config.DNSExpires = dnsexpires
 				if !pkixfallback {
 					config.NoPKIXfallback()
 				}
-				if ip4 := ip.To4(); ip4 != nil {
-					time.Sleep(IPv6Headstart)
+				if alpn != nil {
+					config.SetALPN(alpn)
+				}
+				if ip4 := ip.To4(); ip4 != nil && headstart > 0 {
+					time.Sleep(headstart)
 				}
-				conn, err = DialTLS(config)
+				conn, err := dialRetry(config, opts.Retries)
 				select {
 				case <-done:
+					// Another address won; don't leak this connection.
+					if conn != nil {
+						conn.Close()
+					}
 				case results <- &Response{config: config, conn: conn, err: err}:
-					<-tokens
 				}
 			}(hostname, ip, port)
 		}
@@ -140,13 +381,40 @@ func ConnectByNameAsyncBase(hostname string, port int, pkixfallback bool) (*tls.
 		close(results)
 	}()
 
+	connerr := &ConnectError{Hostname: hostname}
 	for r := range results {
 		if r.err == nil {
 			return r.conn, r.config, nil
 		}
+		logf(resolver.Logger, "Connection failed to %s: %s",
+			r.config.Server.Address(), r.err.Error())
+		connerr.add(r.config.Server.Address(), r.err)
 	}
-	return conn, nil, fmt.Errorf("failed to connect to any server address for %s",
-		hostname)
+	return nil, nil, connerr
+}
+
+//
+// dnsExpiry returns the time, counting from the given lookup time, at which
+// the smallest TTL of the given TLSA records and address query answers
+// expires, or the zero time if none of them has a TTL.
+//
+func dnsExpiry(lookup time.Time, tlsa *TLSAinfo, infos map[uint16]*QueryInfo) time.Time {
+
+	var ttl uint32
+	var known bool
+
+	if tlsa != nil {
+		ttl, known = tlsa.MinTTL()
+	}
+	for _, info := range infos {
+		if info.Answers > 0 && (!known || info.MinTTL < ttl) {
+			ttl, known = info.MinTTL, true
+		}
+	}
+	if !known {
+		return time.Time{}
+	}
+	return lookup.Add(time.Duration(ttl) * time.Second)
 }
 
 //
@@ -170,3 +438,146 @@ func ConnectByNameAsync2(hostname string, port int, pkixfallback bool) (*tls.Con
 
 	return ConnectByNameAsyncBase(hostname, port, pkixfallback)
 }
+
+//
+// ConnectByNameAsyncAll is like ConnectByNameAsync2, but waits for the
+// connection attempts to all server addresses to complete, and also returns
+// the list of per-address responses (successes and failures), in order of
+// completion. This is useful for diagnostic tools that want to report on
+// every address of a multi-homed server. Only the returned connection is
+// left open; any other successful connections are closed, and their
+// responses have no connection handle.
+//
+func ConnectByNameAsyncAll(hostname string, port int, pkixfallback bool) (*tls.Conn, *Config, []*Response, error) {
+
+	opts := &ConnectOptions{PKIXfallback: pkixfallback}
+	return ConnectByNameAllOptions(hostname, port, opts)
+}
+
+//
+// ConnectByNameAllOptions is the same as ConnectByNameAsyncAll, but takes
+// its resolver, PKIX fallback, IPv6 headstart and parallelism settings from
+// the given ConnectOptions, as with ConnectByNameOptions.
+//
+func ConnectByNameAllOptions(hostname string, port int, opts *ConnectOptions) (*tls.Conn, *Config, []*Response, error) {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var responses []*Response
+	var winner *Response
+
+	if opts == nil {
+		opts = &ConnectOptions{}
+	}
+	resolver, err := opts.resolver()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tokens := make(chan struct{}, opts.maxParallel())
+	pkixfallback := opts.PKIXfallback
+	headstart := opts.headstart()
+
+	start := time.Now()
+	tlsa, err := GetTLSA(resolver, hostname, port)
+	timings := Timings{TLSALookup: time.Since(start)}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !pkixfallback && (tlsa == nil) {
+		return nil, nil, nil, &DANERequiredError{Hostname: hostname, Err: ErrNoTLSA}
+	}
+
+	needSecure := (tlsa != nil)
+	start = time.Now()
+	iplist, err := GetAddresses(resolver, hostname, needSecure)
+	timings.AddressLookup = time.Since(start)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(iplist) == 0 {
+		return nil, nil, nil, fmt.Errorf("%s: no addresses found", hostname)
+	}
+	iplist = orderAddresses(iplist, opts.Order, opts.MaxAddrs)
+
+	for _, ip := range iplist {
+		wg.Add(1)
+		tokens <- struct{}{}
+		go func(ip net.IP) {
+			defer wg.Done()
+			defer func() { <-tokens }()
+			config := NewConfig(hostname, ip, port)
+			config.SetTLSA(tlsa)
+			config.SetLogger(resolver.Logger)
+			config.Timings = timings
+			if !pkixfallback {
+				config.NoPKIXfallback()
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				time.Sleep(headstart)
+			}
+			conn, err := dialRetry(config, opts.Retries)
+			r := &Response{config: config, conn: conn, err: err}
+			mu.Lock()
+			defer mu.Unlock()
+			responses = append(responses, r)
+			if err != nil {
+				return
+			}
+			if winner == nil {
+				winner = r
+				return
+			}
+			conn.Close()
+			r.conn = nil
+		}(ip)
+	}
+	wg.Wait()
+
+	if winner == nil {
+		connerr := &ConnectError{Hostname: hostname}
+		for _, r := range responses {
+			connerr.add(r.config.Server.Address(), r.err)
+		}
+		return nil, nil, responses, connerr
+	}
+	return winner.conn, winner.config, responses, nil
+}
+
+//
+// ConnectByNameIP is like ConnectByNameAsync2, but instead of looking up
+// the addresses of the hostname, connects only to the given IP address
+// (e.g. a particular anycast instance or load balanced server). The TLSA
+// records are looked up for the hostname and port.
+//
+func ConnectByNameIP(hostname string, ip net.IP, port int, pkixfallback bool) (*tls.Conn, *Config, error) {
+
+	resolver, err := GetResolver("")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error obtaining resolver address: %s", err.Error())
+	}
+
+	start := time.Now()
+	tlsa, err := GetTLSA(resolver, hostname, port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !pkixfallback && (tlsa == nil) {
+		return nil, nil, &DANERequiredError{Hostname: hostname, Err: ErrNoTLSA}
+	}
+
+	config := NewConfig(hostname, ip, port)
+	config.SetTLSA(tlsa)
+	config.SetLogger(resolver.Logger)
+	config.Timings.TLSALookup = time.Since(start)
+	if !pkixfallback {
+		config.NoPKIXfallback()
+	}
+	conn, err := DialTLS(config)
+	if err != nil {
+		return nil, config, err
+	}
+	return conn, config, nil
+}
@@ -7,8 +7,17 @@ package dane
  */
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 func TestConnectByName(t *testing.T) {
@@ -85,3 +94,288 @@ func TestConnectByNameAsync2Fail(t *testing.T) {
 		hostname, err.Error())
 	fmt.Printf("\n")
 }
+
+func TestConnectByNameResolverIPv6(t *testing.T) {
+
+	var hostname = "www.example.com"
+	var port = 443
+
+	servers := []*Server{NewServer("", "8.8.8.8", 53)}
+	resolver := NewResolver(servers)
+	resolver.IPv4 = false
+
+	conn, config, err := ConnectByNameResolver(resolver, hostname, port)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if config.Server.Ipaddr.To4() != nil {
+		t.Fatalf("ConnectByNameResolver: connected over IPv4 to %s\n",
+			config.Server.Address())
+	}
+	fmt.Printf("ConnectByNameResolver: Success connecting to %s %s\n",
+		hostname, config.Server.Address())
+	fmt.Printf("\n")
+	conn.Close()
+}
+
+func TestConnectByNameAsyncAll(t *testing.T) {
+
+	var hostname = "www.example.com"
+	var port = 443
+
+	conn, config, responses, err := ConnectByNameAsyncAll(hostname, port, true)
+	for _, r := range responses {
+		if r.Err() != nil {
+			fmt.Printf("ConnectByNameAsyncAll: %s failed: %s\n",
+				r.Config().Server.Address(), r.Err())
+			continue
+		}
+		fmt.Printf("ConnectByNameAsyncAll: %s DANE %v PKIX %v\n",
+			r.Config().Server.Address(), r.Config().Okdane, r.Config().Okpkix)
+	}
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	fmt.Printf("ConnectByNameAsyncAll: Success connecting to %s %s\n",
+		hostname, config.Server.Address())
+	fmt.Printf("\n")
+	conn.Close()
+}
+
+func TestConnectErrorOffline(t *testing.T) {
+
+	connerr := &ConnectError{Hostname: "www.example.com"}
+	connerr.add("192.0.2.1:443", fmt.Errorf("connection refused"))
+	connerr.add("[2001:db8::1]:443", &DANERequiredError{Hostname: "www.example.com",
+		Err: ErrNoTLSA})
+
+	expected := "failed to connect to any server address for www.example.com: " +
+		"192.0.2.1:443: connection refused; [2001:db8::1]:443: " +
+		"DANE required for www.example.com: no TLSA records found"
+	if connerr.Error() != expected {
+		t.Fatalf("ConnectError: got %q", connerr.Error())
+	}
+	if !errors.Is(connerr.Errors[1], ErrNoTLSA) {
+		t.Fatalf("AddressError: does not unwrap to ErrNoTLSA")
+	}
+	if !errors.Is(connerr, ErrNoTLSA) {
+		t.Fatalf("ConnectError: does not unwrap to ErrNoTLSA")
+	}
+	var derr *DANERequiredError
+	if !errors.As(connerr, &derr) || derr.Hostname != "www.example.com" {
+		t.Fatalf("ConnectError: does not unwrap to DANERequiredError")
+	}
+	if errors.Is(connerr, ErrInsecureTLSA) {
+		t.Fatalf("ConnectError: unwraps to unrelated error")
+	}
+
+	// The Is and As methods work without multi-error Unwrap (Go 1.20).
+	if !connerr.Is(ErrNoTLSA) || connerr.Is(ErrInsecureTLSA) {
+		t.Fatalf("ConnectError.Is: unexpected result")
+	}
+	derr = nil
+	if !connerr.As(&derr) || derr.Hostname != "www.example.com" {
+		t.Fatalf("ConnectError.As: does not find DANERequiredError")
+	}
+}
+
+type failHTTPSExchanger struct {
+	stubExchanger
+}
+
+func (f *failHTTPSExchanger) Exchange(m *dns.Msg) (*dns.Msg, error) {
+
+	if m.Question[0].Qtype == dns.TypeHTTPS {
+		return nil, errors.New("HTTPS query timed out")
+	}
+	return f.stubExchanger.Exchange(m)
+}
+
+func TestConnectSVCBFailureOffline(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	logger := new(testLogger)
+	resolver := NewResolver(nil)
+	resolver.Logger = logger
+	resolver.Exchanger = &failHTTPSExchanger{stubExchanger{records: []string{
+		"www.example.com. 300 IN A 127.0.0.1",
+	}}}
+	opts := &ConnectOptions{Resolver: resolver, PKIXfallback: true, UseSVCB: true}
+
+	_, _, err = ConnectByNameOptions("www.example.com", port, opts)
+	var connerr *ConnectError
+	if !errors.As(err, &connerr) {
+		t.Fatalf("ConnectByNameOptions: expected connection error, got: %v", err)
+	}
+	if len(connerr.Errors) != 1 || connerr.Errors[0].Address != fmt.Sprintf("127.0.0.1:%d", port) {
+		t.Fatalf("ConnectByNameOptions: unexpected addresses tried: %v", err)
+	}
+	if len(logger.messages) == 0 || !strings.Contains(logger.messages[0], "HTTPS record lookup") {
+		t.Fatalf("ConnectByNameOptions: SVCB failure not logged: %v", logger.messages)
+	}
+}
+
+func TestConnectByNameIP(t *testing.T) {
+
+	var hostname = "www.example.com"
+	var ip = net.ParseIP("50.116.63.23")
+	var port = 443
+
+	conn, config, err := ConnectByNameIP(hostname, ip, port, true)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !config.Server.Ipaddr.Equal(ip) {
+		t.Fatalf("ConnectByNameIP: connected to %s, expected %s\n",
+			config.Server.Address(), ip)
+	}
+	fmt.Printf("ConnectByNameIP: Success connecting to %s %s\n",
+		hostname, config.Server.Address())
+	fmt.Printf("\n")
+	conn.Close()
+}
+
+func TestConnectOptionsHeadstartOffline(t *testing.T) {
+
+	opts := NewConnectOptions()
+	if !opts.PKIXfallback {
+		t.Fatalf("NewConnectOptions: PKIX fallback not enabled")
+	}
+	if opts.headstart() != IPv6Headstart {
+		t.Fatalf("default headstart %v, expected %v", opts.headstart(), IPv6Headstart)
+	}
+	opts.Headstart = 5 * time.Millisecond
+	if opts.headstart() != 5*time.Millisecond {
+		t.Fatalf("headstart %v, expected 5ms", opts.headstart())
+	}
+	opts.NoHeadstart = true
+	if opts.headstart() != 0 {
+		t.Fatalf("headstart %v, expected 0", opts.headstart())
+	}
+	if opts.maxParallel() != MaxParallelConnections {
+		t.Fatalf("maxParallel %d, expected %d", opts.maxParallel(),
+			MaxParallelConnections)
+	}
+	opts.MaxParallel = 2
+	if opts.maxParallel() != 2 {
+		t.Fatalf("maxParallel %d, expected 2", opts.maxParallel())
+	}
+}
+
+func TestOrderAddressesOffline(t *testing.T) {
+
+	var iplist []net.IP
+	for _, s := range []string{"192.0.2.1", "2002:c000:201::1", "2001:db8::1",
+		"fc00::1", "192.0.2.2", "2001::1"} {
+		iplist = append(iplist, net.ParseIP(s))
+	}
+
+	ordered := orderAddresses(iplist, OrderAsReturned, 0)
+	for i := range iplist {
+		if !ordered[i].Equal(iplist[i]) {
+			t.Fatalf("OrderAsReturned: %v", ordered)
+		}
+	}
+
+	expected := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2",
+		"2002:c000:201::1", "2001::1", "fc00::1"}
+	ordered = orderAddresses(iplist, OrderRFC6724, 0)
+	for i, s := range expected {
+		if !ordered[i].Equal(net.ParseIP(s)) {
+			t.Fatalf("OrderRFC6724: got %v, expected %v", ordered, expected)
+		}
+	}
+
+	ordered = orderAddresses(iplist, OrderShuffle, 3)
+	if len(ordered) != 3 {
+		t.Fatalf("MaxAddrs: got %d addresses, expected 3", len(ordered))
+	}
+	if !iplist[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("orderAddresses modified its input")
+	}
+}
+
+// resetListener is a net.Listener that resets the first given number of
+// accepted connections, to simulate transient connection failures.
+type resetListener struct {
+	net.Listener
+	resets   int32
+	accepted int32
+}
+
+func (l *resetListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.AddInt32(&l.accepted, 1) > atomic.LoadInt32(&l.resets) {
+			return conn, nil
+		}
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+}
+
+func TestDialRetryOffline(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	listener := &resetListener{Listener: ln}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener = listener
+	server.StartTLS()
+	defer server.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	tlsadata, _ := ComputeTLSA(1, 1, server.Certificate())
+	good := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: tlsadata}},
+	}
+	bad := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1,
+			Data: strings.Repeat("ab", 32)}},
+	}
+
+	for _, tc := range []struct {
+		tlsa     *TLSAinfo
+		resets   int32
+		retries  int
+		ok       bool
+		accepted int32
+	}{
+		{good, 1, 0, false, 1},
+		{good, 1, 1, true, 2},
+		{good, 2, 1, false, 2},
+		{bad, 0, 2, false, 1}, // authentication failures aren't retried
+	} {
+		atomic.StoreInt32(&listener.accepted, 0)
+		atomic.StoreInt32(&listener.resets, tc.resets)
+		config := NewConfig("example.com", addr.IP, addr.Port)
+		config.SetTLSA(tc.tlsa)
+		config.Timings.TLSALookup = time.Millisecond
+		conn, err := dialRetry(config, tc.retries)
+		if conn != nil {
+			conn.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Fatalf("%+v: dialRetry error: %v", tc, err)
+		}
+		if tc.ok && (!config.Okdane || config.Timings.TLSALookup != time.Millisecond) {
+			t.Fatalf("%+v: results not kept after retry: %+v", tc, config)
+		}
+		if accepted := atomic.LoadInt32(&listener.accepted); accepted != tc.accepted {
+			t.Fatalf("%+v: %d connections accepted, expected %d", tc, accepted,
+				tc.accepted)
+		}
+	}
+}
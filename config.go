@@ -1,32 +1,88 @@
 package dane
 
 import (
+	"crypto/tls"
 	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// DialControlFunc is a function called on the network connection's socket
+// before dialing, as with net.Dialer's Control field. It can be used to
+// set socket options, such as SO_BINDTODEVICE.
+type DialControlFunc func(network, address string, c syscall.RawConn) error
+
+// VerifyFunc is an additional certificate verification function, called
+// with the server's certificate chain and the dane Config after DANE (or
+// PKIX) authentication has succeeded.
+type VerifyFunc func(chain []*x509.Certificate, config *Config) error
+
 // Config contains a DANE configuration for a single Server.
 type Config struct {
-	DiagMode    bool                  // Diagnostic mode
-	DiagError   error                 // Holds possible error in Diagnostic mode
-	Server      *Server               // Server structure (name, ip, port)
-	TimeoutTCP  int                   // TCP timeout in seconds
-	NoVerify    bool                  // Don't verify server certificate
-	TLSversion  uint16                // TLS version number (otherwise use best TLS version offered)
-	PKIXRootCA  []byte                // Use PEM bytes as Root CA store for PKIX authentication
-	ALPN        []string              // ALPN strings to send
-	DaneEEname  bool                  // Do name checks even for DANE-EE mode
-	SMTPAnyMode bool                  // Allow any DANE modes for SMTP
-	Appname     string                // STARTTLS application name
-	Servicename string                // Servicename, if different from server
-	Transcript  string                // StartTLS transcript
-	DANE        bool                  // do DANE authentication
-	PKIX        bool                  // fall back to PKIX authentication
-	Okdane      bool                  // DANE authentication result
-	Okpkix      bool                  // PKIX authentication result
-	TLSA        *TLSAinfo             // TLSA RRset information
-	PeerChain   []*x509.Certificate   // Peer Certificate Chain
-	PKIXChains  [][]*x509.Certificate // PKIX Certificate Chains
-	DANEChains  [][]*x509.Certificate // DANE Certificate Chains
+	DiagMode       bool                  // Diagnostic mode
+	DiagError      error                 // Holds possible error in Diagnostic mode
+	ConnOnFail     bool                  // Return the connection with the error on auth failure
+	Server         *Server               // Server structure (name, ip, port)
+	TimeoutTCP     int                   // TCP timeout in seconds
+	TimeoutTLS     int                   // TLS handshake timeout in seconds (0: TimeoutTCP)
+	KeepAlive      int                   // TCP keepalive period in seconds (0: default, <0: off)
+	LocalAddr      net.Addr              // Local (source) address to dial from (optional)
+	Network        string                // Network to dial (default: "tcp")
+	DialAddress    string                // Address to dial, instead of the server's (optional)
+	DialControl    DialControlFunc       // Socket control function for dialing (optional)
+	NoVerify       bool                  // Don't verify server certificate
+	TLSversion     uint16                // TLS version number (otherwise use best TLS version offered)
+	Resumption     bool                  // Allow TLS session resumption (see GetTLSconfig)
+	PKIXRootCA     []byte                // Use PEM bytes as Root CA store for PKIX authentication
+	DANERootCA     []byte                // PEM bytes of extra DANE-TA trust anchor candidates
+	ALPN           []string              // ALPN strings to send
+	DaneEEname     bool                  // Do name checks even for DANE-EE mode
+	SMTPAnyMode    bool                  // Allow any DANE modes for SMTP
+	PreferUsage    []uint8               // TLSA usage modes in order of preference
+	AllowUsages    []uint8               // TLSA usage modes allowed (default: all)
+	AllowSelectors []uint8               // TLSA selectors allowed (default: all)
+	AllowMtypes    []uint8               // TLSA matching types allowed (default: all)
+	Appname        string                // STARTTLS application name
+	Servicename    string                // Servicename, if different from server
+	HelloName      string                // SMTP EHLO name (default: local hostname)
+	SNI            string                // TLS SNI to send, if different from server
+	NoSNI          bool                  // Don't send SNI (the name is still checked)
+	AcceptNames    []string              // Names to accept in the certificate, instead of server
+	Transcript     string                // StartTLS transcript
+	MaxPreamble    int                   // Max bytes read before STARTTLS (0: 64KB)
+	TimeoutSTLS    int                   // STARTTLS dialog timeout in seconds (0: 60)
+	DANE           bool                  // do DANE authentication
+	PKIX           bool                  // fall back to PKIX authentication
+	Okdane         bool                  // DANE authentication result
+	Okpkix         bool                  // PKIX authentication result
+	PinnedSPKI     []string              // SPKI SHA-256 hex digests to pin (no DANE/PKIX)
+	ExtraVerify    VerifyFunc            // Additional verification after authentication (optional)
+	Okpin          bool                  // SPKI pin authentication result
+	MatchedTLSA    *TLSArdata            // TLSA record that authenticated the server
+	TLSA           *TLSAinfo             // TLSA RRset information
+	Resolver       *Resolver             // Resolver for DialTLSResolve lookups
+	Logger         Logger                // Logger for diagnostic output (optional)
+	Timings        Timings               // Connection timing measurements
+	DNSExpires     time.Time             // When the TLSA and address record TTLs expire (if known)
+	TLSConn        *tls.Conn             // TLS connection established with this Config
+	PeerChain      []*x509.Certificate   // Peer Certificate Chain
+	LeafSANs       []string              // DNS subject alternative names of the EE certificate
+	NameMatches    []string              // Accepted names that the EE certificate matched
+	Expiry         bool                  // Record EE certificate validity period
+	EEValidity     *CertValidity         // EE certificate validity (if Expiry set)
+	HasSCT         bool                  // Server presented CT SCTs
+	SCTCount       int                   // Number of CT SCTs presented
+	CTLogs         []*CTLog              // CT logs to verify SCTs against
+	RequireCT      bool                  // Require a valid SCT from one of CTLogs
+	ValidSCTs      int                   // Number of SCTs verified with CTLogs
+	PKIXChains     [][]*x509.Certificate // PKIX Certificate Chains (to a trusted root)
+	DANEChains     [][]*x509.Certificate // DANE Certificate Chains (to the last peer cert)
+	ChainChecks    []*ChainCheck         // TLSA record matches against each chain
 }
 
 // NewConfig initializes and returns a new dane Config structure
@@ -42,6 +98,94 @@ func NewConfig(hostname string, ip interface{}, port int) *Config {
 	return c
 }
 
+// Clone returns a copy of the Config, for use as a per-connection
+// configuration derived from a shared template. The settings, Server and
+// TLSA information are copied, while the per-connection result fields
+// (authentication status, certificate chains, transcript, and diagnostic
+// error) are reset. The Resolver and Logger are shared with the original.
+func (c *Config) Clone() *Config {
+
+	n := *c
+	if c.Server != nil {
+		server := *c.Server
+		server.Ipaddr = append(server.Ipaddr[:0:0], c.Server.Ipaddr...)
+		n.Server = &server
+	}
+	if c.PKIXRootCA != nil {
+		n.PKIXRootCA = append([]byte(nil), c.PKIXRootCA...)
+	}
+	if c.DANERootCA != nil {
+		n.DANERootCA = append([]byte(nil), c.DANERootCA...)
+	}
+	if c.ALPN != nil {
+		n.SetALPN(c.ALPN)
+	}
+	if c.PreferUsage != nil {
+		n.SetPreferUsage(c.PreferUsage)
+	}
+	if c.AllowUsages != nil {
+		n.SetAllowUsages(c.AllowUsages)
+	}
+	if c.AllowSelectors != nil {
+		n.SetAllowSelectors(c.AllowSelectors)
+	}
+	if c.AllowMtypes != nil {
+		n.SetAllowMtypes(c.AllowMtypes)
+	}
+	if c.AcceptNames != nil {
+		n.SetAcceptNames(c.AcceptNames)
+	}
+	if c.PinnedSPKI != nil {
+		n.SetPinnedSPKI(c.PinnedSPKI)
+	}
+	if c.CTLogs != nil {
+		n.CTLogs = append([]*CTLog(nil), c.CTLogs...)
+	}
+	n.TLSA = nil
+	n.SetTLSA(c.TLSA)
+	n.ResetResults()
+	return &n
+}
+
+// ResetResults clears the per-connection result fields of Config (the
+// authentication results, certificate chains, transcript, timings and
+// diagnostic error), and unchecks the TLSA records, so that the Config
+// can be reused for another connection, such as a retry to a different
+// server address. The settings and TLSA records are kept.
+func (c *Config) ResetResults() {
+	c.DiagError = nil
+	c.Transcript = ""
+	c.Okdane = false
+	c.Okpkix = false
+	c.Okpin = false
+	c.MatchedTLSA = nil
+	c.PeerChain = nil
+	c.LeafSANs = nil
+	c.NameMatches = nil
+	c.EEValidity = nil
+	c.HasSCT = false
+	c.SCTCount = 0
+	c.ValidSCTs = 0
+	c.PKIXChains = nil
+	c.DANEChains = nil
+	c.ChainChecks = nil
+	c.Timings = Timings{}
+	c.TLSConn = nil
+	if c.TLSA != nil {
+		c.TLSA.Uncheck()
+	}
+}
+
+// resetAttempt clears the per-connection results of the Config before
+// another connection attempt with it, as ResetResults does, but keeps the
+// TLSA and address lookup timings, which apply to all attempts.
+func (c *Config) resetAttempt() {
+	timings := c.Timings
+	c.ResetResults()
+	c.Timings.TLSALookup = timings.TLSALookup
+	c.Timings.AddressLookup = timings.AddressLookup
+}
+
 // SetServer set the Server component of Config.
 func (c *Config) SetServer(server *Server) {
 	c.Server = server
@@ -57,29 +201,454 @@ func (c *Config) SetTLSA(tlsa *TLSAinfo) {
 	}
 }
 
-// SetAppName sets the STARTTLS application name.
+// SetTimeoutTCP sets the TCP connection timeout in seconds.
+func (c *Config) SetTimeoutTCP(timeout int) {
+	c.TimeoutTCP = timeout
+}
+
+// SetTimeoutTLS sets the TLS handshake timeout in seconds. If not set,
+// the TCP connection timeout is used.
+func (c *Config) SetTimeoutTLS(timeout int) {
+	c.TimeoutTLS = timeout
+}
+
+// handshakeTimeout returns the TLS handshake timeout: TimeoutTLS if set,
+// otherwise TimeoutTCP. Zero means no timeout.
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.TimeoutTLS > 0 {
+		return time.Second * time.Duration(c.TimeoutTLS)
+	}
+	return time.Second * time.Duration(c.TimeoutTCP)
+}
+
+// SetKeepAlive sets the TCP keepalive period in seconds. A value of 0
+// uses the system default, and a negative value disables keepalives.
+func (c *Config) SetKeepAlive(keepalive int) {
+	c.KeepAlive = keepalive
+}
+
+// SetDialTarget overrides the network and address that connections are
+// dialed to, which are otherwise TCP and the server's address and port,
+// e.g. "unix" and a socket path, to connect to a local test server or
+// proxy. The server name and port are still used for the TLSA records,
+// SNI and certificate name checks.
+func (c *Config) SetDialTarget(network, address string) {
+	c.Network = network
+	c.DialAddress = address
+}
+
+// dialTarget returns the network and address to dial for the server.
+func (c *Config) dialTarget() (string, string) {
+
+	network, address := c.Network, c.DialAddress
+	if network == "" {
+		network = "tcp"
+	}
+	if address == "" {
+		address = c.Server.Address()
+	}
+	return network, address
+}
+
+// SetLocalAddr sets the local (source) address that connections to the
+// server are dialed from, for example a *net.TCPAddr with only the IP
+// field set, to select a particular egress path on a multi-homed host.
+func (c *Config) SetLocalAddr(addr net.Addr) {
+	c.LocalAddr = addr
+}
+
+// SetDialControl sets a function that is called on the socket before
+// connecting, for setting socket options.
+func (c *Config) SetDialControl(control DialControlFunc) {
+	c.DialControl = control
+}
+
+// SetResolver sets the Resolver used by DialTLSResolve to look up TLSA
+// and address records.
+func (c *Config) SetResolver(resolver *Resolver) {
+	c.Resolver = resolver
+}
+
+// SetLogger sets the Logger used for diagnostic output.
+func (c *Config) SetLogger(logger Logger) {
+	c.Logger = logger
+}
+
+// SetAppName sets the STARTTLS application name. The name "smtps" can
+// be used for SMTP over implicit TLS (port 465) with DialTLS, to apply the
+// same DANE usage mode policy as for SMTP STARTTLS.
 func (c *Config) SetAppName(appname string) {
 	c.Appname = appname
 }
 
+// isSMTP returns whether the Config's application is SMTP, either with
+// STARTTLS or implicit TLS.
+func (c *Config) isSMTP() bool {
+	return c.Appname == "smtp" || c.Appname == "smtps"
+}
+
+// needsSTARTTLS returns whether the Config's application requires a
+// STARTTLS dialog before the TLS handshake.
+func (c *Config) needsSTARTTLS() bool {
+	return c.Appname != "" && c.Appname != "smtps"
+}
+
 // SetServiceName sets the STARTTLS service name.
 func (c *Config) SetServiceName(servicename string) {
 	c.Servicename = servicename
 }
 
+// SetHelloName sets the name sent in the SMTP EHLO command, which should
+// be the fully qualified domain name of the client. If not set, the local
+// hostname is used.
+func (c *Config) SetHelloName(name string) {
+	c.HelloName = name
+}
+
+// helloName returns the name to send in the SMTP EHLO command.
+func (c *Config) helloName() (string, error) {
+	if c.HelloName != "" {
+		return c.HelloName, nil
+	}
+	return os.Hostname()
+}
+
+// SetSNI sets the TLS Server Name Indication (SNI) value to send, if it
+// should differ from the server name. The server name remains the reference
+// identity used for certificate name checks, unless it is empty (as when
+// connecting to a bare IP address), in which case the SNI value is used.
+func (c *Config) SetSNI(sni string) {
+	c.SNI = sni
+}
+
+// SetNoSNI sets whether to send no TLS Server Name Indication at all, for
+// example to test how a server at a given IP address responds to clients
+// that don't send it. The server certificate is still checked against the
+// reference name.
+func (c *Config) SetNoSNI(value bool) {
+	c.NoSNI = value
+}
+
+// referenceName returns the name that the server certificate is checked
+// against, which is distinct from the SNI value sent to the server. This
+// is the Servicename if set (as for STARTTLS and XMPP), otherwise the
+// server name, or the SNI value if the server has no name.
+func (c *Config) referenceName() string {
+	if c.Servicename != "" {
+		return c.Servicename
+	}
+	if c.Server.Name == "" {
+		return c.SNI
+	}
+	return c.Server.Name
+}
+
+// SetAcceptNames sets the list of names that the server certificate is
+// checked against, for a server that is expected to serve several names,
+// such as a multi-tenant endpoint. The certificate is accepted if it
+// matches any of the names, instead of the server (or service) name.
+// The TLSA records are still those of the server name.
+func (c *Config) SetAcceptNames(names []string) {
+	c.AcceptNames = append([]string(nil), names...)
+}
+
+// verifyName checks the server certificate against the reference names:
+// the AcceptNames if set, otherwise the referenceName. All the names that
+// the certificate matches are recorded in NameMatches. Returns nil if it
+// matches any of them, otherwise the error for the first name.
+func (c *Config) verifyName(cert *x509.Certificate) error {
+
+	var firstErr error
+
+	names := c.AcceptNames
+	if len(names) == 0 {
+		names = []string{c.referenceName()}
+	}
+	c.NameMatches = nil
+	for _, name := range names {
+		if err := cert.VerifyHostname(name); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		c.NameMatches = append(c.NameMatches, name)
+	}
+	if len(c.NameMatches) > 0 {
+		return nil
+	}
+	return firstErr
+}
+
 // NoPKIXfallback sets Config to not allow PKIX fallback. Only DANE
-// authentication is permitted.
+// authentication is permitted. The PKIX validation of the server's
+// certificate chain is then skipped too (so Okpkix is not set), unless the
+// TLSA records include PKIX-TA or PKIX-EE records, which require it, or
+// DANE-TA records, which can match a trust anchor that the server didn't
+// send via the PKIX chains.
 func (c *Config) NoPKIXfallback() {
 	c.PKIX = false
 }
 
+// needPKIX returns whether PKIX validation of the server's certificate
+// chain is needed: if PKIX fallback is enabled, there are no TLSA records
+// to authenticate with DANE, or the TLSA records include PKIX or DANE-TA
+// usage modes.
+func (c *Config) needPKIX() bool {
+
+	if c.PKIX || !c.DANE || c.TLSA == nil {
+		return true
+	}
+	for _, tr := range c.TLSA.Rdata {
+		if tr.Usage == PkixTA || tr.Usage == PkixEE || tr.Usage == DaneTA {
+			return true
+		}
+	}
+	return false
+}
+
 // SetDiagMode sets the Diagnostic mode.
 func (c *Config) SetDiagMode(value bool) {
 	c.DiagMode = value
 }
 
+// SetConnOnFail sets whether the connection functions complete the TLS
+// handshake when authentication of the server fails, and return the
+// connection along with the (non-nil) error, so that the server's
+// certificate chain and connection state can still be inspected. The
+// caller is responsible for closing the connection. Unlike DiagMode,
+// an authentication failure is still reported as an error.
+func (c *Config) SetConnOnFail(value bool) {
+	c.ConnOnFail = value
+}
+
+// deferFailure returns whether an authentication failure should be
+// recorded in DiagError rather than failing the TLS handshake.
+func (c *Config) deferFailure() bool {
+	return c.DiagMode || c.ConnOnFail
+}
+
+// failedConn records the given TLS connection in the Config, and returns
+// it with an error wrapping the recorded authentication failure, if
+// authentication failed for a Config with ConnOnFail set. Otherwise it
+// returns the connection and a nil error.
+func (c *Config) failedConn(conn *tls.Conn) (*tls.Conn, error) {
+	c.TLSConn = conn
+	if c.ConnOnFail && c.DiagError != nil {
+		return conn, fmt.Errorf("server authentication failed: %w", c.DiagError)
+	}
+	return conn, nil
+}
+
+// ExportKeyingMaterial returns length bytes of keying material exported
+// (per RFC 5705, or RFC 8446 for TLS 1.3) from the TLS connection last
+// established with this Config, such as by DialTLS, for use by protocols
+// layered over the DANE authenticated connection, e.g. for channel
+// binding. The label and context are as defined by the application
+// protocol; context may be nil.
+func (c *Config) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if c.TLSConn == nil {
+		return nil, fmt.Errorf("no TLS connection established with Config")
+	}
+	cs := c.TLSConn.ConnectionState()
+	return cs.ExportKeyingMaterial(label, context, length)
+}
+
+// SetResumption sets whether TLS session resumption is allowed. It is
+// disabled by default, so that every connection is authenticated with
+// a full handshake. If enabled, the tls Config from GetTLSconfig needs a
+// ClientSessionCache for resumption to happen, and resumed sessions are
+// authenticated against the current TLSA records.
+func (c *Config) SetResumption(value bool) {
+	c.Resumption = value
+}
+
+// SetReportExpiry sets whether to record the validity period of the server's
+// EE certificate in EEValidity. This does not affect authentication.
+func (c *Config) SetReportExpiry(value bool) {
+	c.Expiry = value
+}
+
+// SetRequireCT requires that the server present at least one Certificate
+// Transparency SCT (embedded in its certificate or in the TLS handshake)
+// with a valid signature from one of the given CT logs. This is checked in
+// addition to, and after, DANE or PKIX authentication, and does not depend
+// on PKIX: it can be combined with DANE-EE (and DaneEEname) for defense in
+// depth. SCTs stapled in OCSP responses are not checked.
+func (c *Config) SetRequireCT(logs []*CTLog) {
+	c.RequireCT = true
+	c.CTLogs = append([]*CTLog(nil), logs...)
+}
+
+// SetDANERootCA sets a PEM bundle of candidate trust anchor certificates
+// for DANE-TA (usage 2) TLSA records, for servers that omit their trust
+// anchor (typically a root certificate) from the chain they send. A
+// candidate is only considered if it issued (and signed) the last
+// certificate of a DANE chain, in which case it is appended to the chain.
+func (c *Config) SetDANERootCA(pem []byte) {
+	c.DANERootCA = append([]byte(nil), pem...)
+}
+
+// SetPinnedSPKI sets a list of expected server public key pins, each
+// a hex encoded SHA-256 digest of the SubjectPublicKeyInfo (the same as
+// the data of a "3 1 1" TLSA record, as computed by ComputeTLSA(1, 1,
+// cert)). If set, the server is authenticated only by matching its
+// public key against these pins, without any TLSA records, DNS lookups,
+// or PKIX validation. The result is recorded in Okpin.
+func (c *Config) SetPinnedSPKI(pins []string) {
+	c.PinnedSPKI = append([]string(nil), pins...)
+}
+
+// SetExtraVerify sets a function to perform additional verification
+// of the server certificate chain (for example against local policy),
+// after it has been authenticated. If it returns an error, the
+// connection fails.
+func (c *Config) SetExtraVerify(verify VerifyFunc) {
+	c.ExtraVerify = verify
+}
+
+// SetPreferUsage sets the order in which TLSA records are evaluated by
+// usage mode, e.g. []uint8{DaneEE, DaneTA} to prefer DANE-EE records. The
+// first matching record in this order is recorded in MatchedTLSA.
+func (c *Config) SetPreferUsage(usages []uint8) {
+	c.PreferUsage = make([]uint8, len(usages))
+	copy(c.PreferUsage, usages)
+}
+
+// SetAllowUsages restricts the TLSA usage modes that can authenticate the
+// server to the given list, e.g. []uint8{DaneEE} to accept only DANE-EE
+// records. Records with other usage modes are ignored. This generalizes
+// the usage mode restriction applied for SMTP to any application, and if
+// set, replaces the SMTP restriction (and the SMTPAnyMode option).
+func (c *Config) SetAllowUsages(usages []uint8) {
+	c.AllowUsages = make([]uint8, len(usages))
+	copy(c.AllowUsages, usages)
+}
+
+// SetAllowSelectors restricts the TLSA selectors that can authenticate
+// the server to the given list, e.g. []uint8{1} to accept only records
+// matching the subject public key. Records with other selectors are
+// ignored.
+func (c *Config) SetAllowSelectors(selectors []uint8) {
+	c.AllowSelectors = make([]uint8, len(selectors))
+	copy(c.AllowSelectors, selectors)
+}
+
+// SetAllowMtypes restricts the TLSA matching types that can authenticate
+// the server to the given list, e.g. []uint8{1} to accept only SHA-256
+// digests, rejecting full value and SHA-512 records. Records with other
+// matching types are ignored.
+func (c *Config) SetAllowMtypes(mtypes []uint8) {
+	c.AllowMtypes = make([]uint8, len(mtypes))
+	copy(c.AllowMtypes, mtypes)
+}
+
 // SetALPN sets ALPN strings to be used.
 func (c *Config) SetALPN(alpnStrings []string) {
 	c.ALPN = make([]string, len(alpnStrings))
 	copy(c.ALPN, alpnStrings)
 }
+
+// PeerChainPEM returns the peer certificate chain as a PEM bundle.
+func (c *Config) PeerChainPEM() []byte {
+	return certsToPEMBytes(c.PeerChain)
+}
+
+// VerifiedChainsPEM returns the PKIX and DANE verified certificate chains,
+// each as a PEM bundle.
+func (c *Config) VerifiedChainsPEM() [][]byte {
+
+	var out [][]byte
+
+	for _, chain := range c.PKIXChains {
+		out = append(out, certsToPEMBytes(chain))
+	}
+	for _, chain := range c.DANEChains {
+		out = append(out, certsToPEMBytes(chain))
+	}
+	return out
+}
+
+// PrintChain writes a description of the server's certificate chain to w:
+// the subject, issuer, validity period, and SPKI SHA-256 digest of each
+// certificate in PeerChain, annotated with the TLSA records (if any) whose
+// data matches the certificate. Certificates in the first PKIX verified
+// chain that the server did not send (such as the trust anchor) follow.
+func (c *Config) PrintChain(w io.Writer) {
+
+	if len(c.PeerChain) == 0 {
+		fmt.Fprintf(w, "No peer certificate chain available.\n")
+		return
+	}
+
+	chain := c.PeerChain
+	sent := len(chain)
+	if len(c.PKIXChains) > 0 && len(c.PKIXChains[0]) > sent {
+		chain = append(chain[:sent:sent], c.PKIXChains[0][sent:]...)
+	}
+
+	for depth, cert := range chain {
+		note := ""
+		if depth >= sent {
+			note = " (not sent by server)"
+		}
+		fmt.Fprintf(w, "%d Subject: %s%s\n", depth, cert.Subject, note)
+		fmt.Fprintf(w, "  Issuer: %s\n", cert.Issuer)
+		fmt.Fprintf(w, "  Validity: %s to %s\n",
+			cert.NotBefore.UTC().Format(time.RFC3339),
+			cert.NotAfter.UTC().Format(time.RFC3339))
+		if spki, err := ComputeTLSA(1, 1, cert); err == nil {
+			fmt.Fprintf(w, "  SPKI SHA-256: %s\n", spki)
+		}
+		if c.TLSA == nil {
+			continue
+		}
+		for _, tr := range c.TLSA.MatchesCert(cert) {
+			note = ""
+			if tr == c.MatchedTLSA {
+				note = " (authenticated)"
+			}
+			fmt.Fprintf(w, "  <- matched by TLSA %d %d %d%s\n",
+				tr.Usage, tr.Selector, tr.Mtype, note)
+		}
+	}
+}
+
+// DaneFailureReason returns an explanation of why DANE authentication did
+// not succeed for the connection made with this Config, or an empty string
+// if it did. The common case of having no TLSA records at all is usually
+// due to the resolver not validating DNSSEC: the TLSA records are only
+// used if the response is authenticated (see Resolver.VerifyValidating).
+func (c *Config) DaneFailureReason() string {
+
+	switch {
+	case c.Okdane:
+		return ""
+	case c.NoVerify:
+		return "server certificate verification disabled (NoVerify)"
+	case len(c.PinnedSPKI) > 0:
+		return "SPKI pinning mode: DANE authentication not attempted"
+	case !c.DANE:
+		return "DANE authentication disabled (PKIX only mode)"
+	case c.TLSA == nil:
+		return "no authenticated TLSA records: none published, or the resolver did not validate the response (no AD bit)"
+	case len(c.PeerChain) == 0:
+		return "no server certificate chain received"
+	}
+
+	var reasons []string
+	for _, tr := range c.TLSA.Rdata {
+		if !tr.Checked {
+			continue
+		}
+		reason := fmt.Sprintf("%d %d %d", tr.Usage, tr.Selector, tr.Mtype)
+		if tr.Message != "" {
+			reason += ": " + tr.Message
+		}
+		reasons = append(reasons, reason)
+	}
+	if len(reasons) == 0 {
+		return "TLSA records found but none were usable"
+	}
+	return "TLSA records found but none matched: " + strings.Join(reasons, "; ")
+}
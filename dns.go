@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -17,6 +20,51 @@ type Query struct {
 	Class uint16
 }
 
+//
+// QueryInfo contains transport details of a DNS query exchange, for
+// diagnostics: the resolver address that answered, the transport used for
+// the final exchange ("udp" or "tcp", or "exchanger" if the Resolver's
+// DNSExchanger was used, in which case Server is empty), whether a UDP
+// response was truncated (so that the query was retried over TCP), the
+// round trip time of the final exchange, the size of the response
+// message in bytes, and the number of answer records and the smallest
+// TTL among them (in seconds, from the time of the query).
+//
+type QueryInfo struct {
+	Server    string
+	Transport string
+	Truncated bool
+	RTT       time.Duration
+	Size      int
+	Answers   int
+	MinTTL    uint32
+
+	raw []byte // response as received, if from the built-in client
+}
+
+//
+// record records the details of a successful exchange in the QueryInfo,
+// if it is not nil.
+//
+func (qi *QueryInfo) record(server, transport string, rtt time.Duration,
+	response *dns.Msg, raw []byte) {
+
+	if qi == nil || response == nil {
+		return
+	}
+	qi.raw = raw
+	qi.Server = server
+	qi.Transport = transport
+	qi.RTT = rtt
+	qi.Size = response.Len()
+	qi.Answers = len(response.Answer)
+	for i, rr := range response.Answer {
+		if i == 0 || rr.Header().Ttl < qi.MinTTL {
+			qi.MinTTL = rr.Header().Ttl
+		}
+	}
+}
+
 //
 // NewQuery returns an initialized Query structure from the given query
 // parameters.
@@ -40,20 +88,84 @@ func makeQueryMessage(query *Query, resolver *Resolver) *dns.Msg {
 	m.RecursionDesired = resolver.Rdflag
 	m.AuthenticatedData = resolver.Adflag
 	m.CheckingDisabled = resolver.Cdflag
-	m.SetEdns0(resolver.Payload, true)
+	m.SetEdns0(resolver.getPayload(), true)
 	m.Question = make([]dns.Question, 1)
 	m.Question[0] = dns.Question{Name: query.Name, Qtype: query.Type,
 		Qclass: query.Class}
 	return m
 }
 
+//
+// exchange sends a DNS query message on the given connection and reads
+// the response, as the dns.Client's ExchangeWithConn does, but also
+// returns the response message exactly as it was received.
+//
+func exchange(c *dns.Client, m *dns.Msg, conn *dns.Conn) (*dns.Msg, []byte, time.Duration, error) {
+
+	var hdr dns.Header
+	var raw []byte
+	var err error
+
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * time.Duration(defaultDNSTimeout)
+	}
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+
+	if err = conn.WriteMsg(m); err != nil {
+		return nil, nil, 0, err
+	}
+	_, udp := conn.Conn.(net.PacketConn)
+	for {
+		raw, err = conn.ReadMsgHeader(&hdr)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if hdr.Id == m.Id {
+			break
+		}
+		// Over UDP, ignore replies with mismatched IDs, which may be
+		// responses to earlier queries that timed out.
+		if !udp {
+			return nil, nil, 0, dns.ErrId
+		}
+	}
+	rtt := time.Since(start)
+
+	response := new(dns.Msg)
+	if err = response.Unpack(raw); err != nil {
+		return nil, nil, 0, err
+	}
+	return response, raw, rtt, nil
+}
+
+//
+// exchangeAddress sends a DNS query message to the given server address
+// over a new connection, as exchange does.
+//
+func exchangeAddress(c *dns.Client, m *dns.Msg, address string) (*dns.Msg, []byte, time.Duration, error) {
+
+	conn, err := c.Dial(address)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer conn.Close()
+	return exchange(c, m, conn)
+}
+
 //
 // SendQueryUDP sends a DNS query via UDP with timeout and retries if
 // necessary.
 //
-func sendQueryUDP(query *Query, resolver *Resolver) (*dns.Msg, error) {
+func sendQueryUDP(query *Query, resolver *Resolver, info *QueryInfo) (*dns.Msg, error) {
 
 	var response *dns.Msg
+	var raw []byte
+	var rtt time.Duration
 	var err error
 
 	m := makeQueryMessage(query, resolver)
@@ -65,8 +177,9 @@ func sendQueryUDP(query *Query, resolver *Resolver) (*dns.Msg, error) {
 	retries := resolver.Retries
 	for retries > 0 {
 		for _, server := range resolver.Servers {
-			response, _, err = c.Exchange(m, server.Address())
+			response, raw, rtt, err = exchangeAddress(c, m, server.Address())
 			if err == nil {
+				info.record(server.Address(), "udp", rtt, response, raw)
 				return response, err
 			}
 			if nerr, ok := err.(net.Error); ok && !nerr.Timeout() {
@@ -82,9 +195,11 @@ func sendQueryUDP(query *Query, resolver *Resolver) (*dns.Msg, error) {
 //
 // SendQueryTCP sends a DNS query via TCP.
 //
-func sendQueryTCP(query *Query, resolver *Resolver) (*dns.Msg, error) {
+func sendQueryTCP(query *Query, resolver *Resolver, info *QueryInfo) (*dns.Msg, error) {
 
 	var response *dns.Msg
+	var raw []byte
+	var rtt time.Duration
 	var err error
 
 	m := makeQueryMessage(query, resolver)
@@ -94,8 +209,9 @@ func sendQueryTCP(query *Query, resolver *Resolver) (*dns.Msg, error) {
 	c.Timeout = resolver.Timeout
 
 	for _, server := range resolver.Servers {
-		response, _, err = c.Exchange(m, server.Address())
+		response, raw, rtt, err = exchangeAddress(c, m, server.Address())
 		if err == nil {
+			info.record(server.Address(), "tcp", rtt, response, raw)
 			return response, err
 		}
 	}
@@ -103,27 +219,126 @@ func sendQueryTCP(query *Query, resolver *Resolver) (*dns.Msg, error) {
 
 }
 
+//
+// sendQueryPersistentTCP sends a DNS query over a persistent TCP connection
+// to each resolver in turn, establishing the connection if necessary. The
+// resolver's lock is held only while taking a connection from, or returning
+// it to, the pool of idle connections, so a slow exchange does not block
+// other queries; a query that finds no idle connection opens a new one. If
+// the exchange fails on an existing connection (e.g. because the server
+// closed it), the connection is discarded and the query is retried once on
+// a new connection.
+//
+func sendQueryPersistentTCP(query *Query, resolver *Resolver, info *QueryInfo) (*dns.Msg, error) {
+
+	var response *dns.Msg
+	var raw []byte
+	var rtt time.Duration
+	var err error
+
+	m := makeQueryMessage(query, resolver)
+
+	c := new(dns.Client)
+	c.Net = "tcp"
+	c.Timeout = resolver.Timeout
+
+	for _, server := range resolver.Servers {
+		address := server.Address()
+		for attempt := 0; attempt < 2; attempt++ {
+			conn := resolver.takeTCPConn(address)
+			reused := conn != nil
+			if !reused {
+				conn, err = c.Dial(address)
+				if err != nil {
+					break
+				}
+			}
+			response, raw, rtt, err = exchange(c, m, conn)
+			if err == nil {
+				resolver.putTCPConn(address, conn)
+				info.record(address, "tcp", rtt, response, raw)
+				return response, err
+			}
+			conn.Close()
+			if !reused {
+				break
+			}
+		}
+	}
+	return nil, err
+}
+
+//
+// sendQueryExchanger sends a DNS query with the resolver's DNSExchanger.
+//
+func sendQueryExchanger(query *Query, resolver *Resolver, info *QueryInfo) (*dns.Msg, error) {
+
+	m := makeQueryMessage(query, resolver)
+	start := time.Now()
+	response, err := resolver.Exchanger.Exchange(m)
+	if err != nil {
+		return nil, err
+	}
+	info.record("", "exchanger", time.Since(start), response, nil)
+	return response, nil
+}
+
 //
 // SendQuery sends a DNS query via UDP with fallback to TCP upon truncation.
+// If the resolver is configured to use persistent TCP connections, the
+// query is sent over TCP directly, falling back to a new per-query TCP
+// connection on failure.
 //
 func sendQuery(query *Query, resolver *Resolver) (*dns.Msg, error) {
 
+	response, _, err := sendQueryInfo(query, resolver)
+	return response, err
+}
+
+//
+// sendQueryInfo is like sendQuery, but also returns the transport details
+// of the exchange. These are also passed to the resolver's OnExchange
+// function, if it is set.
+//
+func sendQueryInfo(query *Query, resolver *Resolver) (*dns.Msg, *QueryInfo, error) {
+
 	var response *dns.Msg
 	var err error
 
-	response, err = sendQueryUDP(query, resolver)
+	defer resolver.acquire()()
 
-	if err == nil && response.MsgHdr.Truncated {
-		response, err = sendQueryTCP(query, resolver)
+	info := new(QueryInfo)
+	if resolver.Exchanger == nil && len(resolver.Servers) == 0 {
+		return nil, nil, errors.New("no DNS servers configured in resolver")
+	}
+	if resolver.Exchanger != nil {
+		response, err = sendQueryExchanger(query, resolver, info)
+	} else if resolver.PersistentTCP {
+		response, err = sendQueryPersistentTCP(query, resolver, info)
+		if err != nil {
+			response, err = sendQueryTCP(query, resolver, info)
+		}
+	} else {
+		response, err = sendQueryUDP(query, resolver, info)
+		if err == nil && response != nil && response.MsgHdr.Truncated {
+			info.Truncated = true
+			resolver.raisePayload()
+			response, err = sendQueryTCP(query, resolver, info)
+		}
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if response == nil {
-		return nil, errors.New("null response to DNS query")
+		return nil, nil, errors.New("null response to DNS query")
 	}
-	return response, err
+	resolver.keepResponse(query.Type, info.raw)
+	info.raw = nil
+	if resolver.OnExchange != nil {
+		resolver.OnExchange(query, info)
+	}
+	return response, info, err
 }
 
 //
@@ -142,12 +357,31 @@ func responseOK(response *dns.Msg) bool {
 
 //
 // GetAddresses obtains a list of IPv4 and IPv6 addresses for given hostname.
+// If the lookup for one address family fails but the other returns
+// addresses (for example when only the AAAA query gets a SERVFAIL), those
+// addresses are returned, and the failure is logged to the resolver's
+// Logger, so that hosts with broken DNS for one family remain reachable.
+// An error is returned if all the lookups fail or find no addresses, and
+// one of them failed.
 //
 func GetAddresses(resolver *Resolver, hostname string, secure bool) ([]net.IP, error) {
 
+	ipList, _, err := GetAddressesInfo(resolver, hostname, secure)
+	return ipList, err
+}
+
+//
+// GetAddressesInfo is like GetAddresses, but also returns the transport
+// details of the address queries that were answered, keyed by query type
+// (dns.TypeAAAA and dns.TypeA), including the address of the resolver that
+// answered each, for diagnosing a misbehaving resolver in a multi-resolver
+// setup.
+//
+func GetAddressesInfo(resolver *Resolver, hostname string, secure bool) ([]net.IP, map[uint16]*QueryInfo, error) {
+
 	var ipList []net.IP
-	var q *Query
 	var rrTypes []uint16
+	var errs []error
 
 	if resolver.IPv6 {
 		rrTypes = append(rrTypes, dns.TypeAAAA)
@@ -156,78 +390,275 @@ func GetAddresses(resolver *Resolver, hostname string, secure bool) ([]net.IP, e
 		rrTypes = append(rrTypes, dns.TypeA)
 	}
 
+	infos := make(map[uint16]*QueryInfo)
 	for _, rrtype := range rrTypes {
-		q = NewQuery(hostname, rrtype, dns.ClassINET)
-		response, err := sendQuery(q, resolver)
+		addrs, info, err := getAddressesType(resolver, hostname, rrtype, secure)
+		if info != nil {
+			infos[rrtype] = info
+		}
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
-		if !responseOK(response) {
-			return nil, fmt.Errorf("address lookup for %s failed, rcode %d",
-				hostname, response.MsgHdr.Rcode)
+		ipList = append(ipList, addrs...)
+	}
+
+	if len(errs) > 0 {
+		if len(ipList) == 0 {
+			return nil, infos, errs[0]
 		}
-		if response.MsgHdr.Rcode == dns.RcodeNameError {
-			return nil, fmt.Errorf("%s: non-existent domain name", hostname)
+		for _, err := range errs {
+			logf(resolver.Logger, "Ignoring partial address lookup failure: %s", err.Error())
 		}
-		if secure && !response.MsgHdr.AuthenticatedData {
-			return nil, fmt.Errorf("%s address response was not authenticated", hostname)
+	}
+	return ipList, infos, nil
+}
+
+//
+// getAddressesType obtains the addresses of the given type (A or AAAA)
+// for the given hostname, and the transport details of the query, if it
+// was answered.
+//
+func getAddressesType(resolver *Resolver, hostname string, rrtype uint16,
+	secure bool) ([]net.IP, *QueryInfo, error) {
+
+	var ipList []net.IP
+
+	q := NewQuery(hostname, rrtype, dns.ClassINET)
+	response, info, err := sendQueryInfo(q, resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !responseOK(response) {
+		return nil, info, fmt.Errorf("%s address lookup for %s failed, rcode %d",
+			dns.TypeToString[rrtype], hostname, response.MsgHdr.Rcode)
+	}
+	if response.MsgHdr.Rcode == dns.RcodeNameError {
+		return nil, info, fmt.Errorf("%s: non-existent domain name", hostname)
+	}
+	if secure && !response.MsgHdr.AuthenticatedData {
+		if resolver.Cdflag {
+			return nil, info, fmt.Errorf("%s address response was not authenticated: %w",
+				hostname, ErrCheckingDisabled)
 		}
+		return nil, info, fmt.Errorf("%s address response was not authenticated", hostname)
+	}
 
-		for _, rr := range response.Answer {
-			if rr.Header().Rrtype == rrtype {
-				if rrtype == dns.TypeAAAA {
-					ipList = append(ipList, rr.(*dns.AAAA).AAAA)
-				} else if rrtype == dns.TypeA {
-					ipList = append(ipList, rr.(*dns.A).A)
-				}
+	for _, rr := range response.Answer {
+		if rr.Header().Rrtype == rrtype {
+			if rrtype == dns.TypeAAAA {
+				ipList = append(ipList, rr.(*dns.AAAA).AAAA)
+			} else if rrtype == dns.TypeA {
+				ipList = append(ipList, rr.(*dns.A).A)
 			}
 		}
 	}
-
-	return ipList, nil
+	return ipList, info, nil
 }
 
+//
+// Maximum length of a CNAME chain followed for TLSA queries
+//
+const maxCNAMEChain = 16
+
 //
 // Message2TSLAinfo returns a populated TLSAinfo structure from the
 // contents of a given dns message that contains a response to a
 // TLSA query. The qname parameter provides the expected TLSA query
-// name string.
+// name string. The hex encoded certificate association data is
+// normalized to lower case. The validity periods of any RRSIGs covering
+// the TLSA RRset (returned since queries set the DNSSEC OK bit) are
+// recorded in the RRSIG field. Any CNAME chain from the query name is
+// recorded in order in the Alias field, and only TLSA records owned by
+// the target of the chain (or the query name, if there is no chain) are
+// included.
 //
 func Message2TSLAinfo(qname string, message *dns.Msg) *TLSAinfo {
 
+	tlsa, _ := parseTLSAResponse(qname, message)
+	return tlsa
+}
+
+//
+// TLSAinfoFromRRs returns a TLSAinfo structure from a list of DNS
+// resource records for the given query name, for callers that perform
+// their own (DNSSEC validated) DNS lookups. The records are processed as
+// the answer section of a TLSA response by Message2TSLAinfo: CNAME and
+// RRSIG records are used, and other record types are ignored. The caller
+// is responsible for ensuring that the records are authenticated.
+//
+func TLSAinfoFromRRs(qname string, rrs []dns.RR) *TLSAinfo {
+
+	message := new(dns.Msg)
+	message.Answer = rrs
+	return Message2TSLAinfo(qname, message)
+}
+
+//
+// parseTLSAResponse is like Message2TSLAinfo, but also returns an error
+// if the response has TLSA records owned by a name other than the query
+// name or CNAME target, or an invalid CNAME chain.
+//
+func parseTLSAResponse(qname string, message *dns.Msg) (*TLSAinfo, error) {
+
 	var tr *TLSArdata
+	var err error
 
 	tlsa := new(TLSAinfo)
 	tlsa.Qname = dns.Fqdn(qname)
 
+	cnames := make(map[string]string)
+	for _, rr := range message.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			cnames[strings.ToLower(cname.Hdr.Name)] = cname.Target
+		}
+	}
+	owner := tlsa.Qname
+	for {
+		target, ok := cnames[strings.ToLower(owner)]
+		if !ok {
+			break
+		}
+		if len(tlsa.Alias) == maxCNAMEChain {
+			err = fmt.Errorf("%s: CNAME chain too long", tlsa.Qname)
+			break
+		}
+		tlsa.Alias = append(tlsa.Alias, target)
+		owner = target
+	}
+
 	for _, rr := range message.Answer {
 		if tlsarr, ok := rr.(*dns.TLSA); ok {
-			if tlsarr.Hdr.Name != tlsa.Qname {
-				tlsa.Alias = append(tlsa.Alias, tlsarr.Hdr.Name)
+			if !strings.EqualFold(tlsarr.Hdr.Name, owner) {
+				err = fmt.Errorf("TLSA owner name %s does not match %s or its CNAME target",
+					tlsarr.Hdr.Name, tlsa.Qname)
+				continue
 			}
 			tr = new(TLSArdata)
 			tr.Usage = tlsarr.Usage
 			tr.Selector = tlsarr.Selector
 			tr.Mtype = tlsarr.MatchingType
-			tr.Data = tlsarr.Certificate
+			tr.Data = strings.ToLower(tlsarr.Certificate)
+			tr.TTL = tlsarr.Hdr.Ttl
 			tlsa.Rdata = append(tlsa.Rdata, tr)
+		} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeTLSA {
+			tlsa.RRSIG = append(tlsa.RRSIG, &RRSIGinfo{
+				KeyTag:     sig.KeyTag,
+				Algorithm:  sig.Algorithm,
+				SignerName: sig.SignerName,
+				Inception:  time.Unix(int64(sig.Inception), 0).UTC(),
+				Expiration: time.Unix(int64(sig.Expiration), 0).UTC(),
+			})
 		}
 	}
-	return tlsa
+	return tlsa, err
+}
+
+//
+// hasTLSA reports whether the answer section of the given DNS response
+// contains any TLSA records.
+//
+func hasTLSA(response *dns.Msg) bool {
+
+	for _, rr := range response.Answer {
+		if rr.Header().Rrtype == dns.TypeTLSA {
+			return true
+		}
+	}
+	return false
 }
 
 //
 // GetTLSA returns the DNS TLSA RRset information for the given hostname,
-// port and resolver parameters.
+// port and resolver parameters, for a service over TCP.
+//
+// If the response is not authenticated (AD bit not set), and the resolver's
+// Pkixfallback is set, no TLSA information (nil) is returned, so that the
+// caller falls back to PKIX. If the resolver's StrictTLSA is also set, and
+// the unauthenticated response contains TLSA records, an error wrapping
+// ErrInsecureTLSA is returned instead, so that a missing DNSSEC validation
+// can be distinguished from the absence of TLSA records.
 //
 func GetTLSA(resolver *Resolver, hostname string, port int) (*TLSAinfo, error) {
 
-	var q *Query
+	return GetTLSATransport(resolver, hostname, port, "tcp")
+}
 
-	qname := fmt.Sprintf("_%d._tcp.%s", port, hostname)
+//
+// GetTLSAMulti looks up the TLSA RRsets for the given hostname on each of
+// the given ports (over TCP) concurrently, and returns a map of port number
+// to TLSA RRset information. As with GetTLSA, a port with no (secure) TLSA
+// records has a nil entry if the resolver's Pkixfallback is set. A failed
+// lookup for one port does not abort the others: the failed port is left
+// out of the map, and the returned error describes all such failures.
+//
+func GetTLSAMulti(resolver *Resolver, hostname string, ports []int) (map[int]*TLSAinfo, error) {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []string
+
+	results := make(map[int]*TLSAinfo)
+	failed := make(map[int]error)
+
+	for _, port := range ports {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			tlsa, err := GetTLSA(resolver, hostname, port)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[port] = err
+				return
+			}
+			results[port] = tlsa
+		}(port)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return results, nil
+	}
+	for _, port := range ports {
+		if err, ok := failed[port]; ok {
+			errs = append(errs, fmt.Sprintf("port %d: %s", port, err.Error()))
+			delete(failed, port)
+		}
+	}
+	return results, fmt.Errorf("TLSA lookup failed for %s: %s", hostname,
+		strings.Join(errs, "; "))
+}
+
+//
+// GetTLSATransport is like GetTLSA, but allows the transport protocol
+// label of the TLSA query name to be specified: "tcp", "udp" (e.g. for
+// DTLS or QUIC based services), or "sctp".
+//
+func GetTLSATransport(resolver *Resolver, hostname string, port int, transport string) (*TLSAinfo, error) {
+
+	switch transport {
+	case "tcp", "udp", "sctp":
+	default:
+		return nil, fmt.Errorf("unsupported TLSA transport: %s", transport)
+	}
+
+	qname := fmt.Sprintf("_%d._%s.%s", port, transport, hostname)
+	return GetTLSAByName(resolver, qname)
+}
+
+//
+// GetTLSAByName is like GetTLSA, but queries the TLSA records at the given
+// owner name, rather than constructing it from a hostname, port and
+// transport. This is for callers that compute the TLSA owner name
+// themselves, such as for non-standard deployments or testing.
+//
+func GetTLSAByName(resolver *Resolver, qname string) (*TLSAinfo, error) {
+
+	var q *Query
 
 	q = NewQuery(qname, dns.TypeTLSA, dns.ClassINET)
-	response, err := sendQuery(q, resolver)
+	response, info, err := sendQueryInfo(q, resolver)
 
 	if err != nil {
 		return nil, err
@@ -239,9 +670,23 @@ func GetTLSA(resolver *Resolver, hostname string, port int) (*TLSAinfo, error) {
 	}
 
 	if !response.MsgHdr.AuthenticatedData {
-		if resolver.Pkixfallback {
+		if resolver.Cdflag {
+			// Don't let the CD flag silently disable DANE.
+			logf(resolver.Logger, "%s/TLSA: response unauthenticated, "+
+				"resolver CD flag is set", qname)
+		}
+		present := hasTLSA(response)
+		if resolver.Pkixfallback && !(present && resolver.StrictTLSA) {
 			return nil, nil
 		}
+		if resolver.Cdflag {
+			return nil, fmt.Errorf("response unauthenticated: %s/TLSA: %w",
+				qname, ErrCheckingDisabled)
+		}
+		if present {
+			return nil, fmt.Errorf("response unauthenticated: %s/TLSA: %w",
+				qname, ErrInsecureTLSA)
+		}
 		return nil, fmt.Errorf("response unauthenticated: %s/TLSA", qname)
 	}
 
@@ -249,16 +694,20 @@ func GetTLSA(resolver *Resolver, hostname string, port int) (*TLSAinfo, error) {
 		if resolver.Pkixfallback {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("%s: non-existent domain name", hostname)
+		return nil, fmt.Errorf("%s: non-existent domain name", qname)
 	}
 
-	tlsa := Message2TSLAinfo(q.Name, response)
+	tlsa, err := parseTLSAResponse(q.Name, response)
+	if err != nil {
+		return nil, err
+	}
+	tlsa.Query = info
 
 	if len(tlsa.Rdata) == 0 {
 		if resolver.Pkixfallback {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("no TLSA records found: %s", qname)
+		return nil, fmt.Errorf("%w: %s", ErrNoTLSA, qname)
 	}
 
 	return tlsa, err
@@ -7,7 +7,19 @@ package dane
  */
 
 import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -16,7 +28,7 @@ var hostname = "www.example.com"
 
 func TestSendQueryUDP(t *testing.T) {
 	query := NewQuery(hostname, dns.TypeA, dns.ClassINET)
-	msg, err := sendQueryUDP(query, resolver1)
+	msg, err := sendQueryUDP(query, resolver1, nil)
 	if err != nil {
 		t.Fatalf("SendQueryUDP error: %s\n", err.Error())
 	}
@@ -25,7 +37,7 @@ func TestSendQueryUDP(t *testing.T) {
 
 func TestSendQueryTCP(t *testing.T) {
 	query := NewQuery(hostname, dns.TypeA, dns.ClassINET)
-	msg, err := sendQueryTCP(query, resolver1)
+	msg, err := sendQueryTCP(query, resolver1, nil)
 	if err != nil {
 		t.Fatalf("SendQueryTCP error: %s\n", err.Error())
 	}
@@ -49,3 +61,847 @@ func TestGetTLSA(t *testing.T) {
 	}
 	_ = tlsa
 }
+
+func TestMessage2TLSAinfoUppercase(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+	data, err := ComputeTLSA(1, 1, ee)
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+
+	qname := "_443._tcp.www.example.com."
+	rr, err := dns.NewRR(fmt.Sprintf("%s 300 IN TLSA 3 1 1 %s", qname,
+		strings.ToUpper(data)))
+	if err != nil {
+		t.Fatalf("dns.NewRR: %s", err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(qname, dns.TypeTLSA)
+	msg.Answer = append(msg.Answer, rr)
+
+	tlsa := Message2TSLAinfo(qname, msg)
+	if len(tlsa.Rdata) != 1 {
+		t.Fatalf("Message2TSLAinfo: got %d records, expected 1", len(tlsa.Rdata))
+	}
+	if tlsa.Rdata[0].Data != data {
+		t.Fatalf("Message2TSLAinfo: data not normalized: %s", tlsa.Rdata[0].Data)
+	}
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	if !ChainMatchesTLSA([]*x509.Certificate{ee, ca}, tlsa.Rdata[0], daneconfig) {
+		t.Fatalf("uppercase TLSA data did not match: %s", tlsa.Rdata[0].Message)
+	}
+}
+
+func TestGetTLSATransport(t *testing.T) {
+	tlsa, err := GetTLSATransport(resolver1, hostname, 443, "udp")
+	if err != nil {
+		t.Fatalf("GetTLSATransport error: %s\n", err.Error())
+	}
+	_ = tlsa
+	_, err = GetTLSATransport(resolver1, hostname, 443, "quic")
+	if err == nil {
+		t.Fatalf("GetTLSATransport: expected error for unknown transport\n")
+	}
+}
+
+// countingListener counts the connections accepted by a net.Listener.
+type countingListener struct {
+	net.Listener
+	accepts int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepts, 1)
+	}
+	return conn, err
+}
+
+// startTestDNSServer starts a local DNS server over TCP that answers
+// every A query with 192.0.2.1 (after a delay for names beginning with
+// "slow."), TLSA queries for port 443 with a DANE-EE record, and HTTPS
+// queries with two records, and returns a Resolver that uses it.
+// Like a validating resolver, it sets the AD bit unless the query has the
+// CD bit set, or the query name is under "insecure.example.com".
+func startTestDNSServer(t *testing.T) (*Resolver, *countingListener, func()) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	listener := &countingListener{Listener: ln}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		qname := r.Question[0].Name
+		m.AuthenticatedData = !r.CheckingDisabled &&
+			!strings.HasSuffix(qname, ".insecure.example.com.")
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			if strings.HasPrefix(qname, "slow.") {
+				time.Sleep(500 * time.Millisecond)
+			}
+			rr, _ := dns.NewRR(qname + " 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		case dns.TypeAAAA:
+			if strings.HasPrefix(qname, "brokenv6.") {
+				m.Rcode = dns.RcodeServerFailure
+			}
+		case dns.TypeTLSA:
+			if strings.HasPrefix(qname, "_443.") {
+				rr, _ := dns.NewRR(qname + " 300 IN TLSA 3 1 1 " +
+					strings.Repeat("ab", 32))
+				m.Answer = append(m.Answer, rr)
+			}
+		case dns.TypeHTTPS:
+			for _, data := range []string{
+				"2 alt.example.net. alpn=h2",
+				"1 . alpn=h3,h2 port=8443",
+			} {
+				rr, _ := dns.NewRR(qname + " 300 IN HTTPS " + data)
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(m)
+	})
+	server := &dns.Server{Listener: listener, Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	resolver := NewResolver([]*Server{NewServer("", addr.IP, addr.Port)})
+	return resolver, listener, func() { _ = server.Shutdown() }
+}
+
+func TestPersistentTCPOffline(t *testing.T) {
+
+	resolver, listener, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	resolver.IPv6 = false
+	defer resolver.Close()
+
+	for i := 0; i < 3; i++ {
+		iplist, err := GetAddresses(resolver, hostname, true)
+		if err != nil {
+			t.Fatalf("GetAddresses: %s", err)
+		}
+		if len(iplist) != 1 || !iplist[0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("GetAddresses: unexpected answer %v", iplist)
+		}
+	}
+	if n := atomic.LoadInt32(&listener.accepts); n != 1 {
+		t.Fatalf("PersistentTCP: %d connections for 3 queries, expected 1", n)
+	}
+}
+
+func TestPersistentTCPConcurrentOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	resolver.IPv6 = false
+	defer resolver.Close()
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := GetAddresses(resolver, "slow.example.com", true)
+		slow <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := GetAddresses(resolver, hostname, true); err != nil {
+		t.Fatalf("GetAddresses: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("PersistentTCP: query blocked behind slow query for %s", elapsed)
+	}
+	if err := <-slow; err != nil {
+		t.Fatalf("GetAddresses (slow): %s", err)
+	}
+}
+
+func TestCdflagOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	resolver.IPv6 = false
+	resolver.Cdflag = true
+	defer resolver.Close()
+
+	_, err := GetAddresses(resolver, hostname, true)
+	if !errors.Is(err, ErrCheckingDisabled) {
+		t.Fatalf("GetAddresses: expected ErrCheckingDisabled, got %v", err)
+	}
+	iplist, err := GetAddresses(resolver, hostname, false)
+	if err != nil || len(iplist) != 1 {
+		t.Fatalf("GetAddresses (insecure): %v %s", iplist, err)
+	}
+}
+
+func TestAutoPayloadOffline(t *testing.T) {
+
+	resolver := NewResolver(nil)
+	if resolver.getPayload() != DefaultPayload {
+		t.Fatalf("Payload %d, expected %d", resolver.getPayload(), DefaultPayload)
+	}
+	resolver.raisePayload()
+	if resolver.getPayload() != DefaultPayload {
+		t.Fatalf("Payload raised without AutoPayload")
+	}
+	resolver.AutoPayload = true
+	resolver.raisePayload()
+	if resolver.getPayload() != MaxPayload {
+		t.Fatalf("Payload %d, expected %d", resolver.getPayload(), MaxPayload)
+	}
+}
+
+func TestNoServersOffline(t *testing.T) {
+
+	resolver := NewResolver(nil)
+	_, err := GetAddresses(resolver, "www.example.com", true)
+	if err == nil || !strings.Contains(err.Error(), "no DNS servers") {
+		t.Fatalf("GetAddresses: expected no servers error, got %v", err)
+	}
+}
+
+func TestMessage2TLSAinfoRRSIG(t *testing.T) {
+
+	qname := "_443._tcp.www.example.com."
+	msg := new(dns.Msg)
+	msg.SetQuestion(qname, dns.TypeTLSA)
+	for _, s := range []string{
+		qname + " 300 IN TLSA 3 1 1 " + strings.Repeat("ab", 32),
+		qname + " 300 IN RRSIG TLSA 13 5 300 20301231000000 20201231000000 12345 example.com. AAAA",
+		qname + " 300 IN RRSIG TLSA 8 5 300 20291231000000 20201231000000 54321 example.com. AAAA",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("dns.NewRR: %s", err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	tlsa := Message2TSLAinfo(qname, msg)
+	if len(tlsa.RRSIG) != 2 {
+		t.Fatalf("Message2TSLAinfo: got %d RRSIGs, expected 2", len(tlsa.RRSIG))
+	}
+	expiration, ok := tlsa.SigExpiration()
+	if !ok || !expiration.Equal(time.Date(2029, 12, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("SigExpiration: got %s", expiration)
+	}
+	if tlsa.RRSIG[0].KeyTag != 12345 || tlsa.Copy().RRSIG[1].KeyTag != 54321 {
+		t.Fatalf("Message2TSLAinfo: unexpected RRSIG details")
+	}
+}
+
+func TestParseTLSAResponseCNAME(t *testing.T) {
+
+	qname := "_443._tcp.www.example.com."
+	data := strings.Repeat("ab", 32)
+
+	testCases := []struct {
+		name      string
+		records   []string
+		alias     []string
+		count     int
+		neederror bool
+	}{
+		{"no alias", []string{
+			qname + " 300 IN TLSA 3 1 1 " + data,
+		}, nil, 1, false},
+		{"CNAME chain", []string{
+			"_443._tcp.cdn.example.net. 300 IN TLSA 3 1 1 " + data,
+			"_443._tcp.edge.example.net. 300 IN CNAME _443._tcp.cdn.example.net.",
+			qname + " 300 IN CNAME _443._tcp.edge.example.net.",
+		}, []string{"_443._tcp.edge.example.net.", "_443._tcp.cdn.example.net."}, 1, false},
+		{"unexpected owner", []string{
+			qname + " 300 IN TLSA 3 1 1 " + data,
+			"_443._tcp.other.example.net. 300 IN TLSA 3 1 1 " + data,
+		}, nil, 1, true},
+		{"owner not at CNAME target", []string{
+			qname + " 300 IN CNAME _443._tcp.cdn.example.net.",
+			qname + " 300 IN TLSA 3 1 1 " + data,
+		}, []string{"_443._tcp.cdn.example.net."}, 0, true},
+	}
+	for _, tc := range testCases {
+		msg := new(dns.Msg)
+		msg.SetQuestion(qname, dns.TypeTLSA)
+		for _, s := range tc.records {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("%s: dns.NewRR: %s", tc.name, err)
+			}
+			msg.Answer = append(msg.Answer, rr)
+		}
+		tlsa, err := parseTLSAResponse(qname, msg)
+		if (err != nil) != tc.neederror {
+			t.Fatalf("%s: unexpected error result: %v", tc.name, err)
+		}
+		if fmt.Sprint(tlsa.Alias) != fmt.Sprint(tc.alias) {
+			t.Fatalf("%s: alias %v, expected %v", tc.name, tlsa.Alias, tc.alias)
+		}
+		if len(tlsa.Rdata) != tc.count {
+			t.Fatalf("%s: got %d TLSA records, expected %d", tc.name,
+				len(tlsa.Rdata), tc.count)
+		}
+	}
+}
+
+func TestGetTLSAMultiOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+
+	ports := []int{443, 25, 993}
+	results, err := GetTLSAMulti(resolver, hostname, ports)
+	if err != nil {
+		t.Fatalf("GetTLSAMulti: %s", err)
+	}
+	if len(results) != len(ports) {
+		t.Fatalf("GetTLSAMulti: %d results, expected %d", len(results), len(ports))
+	}
+	if results[443] == nil || len(results[443].Rdata) != 1 {
+		t.Fatalf("GetTLSAMulti: port 443: expected 1 TLSA record")
+	}
+	if results[25] != nil || results[993] != nil {
+		t.Fatalf("GetTLSAMulti: unexpected TLSA records for ports 25/993")
+	}
+
+	resolver.Pkixfallback = false
+	resolver.Cdflag = true
+	results, err = GetTLSAMulti(resolver, hostname, ports)
+	if err == nil || len(results) != 0 {
+		t.Fatalf("GetTLSAMulti: expected failure for all ports: %v", results)
+	}
+	if !strings.Contains(err.Error(), "port 25:") {
+		t.Fatalf("GetTLSAMulti: error missing port detail: %s", err)
+	}
+}
+
+func TestStrictTLSAOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+
+	insecure := "www.insecure.example.com"
+	tlsa, err := GetTLSA(resolver, insecure, 443)
+	if err != nil || tlsa != nil {
+		t.Fatalf("GetTLSA: expected fallback (nil, nil), got %v, %v", tlsa, err)
+	}
+
+	resolver.StrictTLSA = true
+	_, err = GetTLSA(resolver, insecure, 443)
+	if !errors.Is(err, ErrInsecureTLSA) {
+		t.Fatalf("GetTLSA: expected ErrInsecureTLSA, got %v", err)
+	}
+	tlsa, err = GetTLSA(resolver, insecure, 25)
+	if err != nil || tlsa != nil {
+		t.Fatalf("GetTLSA: no records: expected (nil, nil), got %v, %v", tlsa, err)
+	}
+
+	resolver.StrictTLSA = false
+	resolver.Pkixfallback = false
+	_, err = GetTLSA(resolver, insecure, 443)
+	if !errors.Is(err, ErrInsecureTLSA) {
+		t.Fatalf("GetTLSA: no fallback: expected ErrInsecureTLSA, got %v", err)
+	}
+}
+
+func TestTLSAinfoFromRRsOffline(t *testing.T) {
+
+	qname := "_443._tcp.www.example.com."
+	var rrs []dns.RR
+	for _, s := range []string{
+		qname + " 300 IN TLSA 3 1 1 " + strings.Repeat("AB", 32),
+		qname + " 300 IN TLSA 2 0 1 " + strings.Repeat("cd", 32),
+		"www.example.com. 300 IN A 192.0.2.1",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("dns.NewRR: %s", err)
+		}
+		rrs = append(rrs, rr)
+	}
+
+	tlsa := TLSAinfoFromRRs(qname, rrs)
+	if len(tlsa.Rdata) != 2 {
+		t.Fatalf("TLSAinfoFromRRs: got %d records, expected 2", len(tlsa.Rdata))
+	}
+	if tlsa.Rdata[0].Data != strings.Repeat("ab", 32) || tlsa.Rdata[1].Usage != DaneTA {
+		t.Fatalf("TLSAinfoFromRRs: unexpected records: %v", tlsa.Rdata)
+	}
+}
+
+func TestGetSVCBOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+
+	svcb, err := GetSVCB(resolver, hostname)
+	if err != nil {
+		t.Fatalf("GetSVCB: %s", err)
+	}
+	if len(svcb) != 2 || svcb[0].Priority != 1 || svcb[0].Port != 8443 {
+		t.Fatalf("GetSVCB: unexpected records: %+v", svcb)
+	}
+	s := selectSVCB(svcb, hostname)
+	if s != svcb[0] {
+		t.Fatalf("selectSVCB: selected %+v", s)
+	}
+	alpn := s.tcpALPN()
+	if strings.Join(alpn, ",") != "h2,http/1.1" {
+		t.Fatalf("tcpALPN: %v, expected [h2 http/1.1]", alpn)
+	}
+
+	svcb, err = GetSVCB(resolver, "www.insecure.example.com")
+	if err != nil || svcb != nil {
+		t.Fatalf("GetSVCB: insecure: expected (nil, nil), got %v, %v", svcb, err)
+	}
+}
+
+func TestGetAllResolversOffline(t *testing.T) {
+
+	resconf := filepath.Join(t.TempDir(), "resolv.conf")
+	data := "nameserver 192.0.2.53\nnameserver bogus\nnameserver 2001:db8::53\n"
+	if err := os.WriteFile(resconf, []byte(data), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	resolver, err := GetResolver(resconf)
+	if err != nil {
+		t.Fatalf("GetResolver: %s", err)
+	}
+	if len(resolver.Servers) != 2 {
+		t.Fatalf("GetResolver: %d servers, expected 2", len(resolver.Servers))
+	}
+
+	resolvers, err := GetAllResolvers(resconf)
+	if err != nil {
+		t.Fatalf("GetAllResolvers: %s", err)
+	}
+	if len(resolvers) != 2 {
+		t.Fatalf("GetAllResolvers: %d resolvers, expected 2", len(resolvers))
+	}
+	for i, r := range resolvers {
+		if len(r.Servers) != 1 || !r.Servers[0].Ipaddr.Equal(resolver.Servers[i].Ipaddr) {
+			t.Fatalf("GetAllResolvers: resolver %d: unexpected servers", i)
+		}
+	}
+}
+
+func TestResolvConfOptionsOffline(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		data    string
+		timeout time.Duration
+		retries int
+	}{
+		{"nameserver 192.0.2.53\n", time.Second * time.Duration(defaultDNSTimeout),
+			defaultDNSRetries},
+		{"nameserver 192.0.2.53\noptions timeout:7 attempts:4\n", 7 * time.Second, 4},
+		{"nameserver 192.0.2.53\noptions ndots:2 attempts:1\n",
+			time.Second * time.Duration(defaultDNSTimeout), 1},
+	} {
+		resconf := filepath.Join(dir, "resolv.conf")
+		if err := os.WriteFile(resconf, []byte(tc.data), 0644); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		resolver, err := GetResolver(resconf)
+		if err != nil {
+			t.Fatalf("GetResolver: %s", err)
+		}
+		if resolver.Timeout != tc.timeout || resolver.Retries != tc.retries {
+			t.Fatalf("%q: timeout %v retries %d, expected %v %d", tc.data,
+				resolver.Timeout, resolver.Retries, tc.timeout, tc.retries)
+		}
+	}
+}
+
+func TestQueryInfoOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	resolver.IPv6 = false
+	defer resolver.Close()
+
+	var mu sync.Mutex
+	var exchanges []*QueryInfo
+	resolver.OnExchange = func(query *Query, info *QueryInfo) {
+		mu.Lock()
+		defer mu.Unlock()
+		exchanges = append(exchanges, info)
+	}
+
+	tlsa, err := GetTLSA(resolver, hostname, 443)
+	if err != nil || tlsa == nil {
+		t.Fatalf("GetTLSA: %v, %v", tlsa, err)
+	}
+	info := tlsa.Query
+	if info == nil {
+		t.Fatalf("GetTLSA: no query information")
+	}
+	if info.Transport != "tcp" || info.Truncated || info.Size == 0 ||
+		info.Server != resolver.Servers[0].Address() {
+		t.Fatalf("GetTLSA: unexpected query information: %+v", info)
+	}
+	if tlsa.Copy().Query == info {
+		t.Fatalf("Copy: query information not copied")
+	}
+
+	if _, err = GetAddresses(resolver, hostname, true); err != nil {
+		t.Fatalf("GetAddresses: %s", err)
+	}
+	if len(exchanges) != 2 || exchanges[0] != info {
+		t.Fatalf("OnExchange: %d calls, expected 2", len(exchanges))
+	}
+}
+
+func TestGetAddressesInfoOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+
+	iplist, infos, err := GetAddressesInfo(resolver, "brokenv6.example.com", true)
+	if err != nil || len(iplist) != 1 {
+		t.Fatalf("GetAddressesInfo: %v, %v", iplist, err)
+	}
+	server := resolver.Servers[0].Address()
+	for _, rrtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		info := infos[rrtype]
+		if info == nil || info.Server != server || info.Transport != "tcp" {
+			t.Fatalf("GetAddressesInfo: unexpected %s query information: %+v",
+				dns.TypeToString[rrtype], info)
+		}
+	}
+	if info := infos[dns.TypeA]; info.Answers != 1 || info.MinTTL != 300 {
+		t.Fatalf("GetAddressesInfo: A answers %d TTL %d, expected 1 and 300",
+			info.Answers, info.MinTTL)
+	}
+}
+
+func TestKeepResponsesOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+
+	if _, err := GetTLSA(resolver, hostname, 443); err != nil {
+		t.Fatalf("GetTLSA: %s", err)
+	}
+	if raw := resolver.LastResponse(dns.TypeTLSA); raw != nil {
+		t.Fatalf("LastResponse: response kept without KeepResponses")
+	}
+
+	resolver.KeepResponses = true
+	tlsa, err := GetTLSA(resolver, hostname, 443)
+	if err != nil {
+		t.Fatalf("GetTLSA: %s", err)
+	}
+	raw := resolver.LastResponse(dns.TypeTLSA)
+	if raw == nil {
+		t.Fatalf("LastResponse: no TLSA response kept")
+	}
+	msg := new(dns.Msg)
+	if err = msg.Unpack(raw); err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	if !msg.MsgHdr.AuthenticatedData {
+		t.Fatalf("LastResponse: AD bit not set in kept response")
+	}
+	kept := Message2TSLAinfo(tlsa.Qname, msg)
+	if len(kept.Rdata) != len(tlsa.Rdata) || kept.Rdata[0].Data != tlsa.Rdata[0].Data {
+		t.Fatalf("LastResponse: kept response doesn't match TLSA records")
+	}
+	if resolver.LastResponse(dns.TypeA) != nil {
+		t.Fatalf("LastResponse: unexpected A response")
+	}
+}
+
+func TestKeepResponsesWireOffline(t *testing.T) {
+
+	// The server sends compressed responses, which differ from the
+	// uncompressed encoding of the parsed message.
+	sent := make(chan []byte, 1)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.AuthenticatedData = true
+		m.Compress = true
+		for _, data := range []string{"192.0.2.1", "192.0.2.2"} {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A " + data)
+			m.Answer = append(m.Answer, rr)
+		}
+		raw, _ := m.Pack()
+		sent <- raw
+		_, _ = w.Write(raw)
+	})
+
+	for _, transport := range []string{"udp", "tcp"} {
+		var server *dns.Server
+		var addr *net.UDPAddr
+		if transport == "udp" {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("ListenPacket: %s", err)
+			}
+			server = &dns.Server{PacketConn: pc, Handler: handler}
+			addr = pc.LocalAddr().(*net.UDPAddr)
+		} else {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen: %s", err)
+			}
+			server = &dns.Server{Listener: ln, Handler: handler}
+			tcpaddr := ln.Addr().(*net.TCPAddr)
+			addr = &net.UDPAddr{IP: tcpaddr.IP, Port: tcpaddr.Port}
+		}
+		go func() { _ = server.ActivateAndServe() }()
+
+		resolver := NewResolver([]*Server{NewServer("", addr.IP, addr.Port)})
+		resolver.IPv6 = false
+		resolver.PersistentTCP = transport == "tcp"
+		resolver.KeepResponses = true
+		if _, err := GetAddresses(resolver, hostname, true); err != nil {
+			t.Fatalf("%s: GetAddresses: %s", transport, err)
+		}
+		expected := <-sent
+		if raw := resolver.LastResponse(dns.TypeA); !bytes.Equal(raw, expected) {
+			t.Fatalf("%s: LastResponse: kept response differs from wire format", transport)
+		}
+		msg := new(dns.Msg)
+		_ = msg.Unpack(expected)
+		if packed, _ := msg.Pack(); bytes.Equal(packed, expected) {
+			t.Fatalf("%s: re-encoded response matches wire format", transport)
+		}
+		resolver.Close()
+		_ = server.Shutdown()
+	}
+
+	resolver := NewResolver(nil)
+	resolver.KeepResponses = true
+	resolver.Exchanger = &stubExchanger{records: []string{
+		"www.example.com. 300 IN A 192.0.2.1",
+	}}
+	resolver.IPv6 = false
+	if _, err := GetAddresses(resolver, "www.example.com", true); err != nil {
+		t.Fatalf("GetAddresses: %s", err)
+	}
+	if resolver.LastResponse(dns.TypeA) != nil {
+		t.Fatalf("LastResponse: response kept for DNSExchanger")
+	}
+}
+
+func TestVerifyValidatingOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+
+	if err := resolver.VerifyValidating("example.com"); err != nil {
+		t.Fatalf("VerifyValidating: %s", err)
+	}
+	err := resolver.VerifyValidating("www.insecure.example.com")
+	if err == nil {
+		t.Fatalf("VerifyValidating: succeeded for unauthenticated response")
+	}
+	if !errors.Is(err, ErrNotValidating) {
+		t.Fatalf("VerifyValidating: expected ErrNotValidating, got %s", err)
+	}
+}
+
+func TestGetAddressesPartialFailureOffline(t *testing.T) {
+
+	var logbuf strings.Builder
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+	resolver.Logger = log.New(&logbuf, "", 0)
+
+	iplist, err := GetAddresses(resolver, "brokenv6.example.com", true)
+	if err != nil {
+		t.Fatalf("GetAddresses: %s", err)
+	}
+	if len(iplist) != 1 || !iplist[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("GetAddresses: unexpected addresses %v", iplist)
+	}
+	if !strings.Contains(logbuf.String(), "AAAA address lookup for brokenv6.example.com failed") {
+		t.Fatalf("GetAddresses: partial failure not logged: %q", logbuf.String())
+	}
+
+	resolver.IPv4 = false
+	if _, err = GetAddresses(resolver, "brokenv6.example.com", true); err == nil {
+		t.Fatalf("GetAddresses: succeeded with only a failed lookup")
+	}
+}
+
+func TestGetTLSAByNameOffline(t *testing.T) {
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+
+	tlsa, err := GetTLSAByName(resolver, "_443._srv.mail.example.com")
+	if err != nil {
+		t.Fatalf("GetTLSAByName: %s", err)
+	}
+	if tlsa == nil || tlsa.Qname != "_443._srv.mail.example.com." || len(tlsa.Rdata) != 1 {
+		t.Fatalf("GetTLSAByName: unexpected TLSA information: %+v", tlsa)
+	}
+
+	tlsa, err = GetTLSAByName(resolver, "_25._tcp.mail.example.com")
+	if err != nil || tlsa != nil {
+		t.Fatalf("GetTLSAByName: expected no TLSA records, got %+v, %v", tlsa, err)
+	}
+}
+
+func TestMaxQueriesOffline(t *testing.T) {
+
+	var inflight, peak int32
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket: %s", err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+
+	addr := pc.LocalAddr().(*net.UDPAddr)
+	resolver := NewResolver([]*Server{NewServer("", addr.IP, addr.Port)})
+	resolver.MaxQueries = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := NewQuery(fmt.Sprintf("host%d.example.com", i), dns.TypeA, dns.ClassINET)
+			if _, err := sendQuery(q, resolver); err != nil {
+				t.Errorf("sendQuery: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if p := atomic.LoadInt32(&peak); p > 2 {
+		t.Fatalf("MaxQueries 2: %d queries were outstanding at once", p)
+	}
+}
+
+// stubExchanger is a DNSExchanger that answers queries from a fixed set
+// of records, with the AD bit set.
+type stubExchanger struct {
+	records []string
+}
+
+func (s *stubExchanger) Exchange(m *dns.Msg) (*dns.Msg, error) {
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.AuthenticatedData = true
+	for _, record := range s.records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(rr.Header().Name, m.Question[0].Name) &&
+			rr.Header().Rrtype == m.Question[0].Qtype {
+			r.Answer = append(r.Answer, rr)
+		}
+	}
+	return r, nil
+}
+
+func TestDNSExchangerOffline(t *testing.T) {
+
+	resolver := NewResolver(nil)
+	resolver.Exchanger = &stubExchanger{records: []string{
+		"www.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 300 IN AAAA 2001:db8::1",
+		"_443._tcp.www.example.com. 300 IN TLSA 3 1 1 " + strings.Repeat("ab", 32),
+	}}
+
+	tlsa, err := GetTLSA(resolver, "www.example.com", 443)
+	if err != nil {
+		t.Fatalf("GetTLSA: %s", err)
+	}
+	if tlsa == nil || len(tlsa.Rdata) != 1 {
+		t.Fatalf("GetTLSA: unexpected TLSA information: %+v", tlsa)
+	}
+	if tlsa.Query == nil || tlsa.Query.Transport != "exchanger" {
+		t.Fatalf("GetTLSA: unexpected query information: %+v", tlsa.Query)
+	}
+
+	iplist, err := GetAddresses(resolver, "www.example.com", true)
+	if err != nil {
+		t.Fatalf("GetAddresses: %s", err)
+	}
+	if len(iplist) != 2 || !iplist[0].Equal(net.ParseIP("2001:db8::1")) ||
+		!iplist[1].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("GetAddresses: unexpected addresses %v", iplist)
+	}
+}
+
+func TestTLSATTLOffline(t *testing.T) {
+
+	var rrs []dns.RR
+	for _, record := range []string{
+		"_443._tcp.www.example.com. 3600 IN TLSA 3 1 1 " + strings.Repeat("ab", 32),
+		"_443._tcp.www.example.com. 300 IN TLSA 2 0 1 " + strings.Repeat("cd", 32),
+	} {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("NewRR: %s", err)
+		}
+		rrs = append(rrs, rr)
+	}
+
+	tlsa := TLSAinfoFromRRs("_443._tcp.www.example.com", rrs)
+	if tlsa.Rdata[0].TTL != 3600 || tlsa.Rdata[1].TTL != 300 {
+		t.Fatalf("TLSAinfoFromRRs: unexpected TTLs %d, %d",
+			tlsa.Rdata[0].TTL, tlsa.Rdata[1].TTL)
+	}
+	if ttl, ok := tlsa.MinTTL(); !ok || ttl != 300 {
+		t.Fatalf("MinTTL: got %d, %v", ttl, ok)
+	}
+	if tlsa.Copy().Rdata[1].TTL != 300 {
+		t.Fatalf("Copy: TTL not copied")
+	}
+	if _, ok := new(TLSAinfo).MinTTL(); ok {
+		t.Fatalf("MinTTL: ok for empty TLSAinfo")
+	}
+}
@@ -0,0 +1,128 @@
+package dane
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoTLSA is returned (wrapped in a DANERequiredError) when DANE
+// authentication is required, but no secure TLSA records were found.
+var ErrNoTLSA = errors.New("no TLSA records found")
+
+// ErrNoSTARTTLS is returned (wrapped) by DoSMTP when the server does not
+// advertise STARTTLS support.
+var ErrNoSTARTTLS = errors.New("STARTTLS support not detected")
+
+// ErrInsecureTLSA is returned (wrapped) by GetTLSA when TLSA records
+// exist for the service, but the DNS response was not authenticated, and
+// either PKIX fallback is disabled or the Resolver's StrictTLSA is set.
+var ErrInsecureTLSA = errors.New("TLSA records present but not authenticated")
+
+// ErrNotValidating is returned (wrapped) by Resolver.VerifyValidating when
+// the resolver does not appear to validate DNSSEC.
+var ErrNotValidating = errors.New("resolver does not validate DNSSEC")
+
+// ErrCheckingDisabled is returned (wrapped) when an authenticated DNS
+// response is required, but the Resolver has the CD (Checking Disabled)
+// flag set. With CD set, the resolver does not validate responses, so
+// they cannot be relied upon to carry the AD bit.
+var ErrCheckingDisabled = errors.New("resolver CD flag set, responses are not validated")
+
+//
+// DANERequiredError - error returned when DANE authentication is required
+// (PKIX fallback is disabled) but could not be performed for the given
+// host. It can be detected with errors.As, including through the errors
+// returned by a net/http Client.
+//
+type DANERequiredError struct {
+	Hostname string
+	Err      error
+}
+
+// Error returns a string representation of the error.
+func (e *DANERequiredError) Error() string {
+	return fmt.Sprintf("DANE required for %s: %s", e.Hostname, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *DANERequiredError) Unwrap() error {
+	return e.Err
+}
+
+//
+// ConnectError - error returned when connections to all the addresses
+// of a server have failed. It holds the error for each address tried.
+//
+type ConnectError struct {
+	Hostname string
+	Errors   []*AddressError
+}
+
+//
+// AddressError - error from a connection attempt to a single server
+// address.
+//
+type AddressError struct {
+	Address string
+	Err     error
+}
+
+// Error returns a string representation of the error.
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Address, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
+
+// add records the error for a connection attempt to the given address.
+func (e *ConnectError) add(address string, err error) {
+	e.Errors = append(e.Errors, &AddressError{Address: address, Err: err})
+}
+
+// Unwrap returns the errors for each address tried.
+func (e *ConnectError) Unwrap() []error {
+	var errs []error
+	for _, ae := range e.Errors {
+		errs = append(errs, ae)
+	}
+	return errs
+}
+
+// Is reports whether the error for any of the addresses tried matches the
+// target, so that errors.Is can find an error such as ErrNoTLSA. (Go 1.20
+// and later also follow Unwrap, but earlier versions need this method.)
+func (e *ConnectError) Is(target error) bool {
+	for _, ae := range e.Errors {
+		if errors.Is(ae, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error for the addresses tried that matches the
+// target, as errors.As does, so that errors.As can find an error such as
+// an x509.HostnameError for any of the addresses.
+func (e *ConnectError) As(target interface{}) bool {
+	for _, ae := range e.Errors {
+		if errors.As(ae, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Error returns a string representation of the error, including the
+// errors for each address tried.
+func (e *ConnectError) Error() string {
+	var details []string
+	for _, ae := range e.Errors {
+		details = append(details, ae.Error())
+	}
+	return fmt.Sprintf("failed to connect to any server address for %s: %s",
+		e.Hostname, strings.Join(details, "; "))
+}
@@ -2,12 +2,92 @@ package dane
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"strconv"
-	"strings"
 )
 
+//
+// DaneDialTLSContext returns a dial function that performs DANE TLS
+// authentication of the server, suitable for assigning to the
+// DialTLSContext field of an existing net/http Transport. If the argument
+// pkixfallback is set to true, then PKIX authentication will be attempted
+// if the server does not have any published secure DANE TLSA records.
+//
+// The returned connections are ordinary TLS connections with no other
+// references held by this package, so they are pooled and reused by the
+// Transport subject to its idle connection settings (e.g.
+// MaxIdleConnsPerHost). If pkixfallback is false and the server has no
+// secure TLSA records, the dial fails with a *DANERequiredError, which
+// can be detected with errors.As on the error returned by the Client.
+//
+// The dial returns ctx.Err() as soon as the context is cancelled or its
+// deadline passes. The DNS lookups and connection attempts themselves do
+// not take the context, so they run on in the background until they
+// complete or time out (per the Resolver and dialer timeouts), and any
+// connection they establish is then closed.
+//
+func DaneDialTLSContext(pkixfallback bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialContext(ctx, addr, func(hostname string, port int) (*tls.Conn, error) {
+			conn, _, err := ConnectByNameAsync2(hostname, port, pkixfallback)
+			return conn, err
+		})
+	}
+}
+
+//
+// dialContext runs the given connect function for the host and port in
+// addr, returning ctx.Err() if the context is done first. A connection
+// established after the caller has given up is closed.
+//
+func dialContext(ctx context.Context, addr string,
+	connect func(hostname string, port int) (*tls.Conn, error)) (net.Conn, error) {
+
+	hostname, portstring, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstring)
+	if err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// Unbuffered, so that a result can only be delivered while the
+	// caller is still waiting for it.
+	done := make(chan result)
+	go func() {
+		conn, err := connect(hostname, port)
+		r := result{err: err}
+		if err == nil {
+			r.conn = conn
+		}
+		select {
+		case done <- r:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 //
 // GetHttpClient returns a net/http Client structure configured to perform
 // DANE TLS authentication of the HTTPS server. If the argument pkixfallback
@@ -17,13 +97,7 @@ import (
 func GetHttpClient(pkixfallback bool) http.Client {
 
 	t := &http.Transport{
-		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			tmp := strings.SplitN(addr, ":", 2)
-			hostname := tmp[0]
-			port, _ := strconv.Atoi(tmp[1])
-			conn, _, err := ConnectByNameAsync2(hostname, port, pkixfallback)
-			return conn, err
-		},
+		DialTLSContext: DaneDialTLSContext(pkixfallback),
 	}
 	return http.Client{Transport: t}
 }
@@ -7,10 +7,16 @@ package dane
  */
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestGetHttpClient(t *testing.T) {
@@ -42,3 +48,128 @@ func TestGetHttpClient(t *testing.T) {
 	_ = body
 	fmt.Printf("GetHttpClient: Success connecting to %s\n", urlstring)
 }
+
+func TestDaneDialTLSContext(t *testing.T) {
+
+	var urlstring = "https://www.example.com/"
+
+	transport := &http.Transport{
+		DialTLSContext: DaneDialTLSContext(true),
+	}
+	httpclient := &http.Client{Transport: transport}
+
+	response, err := httpclient.Get(urlstring)
+	if err != nil {
+		t.Fatalf("http.Get: %s\n", err.Error())
+	}
+	response.Body.Close()
+	fmt.Printf("DaneDialTLSContext: Success connecting to %s\n\n", urlstring)
+}
+
+func TestDaneDialTLSContextReuse(t *testing.T) {
+
+	var urlstring = "https://www.example.com/"
+	var dials int
+
+	dial := DaneDialTLSContext(true)
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: 1,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			return dial(ctx, network, addr)
+		},
+	}
+	httpclient := &http.Client{Transport: transport}
+
+	for i := 0; i < 3; i++ {
+		response, err := httpclient.Get(urlstring)
+		if err != nil {
+			t.Fatalf("http.Get: %s\n", err.Error())
+		}
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+	}
+	if dials != 1 {
+		t.Fatalf("DaneDialTLSContext: %d dials for 3 requests, expected 1\n", dials)
+	}
+	transport.CloseIdleConnections()
+}
+
+func TestGetHttpClientDANERequired(t *testing.T) {
+
+	var urlstring = "https://www.amazon.com/"
+	var daneErr *DANERequiredError
+
+	httpclient := GetHttpClient(false)
+	response, err := httpclient.Get(urlstring)
+	if err == nil {
+		response.Body.Close()
+		t.Fatalf("http.Get: success for %s, expected failure\n", urlstring)
+	}
+	if !errors.As(err, &daneErr) || !errors.Is(err, ErrNoTLSA) {
+		t.Fatalf("http.Get: expected DANERequiredError, got: %s\n", err)
+	}
+	fmt.Printf("GetHttpClient: DANE required for %s\n\n", daneErr.Hostname)
+}
+
+func TestDaneDialTLSContextCancelOffline(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	dial := DaneDialTLSContext(true)
+	conn, err := dial(ctx, "tcp", "www.example.com:443")
+	if err == nil {
+		conn.Close()
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("DaneDialTLSContext: expected context.Canceled, got: %v", err)
+	}
+}
+
+// closeRecorder is a net.Conn that records whether it has been closed.
+type closeRecorder struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return c.Conn.Close()
+}
+
+func TestDialContextCancelMidDialOffline(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer server.Close()
+	rawconn := &closeRecorder{Conn: client, closed: make(chan struct{})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started, release := make(chan struct{}), make(chan struct{})
+	connect := func(hostname string, port int) (*tls.Conn, error) {
+		close(started)
+		<-release
+		return tls.Client(rawconn, &tls.Config{ServerName: hostname}), nil
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := dialContext(ctx, "www.example.com:443", connect)
+		if err == nil {
+			conn.Close()
+		}
+		errs <- err
+	}()
+	<-started
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("dialContext: expected context.Canceled, got: %v", err)
+	}
+	close(release)
+
+	select {
+	case <-rawconn.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("dialContext: connection established after cancel was not closed")
+	}
+}
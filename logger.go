@@ -0,0 +1,19 @@
+package dane
+
+//
+// Logger is the interface used for diagnostic output from this package.
+// It is satisfied by *log.Logger from the standard library. If no Logger
+// is configured, diagnostic output is discarded.
+//
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+//
+// logf writes a diagnostic message to the given logger, if it is non-nil.
+//
+func logf(logger Logger, format string, v ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
+}
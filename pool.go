@@ -0,0 +1,221 @@
+package dane
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default maximum age of an idle connection in a DaneConnPool
+var defaultPoolMaxAge = 60 * time.Second
+
+//
+// DaneConnPool - a pool of pre-established ("warm") DANE authenticated
+// connections to a set of hosts, for clients that repeatedly connect to
+// the same servers. Connections are established with ConnectByNameOptions,
+// so each one involves fresh TLSA and address lookups. Idle connections
+// are discarded once they are older than MaxAge, when the TTL of the TLSA
+// or address records they were established with expires (counting from
+// the time of the lookup), or when the signatures over the TLSA records
+// expire, so that the DNS data is re-resolved. A DaneConnPool is safe for
+// concurrent use.
+//
+type DaneConnPool struct {
+	Options *ConnectOptions // Options for new connections (nil: defaults)
+	MaxAge  time.Duration   // Maximum age of idle connections (0: 60s)
+
+	lock  sync.Mutex
+	conns map[string][]*poolEntry
+}
+
+//
+// poolEntry - an idle connection in a DaneConnPool.
+//
+type poolEntry struct {
+	conn    *tls.Conn
+	config  *Config
+	expires time.Time
+}
+
+//
+// NewDaneConnPool returns a new, empty DaneConnPool that uses the given
+// connect options.
+//
+func NewDaneConnPool(opts *ConnectOptions) *DaneConnPool {
+	p := new(DaneConnPool)
+	p.Options = opts
+	p.conns = make(map[string][]*poolEntry)
+	return p
+}
+
+//
+// poolKey returns the pool map key for the given host and port.
+//
+func poolKey(hostname string, port int) string {
+	return net.JoinHostPort(hostname, strconv.Itoa(port))
+}
+
+//
+// expiry returns the time at which an idle connection established with
+// the given config should be discarded.
+//
+func (p *DaneConnPool) expiry(config *Config) time.Time {
+
+	maxage := p.MaxAge
+	if maxage <= 0 {
+		maxage = defaultPoolMaxAge
+	}
+	now := time.Now()
+	expires := now.Add(maxage)
+	if !config.DNSExpires.IsZero() {
+		if config.DNSExpires.Before(expires) {
+			expires = config.DNSExpires
+		}
+	} else if config.TLSA != nil {
+		// Lookup time unknown: count the TTL from now.
+		if ttl, ok := config.TLSA.MinTTL(); ok {
+			if ttlexp := now.Add(time.Duration(ttl) * time.Second); ttlexp.Before(expires) {
+				expires = ttlexp
+			}
+		}
+	}
+	if config.TLSA != nil {
+		if sigexp, ok := config.TLSA.SigExpiration(); ok && sigexp.Before(expires) {
+			expires = sigexp
+		}
+	}
+	return expires
+}
+
+//
+// dial establishes a new connection to the given host and port.
+//
+func (p *DaneConnPool) dial(hostname string, port int) (*tls.Conn, *Config, error) {
+
+	opts := p.Options
+	if opts == nil {
+		opts = NewConnectOptions()
+	}
+	return ConnectByNameOptions(hostname, port, opts)
+}
+
+//
+// Prewarm establishes a new connection to the given host and port, and
+// adds it to the pool of idle connections.
+//
+func (p *DaneConnPool) Prewarm(hostname string, port int) error {
+
+	conn, config, err := p.dial(hostname, port)
+	if err != nil {
+		return err
+	}
+	p.Put(hostname, port, conn, config)
+	return nil
+}
+
+//
+// alive returns whether an idle connection is still usable: it has not
+// been closed (or reset) by the server, and has no unexpected data from
+// the server pending. This takes a brief read with a short deadline.
+//
+func alive(conn *tls.Conn) bool {
+
+	var b [1]byte
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return false
+	}
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+//
+// Get returns an idle connection to the given host and port from the
+// pool, removing it from the pool, if one is available, has not expired,
+// and is still alive (not closed by the server). Stale connections are
+// closed and discarded. Otherwise it establishes a new connection.
+//
+func (p *DaneConnPool) Get(hostname string, port int) (*tls.Conn, *Config, error) {
+
+	key := poolKey(hostname, port)
+
+	for {
+		p.lock.Lock()
+		if len(p.conns[key]) == 0 {
+			delete(p.conns, key)
+			p.lock.Unlock()
+			break
+		}
+		entry := p.conns[key][0]
+		p.conns[key] = p.conns[key][1:]
+		p.lock.Unlock()
+
+		if time.Now().Before(entry.expires) && alive(entry.conn) {
+			return entry.conn, entry.config, nil
+		}
+		entry.conn.Close()
+	}
+	return p.dial(hostname, port)
+}
+
+//
+// Put returns a connection (and its dane Config) to the given host and
+// port to the pool for reuse. The caller must not use the connection
+// afterwards.
+//
+func (p *DaneConnPool) Put(hostname string, port int, conn *tls.Conn, config *Config) {
+
+	if conn == nil || config == nil {
+		return
+	}
+	entry := &poolEntry{conn: conn, config: config, expires: p.expiry(config)}
+	key := poolKey(hostname, port)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conns == nil {
+		p.conns = make(map[string][]*poolEntry)
+	}
+	p.conns[key] = append(p.conns[key], entry)
+}
+
+//
+// Len returns the number of idle connections in the pool.
+//
+func (p *DaneConnPool) Len() int {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n := 0
+	for _, entries := range p.conns {
+		n += len(entries)
+	}
+	return n
+}
+
+//
+// Close closes all idle connections in the pool.
+//
+func (p *DaneConnPool) Close() error {
+
+	var err error
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, entries := range p.conns {
+		for _, entry := range entries {
+			if cerr := entry.conn.Close(); cerr != nil && err == nil {
+				err = fmt.Errorf("closing connection to %s: %s", key, cerr.Error())
+			}
+		}
+		delete(p.conns, key)
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package dane
+
+/*
+ * Note: these test routines may not work unless you adapt this file
+ * to use validating DNS resolvers and appropriately configured DANE TLS
+ * servers you have access to.
+ */
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDaneConnPoolPrewarm(t *testing.T) {
+
+	pool := NewDaneConnPool(nil)
+	defer pool.Close()
+
+	if err := pool.Prewarm("www.example.com", 443); err != nil {
+		t.Fatalf("Prewarm: %s", err)
+	}
+	conn, config, err := pool.Get("www.example.com", 443)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	defer conn.Close()
+	if !config.Okdane && !config.Okpkix {
+		t.Fatalf("Get: connection not authenticated")
+	}
+}
+
+func TestDaneConnPoolOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	dial := func() (*tls.Conn, *Config) {
+		daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+		daneconfig.PKIXRootCA = CertToPEMBytes(server.Certificate())
+		conn, err := DialTLS(daneconfig)
+		if err != nil {
+			t.Fatalf("DialTLS: %s", err)
+		}
+		return conn, daneconfig
+	}
+
+	pool := NewDaneConnPool(nil)
+	defer pool.Close()
+
+	idleconn, idleconfig := dial()
+	pool.Put("example.com", 443, idleconn, idleconfig)
+	if pool.Len() != 1 {
+		t.Fatalf("Len: %d, expected 1", pool.Len())
+	}
+	conn, config, err := pool.Get("example.com", 443)
+	if err != nil || conn != idleconn || config != idleconfig {
+		t.Fatalf("Get: did not return the idle connection: %v", err)
+	}
+	if pool.Len() != 0 {
+		t.Fatalf("Len: %d, expected 0", pool.Len())
+	}
+	conn.Close()
+
+	// A connection closed by the server is discarded.
+	idleconn, idleconfig = dial()
+	pool.Put("example.com", 443, idleconn, idleconfig)
+	server.CloseClientConnections()
+	time.Sleep(5 * time.Millisecond)
+	pool.Options = &ConnectOptions{Resolver: NewResolver(nil)}
+	if conn, _, err = pool.Get("example.com", 443); err == nil {
+		conn.Close()
+		t.Fatalf("Get: returned a connection closed by the server")
+	}
+	if pool.Len() != 0 {
+		t.Fatalf("Len: %d, expected 0 after server close", pool.Len())
+	}
+
+	pool.MaxAge = time.Millisecond
+	idleconn, idleconfig = dial()
+	pool.Put("example.com", 443, idleconn, idleconfig)
+	time.Sleep(5 * time.Millisecond)
+	if conn, _, err = pool.Get("example.com", 443); err == nil {
+		conn.Close()
+		t.Fatalf("Get: returned an expired connection")
+	}
+	if pool.Len() != 0 {
+		t.Fatalf("Len: %d, expected 0 after expiry", pool.Len())
+	}
+}
+
+func TestDaneConnPoolTTLOffline(t *testing.T) {
+
+	pool := NewDaneConnPool(nil)
+	tlsa := &TLSAinfo{Rdata: []*TLSArdata{{Usage: DaneEE, TTL: 300}, {Usage: DaneEE, TTL: 2}}}
+
+	// Lookup time unknown: the TLSA TTL counts from now.
+	config := NewConfig("www.example.com", "192.0.2.1", 443)
+	config.SetTLSA(tlsa)
+	before := time.Now()
+	if expires := pool.expiry(config); expires.Before(before.Add(2*time.Second)) ||
+		expires.After(time.Now().Add(2*time.Second)) {
+		t.Fatalf("expiry: %v, expected TLSA TTL of 2s from now", expires.Sub(before))
+	}
+
+	// The address TTL is shorter, and counts from the lookup time.
+	lookup := time.Now().Add(-10 * time.Second)
+	infos := map[uint16]*QueryInfo{
+		dns.TypeA:    {Answers: 1, MinTTL: 1},
+		dns.TypeAAAA: {Answers: 0},
+	}
+	config.DNSExpires = dnsExpiry(lookup, tlsa, infos)
+	if !config.DNSExpires.Equal(lookup.Add(time.Second)) {
+		t.Fatalf("dnsExpiry: %v, expected address TTL of 1s from lookup",
+			config.DNSExpires.Sub(lookup))
+	}
+	if expires := pool.expiry(config); !expires.Equal(config.DNSExpires) {
+		t.Fatalf("expiry: %v, expected %v", expires, config.DNSExpires)
+	}
+	if !dnsExpiry(lookup, nil, nil).IsZero() {
+		t.Fatalf("dnsExpiry: non-zero with no TTLs")
+	}
+}
@@ -0,0 +1,127 @@
+package dane
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// bufferedConn is a net.Conn whose reads are first satisfied from a
+// bufio.Reader, for data that was read ahead of a protocol exchange.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads data from the connection, via its buffered reader.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// DialTLSOnConn performs the TLS handshake, with DANE authentication of
+// the server defined in the dane Config, over an already established
+// connection, such as a tunnel through a proxy. The Config's Server name
+// and port identify the server (and the TLSA records to use); its address
+// is not used. The handshake must complete within the Config's TimeoutTLS
+// (or TimeoutTCP, if not set), and its time is recorded in the Config's
+// Timings. On failure, the connection is not closed, unless ConnOnFail is
+// set and a TLS connection is returned along with the error.
+func DialTLSOnConn(conn net.Conn, daneconfig *Config) (*tls.Conn, error) {
+
+	config := GetTLSconfig(daneconfig)
+
+	start := time.Now()
+	tlsconn, err := daneconfig.handshake(conn, config)
+	daneconfig.Timings.TLSHandshake = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	return daneconfig.failedConn(tlsconn)
+}
+
+// httpConnect asks the HTTP proxy on the given connection to open a
+// tunnel to the given host and port with the CONNECT method, and returns
+// the tunneled connection.
+func httpConnect(conn net.Conn, hostport string, header http.Header) (net.Conn, error) {
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostport},
+		Host:   hostport,
+		Header: header,
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", hostport, err.Error())
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", hostport, err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", hostport, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// DialTLSProxy connects to the given HTTP proxy (host:port), opens a
+// tunnel to the server defined in the dane Config with the HTTP CONNECT
+// method, and then negotiates TLS with DANE authentication of the server
+// over the tunnel, as DialTLSOnConn does. The tunnel is requested by the
+// Config's Server name (and port), so the proxy resolves the server's
+// addresses; the TLSA records should already be set in the Config (for
+// example with GetTLSA). The given header, which may be nil, is sent with
+// the CONNECT request, e.g. for Proxy-Authorization. The dialer settings
+// of the Config are used to connect to the proxy, the TCP timeout applies
+// to the connection and tunnel setup, and the handshake must complete
+// within the TimeoutTLS (or TimeoutTCP) of the Config.
+func DialTLSProxy(proxy string, header http.Header, daneconfig *Config) (*tls.Conn, error) {
+
+	dialer := getDialer(daneconfig)
+	ctx := context.Background()
+	if dialer.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	rawconn, err := dialer.DialContext(ctx, "tcp", proxy)
+	daneconfig.Timings.TCPConnect = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		rawconn.SetDeadline(deadline)
+	}
+
+	hostport := net.JoinHostPort(daneconfig.Server.Name,
+		strconv.Itoa(daneconfig.Server.Port))
+	tunnel, err := httpConnect(rawconn, hostport, header)
+	if err != nil {
+		rawconn.Close()
+		return nil, err
+	}
+
+	conn, err := DialTLSOnConn(tunnel, daneconfig)
+	if err != nil && conn == nil {
+		rawconn.Close()
+		return nil, err
+	}
+	rawconn.SetDeadline(time.Time{})
+	return conn, err
+}
@@ -0,0 +1,122 @@
+package dane
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestProxy starts an HTTP CONNECT proxy on the loopback address,
+// that tunnels connections for any host name to the given address. It
+// returns the proxy address, and a channel on which the requested
+// CONNECT targets are sent.
+func startTestProxy(t *testing.T, target string) (string, <-chan string) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				requests <- req.Host
+				if req.Header.Get("Proxy-Authorization") != "Basic dGVzdDp0ZXN0" {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				backend, err := net.Dial("tcp", target)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer backend.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(backend, reader)
+				io.Copy(conn, backend)
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func TestDialTLSProxyOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	data, err := ComputeTLSA(1, 1, server.Certificate())
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	proxy, requests := startTestProxy(t, server.Listener.Addr().String())
+
+	header := make(http.Header)
+	header.Set("Proxy-Authorization", "Basic dGVzdDp0ZXN0")
+	daneconfig := NewConfig("example.com", nil, port)
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: data}},
+	})
+	conn, err := DialTLSProxy(proxy, header, daneconfig)
+	if err != nil {
+		t.Fatalf("DialTLSProxy: %s", err)
+	}
+	conn.Close()
+	if !daneconfig.Okdane {
+		t.Fatalf("DialTLSProxy: DANE authentication failed")
+	}
+	if host := <-requests; !strings.HasPrefix(host, "example.com:") {
+		t.Fatalf("DialTLSProxy: unexpected CONNECT target %s", host)
+	}
+
+	daneconfig = NewConfig("example.com", nil, port)
+	_, err = DialTLSProxy(proxy, nil, daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("DialTLSProxy: expected proxy authentication error, got %v", err)
+	}
+}
+
+func TestDialTLSOnConnHandshakeTimeoutOffline(t *testing.T) {
+
+	// A tunnel whose far end never responds to the TLS ClientHello.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	daneconfig := NewConfig("example.com", "192.0.2.1", 443)
+	daneconfig.SetTimeoutTLS(1)
+
+	start := time.Now()
+	_, err := DialTLSOnConn(client, daneconfig)
+	if err == nil {
+		t.Fatalf("DialTLSOnConn: handshake with stalled server succeeded")
+	}
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("DialTLSOnConn: expected timeout error, got: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("DialTLSOnConn: handshake timeout took %s", elapsed)
+	}
+}
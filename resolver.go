@@ -1,7 +1,12 @@
 package dane
 
 import (
+	"bytes"
+	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,20 +24,72 @@ var (
 	defaultBufsize      uint16 = 1460
 )
 
+//
+// EDNS0 UDP payload sizes. DefaultPayload is the payload size used by new
+// Resolvers, and MaxPayload is the largest size that a Resolver with
+// AutoPayload set will raise its payload size to.
+//
+var (
+	DefaultPayload        = defaultBufsize
+	MaxPayload     uint16 = 4096
+)
+
+//
+// ExchangeFunc - a function that is called with the transport details of
+// each successful DNS query exchange made by a Resolver, for diagnostics.
+// It may be called concurrently.
+//
+type ExchangeFunc func(query *Query, info *QueryInfo)
+
+//
+// DNSExchanger - a DNS client implementation, that sends a query message
+// and returns the response. It can be set on a Resolver to replace the
+// built-in client (for example with a stub for testing, or a client with
+// its own connection management), in which case the Resolver's Servers,
+// Timeout, Retries and transport settings are not used. It may be called
+// concurrently.
+//
+type DNSExchanger interface {
+	Exchange(m *dns.Msg) (*dns.Msg, error)
+}
+
 //
 // Resolver contains a DNS resolver configuration
 //
+// Note that setting the CD (Checking Disabled) flag asks the resolver not
+// to validate responses, so that bogus data can be inspected. Such responses
+// do not reliably carry the AD bit, so the secure lookups in GetTLSA and
+// GetAddresses will fail (with an error wrapping ErrCheckingDisabled), or
+// GetTLSA will report no TLSA records if Pkixfallback is set. The CD flag
+// should only be set for diagnostic queries, not for DANE authentication.
+//
 type Resolver struct {
-	Servers      []*Server     // list of resolvers
-	Rdflag       bool          // set RD flag
-	Adflag       bool          // set AD flag
-	Cdflag       bool          // set CD flag
-	Timeout      time.Duration // query timeout
-	Retries      int           // query retries
-	Payload      uint16        // EDNS0 UDP payload size
-	IPv6         bool          // lookup AAAA records in getAddresses()
-	IPv4         bool          // look A records in getAddresses()
-	Pkixfallback bool          // whether to fallback to PKIX in getTLSA()
+	Servers       []*Server     // list of resolvers, tried in order
+	Rdflag        bool          // set RD flag
+	Adflag        bool          // set AD flag
+	Cdflag        bool          // set CD flag (see note above)
+	Timeout       time.Duration // query timeout
+	Retries       int           // query retries
+	Payload       uint16        // EDNS0 UDP payload size
+	IPv6          bool          // lookup AAAA records in getAddresses()
+	IPv4          bool          // look A records in getAddresses()
+	Pkixfallback  bool          // whether to fallback to PKIX in getTLSA()
+	StrictTLSA    bool          // don't fallback if insecure TLSA records exist
+	Logger        Logger        // Logger for diagnostic output (optional)
+	PersistentTCP bool          // send queries over reused TCP connections
+	AutoPayload   bool          // raise Payload (to MaxPayload) on truncation
+	OnExchange    ExchangeFunc  // called after each query exchange (optional)
+	MaxQueries    int           // max outstanding queries (0: unlimited)
+	Exchanger     DNSExchanger  // DNS client to use (nil: built-in client)
+	KeepResponses bool          // retain the last response of each query type
+
+	tcpLock     sync.Mutex           // protects tcpConns
+	tcpConns    map[string]*dns.Conn // idle persistent TCP connections by server
+	payloadLock sync.Mutex           // protects Payload when AutoPayload is set
+	queryLock   sync.Mutex           // protects querySem
+	querySem    chan struct{}        // outstanding query slots, if MaxQueries set
+	rawLock     sync.Mutex           // protects rawResps
+	rawResps    map[uint16][]byte    // last response by query type, if KeepResponses set
 }
 
 //
@@ -46,37 +103,285 @@ func NewResolver(servers []*Server) *Resolver {
 	r.Adflag = true
 	r.Timeout = time.Second * time.Duration(defaultDNSTimeout)
 	r.Retries = defaultDNSRetries
-	r.Payload = defaultBufsize
+	r.Payload = DefaultPayload
 	r.IPv6 = true
 	r.IPv4 = true
 	r.Pkixfallback = true
 	return r
 }
 
+//
+// acquire waits until fewer than MaxQueries queries are outstanding on
+// the Resolver (if MaxQueries is set), and returns a function to call
+// when the query is done. This bounds the load on the resolver however
+// many goroutines (e.g. concurrent connection attempts or scans) share
+// it. MaxQueries should be set before the Resolver is used.
+//
+func (r *Resolver) acquire() func() {
+
+	if r.MaxQueries <= 0 {
+		return func() {}
+	}
+	r.queryLock.Lock()
+	if cap(r.querySem) != r.MaxQueries {
+		r.querySem = make(chan struct{}, r.MaxQueries)
+	}
+	sem := r.querySem
+	r.queryLock.Unlock()
+
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+//
+// keepResponse records the given response to a query of the given type,
+// as received on the wire, if the Resolver's KeepResponses is set.
+//
+func (r *Resolver) keepResponse(qtype uint16, raw []byte) {
+
+	if !r.KeepResponses || raw == nil {
+		return
+	}
+	r.rawLock.Lock()
+	defer r.rawLock.Unlock()
+	if r.rawResps == nil {
+		r.rawResps = make(map[uint16][]byte)
+	}
+	r.rawResps[qtype] = raw
+}
+
+//
+// LastResponse returns the last response received by the Resolver to a
+// query of the given type (e.g. dns.TypeTLSA, after GetTLSA), exactly as
+// it was received on the wire, if KeepResponses is set, for archiving the
+// DNSSEC signed data that a trust decision was based on. Returns nil if no
+// such response has been received. Responses obtained through a
+// DNSExchanger are not available in wire format, and so are never kept.
+// Note that with concurrent use of the Resolver, the last response may be
+// that of another lookup.
+//
+func (r *Resolver) LastResponse(qtype uint16) []byte {
+
+	r.rawLock.Lock()
+	defer r.rawLock.Unlock()
+	return r.rawResps[qtype]
+}
+
 //
 // GetResolver returns a Resolver configuration structure containing
 // a list of DNS resolver addresses obtained from a custom resolver
 // configuration file or from the system default (/etc/resolv.conf)
-// if the config file is unspecified.
+// if the config file is unspecified. All the listed resolvers are used:
+// each query is sent to them in order, until one of them responds. The
+// "timeout" and "attempts" options in the file, if present, set the
+// Resolver's Timeout and Retries; otherwise the package defaults are used.
 //
 func GetResolver(resconf string) (*Resolver, error) {
 
-	var ip net.IP
-	var resolver *Resolver
-	var servers []*Server
+	rc, err := readResolvConf(resconf)
+	if err != nil {
+		return nil, err
+	}
+	return rc.newResolver(rc.servers), nil
+}
+
+//
+// GetAllResolvers is like GetResolver, but returns a separate Resolver for
+// each resolver address in the configuration file, in the order listed.
+// This allows each of the system's resolvers to be queried (or checked for
+// DNSSEC validation) individually.
+//
+func GetAllResolvers(resconf string) ([]*Resolver, error) {
+
+	var resolvers []*Resolver
+
+	rc, err := readResolvConf(resconf)
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range rc.servers {
+		resolvers = append(resolvers, rc.newResolver([]*Server{server}))
+	}
+	return resolvers, nil
+}
+
+//
+// resolvConf holds the settings read from a resolver configuration file.
+// A timeout or attempts value of 0 means that the option was not given.
+//
+type resolvConf struct {
+	servers  []*Server
+	timeout  int
+	attempts int
+}
+
+//
+// readResolvConf reads the given resolver configuration file (or the
+// system default). Resolver entries that are not valid IP addresses are
+// skipped.
+//
+func readResolvConf(resconf string) (*resolvConf, error) {
 
 	if resconf == "" {
 		resconf = defaultResolvConf
 	}
-	c, err := dns.ClientConfigFromFile(resconf)
+	data, err := os.ReadFile(resconf)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dns.ClientConfigFromReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 
+	rc := new(resolvConf)
 	for _, s := range c.Servers {
-		ip = net.ParseIP(s)
-		servers = append(servers, NewServer("", ip, defaultResolverPort))
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		rc.servers = append(rc.servers, NewServer("", ip, defaultResolverPort))
+	}
+	if len(rc.servers) == 0 {
+		return nil, fmt.Errorf("no resolver addresses found in %s", resconf)
+	}
+
+	// The dns package fills in its own defaults for these options, so
+	// only use its values if the options are actually present.
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "options" {
+			continue
+		}
+		for _, option := range fields[1:] {
+			switch {
+			case strings.HasPrefix(option, "timeout:"):
+				rc.timeout = c.Timeout
+			case strings.HasPrefix(option, "attempts:"):
+				rc.attempts = c.Attempts
+			}
+		}
+	}
+	return rc, nil
+}
+
+//
+// newResolver returns a new Resolver for the given servers, with the
+// timeout and attempts options of the configuration file applied.
+//
+func (rc *resolvConf) newResolver(servers []*Server) *Resolver {
+
+	r := NewResolver(servers)
+	if rc.timeout > 0 {
+		r.Timeout = time.Second * time.Duration(rc.timeout)
+	}
+	if rc.attempts > 0 {
+		r.Retries = rc.attempts
+	}
+	return r
+}
+
+//
+// VerifyValidating checks that the Resolver validates DNSSEC, by sending
+// a query for the SOA record of the given DNSSEC signed domain (the root
+// zone if it is empty), and checking that the response is authenticated
+// (has the AD bit set). An application can use this at startup to refuse
+// to run without a validating resolver, rather than silently falling back
+// to PKIX authentication. Returns an error wrapping ErrNotValidating if the
+// response is not authenticated.
+//
+func (r *Resolver) VerifyValidating(domain string) error {
+
+	if domain == "" {
+		domain = "."
+	}
+	if r.Cdflag {
+		return fmt.Errorf("%s/SOA: %w", domain, ErrCheckingDisabled)
+	}
+	q := NewQuery(domain, dns.TypeSOA, dns.ClassINET)
+	response, err := sendQuery(q, r)
+	if err != nil {
+		return err
+	}
+	if !responseOK(response) {
+		return fmt.Errorf("%s/SOA: bad response code: %s", domain,
+			dns.RcodeToString[response.MsgHdr.Rcode])
+	}
+	if !response.MsgHdr.AuthenticatedData {
+		return fmt.Errorf("%s/SOA: response unauthenticated: %w", domain,
+			ErrNotValidating)
+	}
+	return nil
+}
+
+//
+// takeTCPConn removes and returns the idle persistent TCP connection to
+// the given server address, or nil if there is none.
+//
+func (r *Resolver) takeTCPConn(address string) *dns.Conn {
+
+	r.tcpLock.Lock()
+	defer r.tcpLock.Unlock()
+	conn := r.tcpConns[address]
+	delete(r.tcpConns, address)
+	return conn
+}
+
+//
+// putTCPConn returns a persistent TCP connection to the given server
+// address to the idle pool. If another connection to the server has been
+// returned in the meantime, this one is closed instead.
+//
+func (r *Resolver) putTCPConn(address string, conn *dns.Conn) {
+
+	r.tcpLock.Lock()
+	defer r.tcpLock.Unlock()
+	if r.tcpConns == nil {
+		r.tcpConns = make(map[string]*dns.Conn)
+	}
+	if _, ok := r.tcpConns[address]; ok {
+		conn.Close()
+		return
+	}
+	r.tcpConns[address] = conn
+}
+
+//
+// Close closes any persistent TCP connections held by the Resolver.
+//
+func (r *Resolver) Close() {
+
+	r.tcpLock.Lock()
+	defer r.tcpLock.Unlock()
+	for address, conn := range r.tcpConns {
+		conn.Close()
+		delete(r.tcpConns, address)
+	}
+}
+
+//
+// getPayload returns the EDNS0 UDP payload size to use for queries.
+//
+func (r *Resolver) getPayload() uint16 {
+
+	r.payloadLock.Lock()
+	defer r.payloadLock.Unlock()
+	return r.Payload
+}
+
+//
+// raisePayload increases the EDNS0 UDP payload size to MaxPayload after a
+// truncated response, if AutoPayload is set, so that subsequent queries
+// are less likely to need TCP fallback.
+//
+func (r *Resolver) raisePayload() {
+
+	if !r.AutoPayload {
+		return
+	}
+	r.payloadLock.Lock()
+	defer r.payloadLock.Unlock()
+	if r.Payload < MaxPayload {
+		r.Payload = MaxPayload
 	}
-	resolver = NewResolver(servers)
-	return resolver, err
 }
@@ -0,0 +1,153 @@
+package dane
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+)
+
+//
+// Target - a host, port, and optional STARTTLS application name to be
+// checked by ScanHosts.
+//
+type Target struct {
+	Hostname string
+	Port     int
+	Appname  string
+}
+
+//
+// ScanResult - outcome of checking a single Target. Config is the dane
+// Config of the last server address tried for the target (nil if no
+// address could be tried), and contains the DANE and PKIX authentication
+// results and TLSA record information.
+//
+type ScanResult struct {
+	Target *Target
+	Config *Config
+	Err    error
+}
+
+// Default number of concurrent workers used by ScanHosts
+var defaultScanConcurrency = 10
+
+//
+// scanTarget looks up TLSA and address records for the given target and
+// tries each address in turn until one succeeds. Connections are always
+// closed before returning.
+//
+func scanTarget(resolver *Resolver, target *Target) *ScanResult {
+
+	var config *Config
+	var conn *tls.Conn
+
+	result := &ScanResult{Target: target}
+
+	tlsa, err := GetTLSA(resolver, target.Hostname, target.Port)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	needSecure := (tlsa != nil)
+	iplist, err := GetAddresses(resolver, target.Hostname, needSecure)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if len(iplist) == 0 {
+		result.Err = fmt.Errorf("%s: no addresses found", target.Hostname)
+		return result
+	}
+
+	for _, ip := range iplist {
+		config = NewConfig(target.Hostname, ip, target.Port)
+		config.SetTLSA(tlsa)
+		config.SetLogger(resolver.Logger)
+		if !resolver.Pkixfallback {
+			config.NoPKIXfallback()
+		}
+		config.SetAppName(target.Appname)
+		if config.needsSTARTTLS() {
+			conn, err = DialStartTLS(config)
+		} else {
+			conn, err = DialTLS(config)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if err == nil {
+			break
+		}
+	}
+
+	result.Config = config
+	result.Err = err
+	return result
+}
+
+//
+// CheckDANE looks up the TLSA records for the given hostname and port,
+// connects to the given IP address, performs DANE (or PKIX fallback)
+// authentication of the server, and closes the connection. It returns
+// the populated dane Config, even on failure, so that the authentication
+// details can be inspected.
+//
+func CheckDANE(resolver *Resolver, hostname string, ip net.IP, port int) (*Config, error) {
+
+	config := NewConfig(hostname, ip, port)
+	config.SetLogger(resolver.Logger)
+	if !resolver.Pkixfallback {
+		config.NoPKIXfallback()
+	}
+
+	tlsa, err := GetTLSA(resolver, hostname, port)
+	if err != nil {
+		return config, err
+	}
+	config.SetTLSA(tlsa)
+
+	conn, err := DialTLS(config)
+	if conn != nil {
+		conn.Close()
+	}
+	return config, err
+}
+
+//
+// ScanHosts checks DANE (and PKIX fallback) authentication for each of
+// the given targets, using a pool of concurrency workers that share the
+// given resolver. It returns a list of results in the same order as the
+// targets. No connections are left open. If concurrency is less than 1,
+// a default value is used.
+//
+func ScanHosts(resolver *Resolver, targets []Target, concurrency int) []ScanResult {
+
+	var wg sync.WaitGroup
+
+	if concurrency < 1 {
+		concurrency = defaultScanConcurrency
+	}
+
+	results := make([]ScanResult, len(targets))
+	indexes := make(chan int)
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = *scanTarget(resolver, &targets[i])
+			}
+		}()
+	}
+
+	for i := range targets {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,45 @@
+package dane
+
+/*
+ * Note: these test routines may not work unless you adapt this file
+ * to use validating DNS resolvers and appropriately configured DANE TLS
+ * servers you have access to.
+ */
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestScanHosts(t *testing.T) {
+
+	targets := []Target{
+		{"www.example.com", 443, ""},
+		{"mail.example.com", 25, "smtp"},
+	}
+
+	results := ScanHosts(resolver1, targets, 2)
+	if len(results) != len(targets) {
+		t.Fatalf("ScanHosts: got %d results, expected %d", len(results), len(targets))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("ScanHosts: %s %d: %s", r.Target.Hostname, r.Target.Port, r.Err)
+		}
+		fmt.Printf("ScanHosts: %s %d: DANE %v PKIX %v\n", r.Target.Hostname,
+			r.Target.Port, r.Config.Okdane, r.Config.Okpkix)
+	}
+}
+
+func TestCheckDANE(t *testing.T) {
+
+	config, err := CheckDANE(resolver1, "www.example.com", net.ParseIP("50.116.63.23"), 443)
+	if err != nil {
+		t.Fatalf("CheckDANE: %s", err)
+	}
+	if config.TLSA != nil {
+		config.TLSA.Results()
+	}
+	fmt.Printf("CheckDANE: DANE %v PKIX %v\n", config.Okdane, config.Okpkix)
+}
@@ -0,0 +1,321 @@
+package dane
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// OID of the embedded SCT list certificate extension (RFC 6962, Section 3.3)
+var oidEmbeddedSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// CTLog is a Certificate Transparency log that SCTs can be verified
+// against, identified by the SHA-256 hash of its public key.
+type CTLog struct {
+	Description string           // Description of the log
+	Key         crypto.PublicKey // Log public key (ECDSA or RSA)
+	ID          [32]byte         // Log ID
+}
+
+// NewCTLog returns a CTLog structure for the log with the given
+// description and DER encoded SubjectPublicKeyInfo, as published in
+// CT log lists.
+func NewCTLog(description string, spki []byte) (*CTLog, error) {
+
+	key, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, fmt.Errorf("CT log %s: %s", description, err.Error())
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("CT log %s: unsupported key type", description)
+	}
+	return &CTLog{Description: description, Key: key, ID: sha256.Sum256(spki)}, nil
+}
+
+// signedCertificateTimestamp is a parsed version 1 SCT (RFC 6962,
+// Section 3.2).
+type signedCertificateTimestamp struct {
+	logID      [32]byte
+	timestamp  uint64
+	extensions []byte
+	hashAlg    uint8
+	sigAlg     uint8
+	signature  []byte
+}
+
+// splitSCTList returns the entries of a TLS encoded
+// SignedCertificateTimestampList, or nil if it is malformed.
+func splitSCTList(data []byte) [][]byte {
+
+	var scts [][]byte
+
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil
+	}
+	data = data[2:]
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil
+		}
+		sctlen := int(binary.BigEndian.Uint16(data))
+		if sctlen == 0 || len(data) < 2+sctlen {
+			return nil
+		}
+		scts = append(scts, data[2:2+sctlen])
+		data = data[2+sctlen:]
+	}
+	return scts
+}
+
+// countSCTList returns the number of entries in a TLS encoded
+// SignedCertificateTimestampList, or 0 if it is malformed.
+func countSCTList(data []byte) int {
+	return len(splitSCTList(data))
+}
+
+// embeddedSCTList returns the TLS encoded SCT list embedded in the given
+// certificate, or nil if there is none.
+func embeddedSCTList(cert *x509.Certificate) []byte {
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidEmbeddedSCTList) {
+			continue
+		}
+		var sctlist []byte
+		if _, err := asn1.Unmarshal(ext.Value, &sctlist); err != nil {
+			return nil
+		}
+		return sctlist
+	}
+	return nil
+}
+
+// countEmbeddedSCTs returns the number of SCTs embedded in the given
+// certificate.
+func countEmbeddedSCTs(cert *x509.Certificate) int {
+	return countSCTList(embeddedSCTList(cert))
+}
+
+// parseSCT parses a TLS encoded SignedCertificateTimestamp.
+func parseSCT(data []byte) (*signedCertificateTimestamp, error) {
+
+	sct := new(signedCertificateTimestamp)
+	if len(data) < 1+32+8+2 || data[0] != 0 {
+		return nil, fmt.Errorf("malformed or unsupported SCT")
+	}
+	copy(sct.logID[:], data[1:33])
+	sct.timestamp = binary.BigEndian.Uint64(data[33:41])
+	extlen := int(binary.BigEndian.Uint16(data[41:43]))
+	data = data[43:]
+	if len(data) < extlen+4 {
+		return nil, fmt.Errorf("malformed SCT")
+	}
+	sct.extensions = data[:extlen]
+	data = data[extlen:]
+	sct.hashAlg, sct.sigAlg = data[0], data[1]
+	siglen := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) != 4+siglen {
+		return nil, fmt.Errorf("malformed SCT signature")
+	}
+	sct.signature = data[4:]
+	return sct, nil
+}
+
+// putUint24 appends the given length as a 3 byte integer to b.
+func putUint24(b []byte, n int) []byte {
+	return append(b, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// sctSignedData returns the data covered by the signature of the given
+// SCT, for the given log entry type (0: X.509 certificate, 1: precertificate)
+// and TLS encoded entry.
+func sctSignedData(sct *signedCertificateTimestamp, entryType uint16, entry []byte) []byte {
+
+	data := make([]byte, 12, 12+len(entry)+2+len(sct.extensions))
+	data[0], data[1] = 0, 0 // version v1, certificate_timestamp
+	binary.BigEndian.PutUint64(data[2:], sct.timestamp)
+	binary.BigEndian.PutUint16(data[10:], entryType)
+	data = append(data, entry...)
+	data = append(data, byte(len(sct.extensions)>>8), byte(len(sct.extensions)))
+	return append(data, sct.extensions...)
+}
+
+// verifySCTSignature verifies the signature of the given SCT over the
+// given data with the key of the given log.
+func verifySCTSignature(log *CTLog, sct *signedCertificateTimestamp, data []byte) bool {
+
+	if sct.hashAlg != 4 { // sha256
+		return false
+	}
+	digest := sha256.Sum256(data)
+	switch key := log.Key.(type) {
+	case *ecdsa.PublicKey:
+		return sct.sigAlg == 3 && ecdsa.VerifyASN1(key, digest[:], sct.signature)
+	case *rsa.PublicKey:
+		return sct.sigAlg == 1 &&
+			rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sct.signature) == nil
+	}
+	return false
+}
+
+// precertTBS returns the TBSCertificate of the given certificate with
+// the embedded SCT list extension removed, which is the form that was
+// signed by the logs for a precertificate entry (RFC 6962, Section 3.2).
+func precertTBS(cert *x509.Certificate) ([]byte, error) {
+
+	var tbs, exts, extlist asn1.RawValue
+	var fields, extensions []byte
+
+	if _, err := asn1.Unmarshal(cert.RawTBSCertificate, &tbs); err != nil {
+		return nil, err
+	}
+	for rest := tbs.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &field); err != nil {
+			return nil, err
+		}
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			fields = append(fields, field.FullBytes...)
+			continue
+		}
+		exts = field
+	}
+	if exts.Bytes == nil {
+		return nil, fmt.Errorf("certificate has no extensions")
+	}
+	if _, err := asn1.Unmarshal(exts.Bytes, &extlist); err != nil {
+		return nil, err
+	}
+	for rest := extlist.Bytes; len(rest) > 0; {
+		var ext struct {
+			Raw asn1.RawContent
+			ID  asn1.ObjectIdentifier
+		}
+		var extraw asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &extraw); err != nil {
+			return nil, err
+		}
+		if _, err = asn1.Unmarshal(extraw.FullBytes, &ext); err == nil &&
+			ext.ID.Equal(oidEmbeddedSCTList) {
+			continue
+		}
+		extensions = append(extensions, extraw.FullBytes...)
+	}
+	if len(extensions) > 0 {
+		extseq, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence,
+			IsCompound: true, Bytes: extensions})
+		if err != nil {
+			return nil, err
+		}
+		extfield, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific,
+			Tag: 3, IsCompound: true, Bytes: extseq})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, extfield...)
+	}
+	return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true,
+		Bytes: fields})
+}
+
+// verifiedSCTCount returns the number of SCTs presented by the server,
+// embedded in the EE certificate or in the TLS handshake, that have a
+// valid signature from one of the given CT logs. SCTs with timestamps
+// in the future are not counted.
+func verifiedSCTCount(cs tls.ConnectionState, logs []*CTLog) int {
+
+	var count int
+
+	if len(cs.PeerCertificates) == 0 {
+		return 0
+	}
+	leaf := cs.PeerCertificates[0]
+	now := uint64(time.Now().UnixMilli())
+
+	verify := func(raw []byte, entryType uint16, entry []byte) {
+		sct, err := parseSCT(raw)
+		if err != nil || sct.timestamp > now {
+			return
+		}
+		for _, log := range logs {
+			if !bytes.Equal(log.ID[:], sct.logID[:]) {
+				continue
+			}
+			if verifySCTSignature(log, sct, sctSignedData(sct, entryType, entry)) {
+				count++
+			}
+			return
+		}
+	}
+
+	entry := putUint24(nil, len(leaf.Raw))
+	entry = append(entry, leaf.Raw...)
+	for _, raw := range cs.SignedCertificateTimestamps {
+		verify(raw, 0, entry)
+	}
+
+	sctlist := embeddedSCTList(leaf)
+	if sctlist == nil || len(cs.PeerCertificates) < 2 {
+		return count
+	}
+	tbs, err := precertTBS(leaf)
+	if err != nil {
+		return count
+	}
+	issuerKeyHash := sha256.Sum256(cs.PeerCertificates[1].RawSubjectPublicKeyInfo)
+	entry = append([]byte(nil), issuerKeyHash[:]...)
+	entry = putUint24(entry, len(tbs))
+	entry = append(entry, tbs...)
+	for _, raw := range splitSCTList(sctlist) {
+		verify(raw, 1, entry)
+	}
+	return count
+}
+
+// checkCT verifies the SCTs presented by the server against the CT logs
+// of the Config, if any, and records the number of valid SCTs. If the
+// Config's RequireCT is set, and there are no valid SCTs, it returns an
+// error (or sets DiagError in diagnostic mode).
+func checkCT(cs tls.ConnectionState, daneconfig *Config) error {
+
+	if len(daneconfig.CTLogs) > 0 {
+		daneconfig.ValidSCTs = verifiedSCTCount(cs, daneconfig.CTLogs)
+	}
+	if !daneconfig.RequireCT || daneconfig.ValidSCTs > 0 {
+		return nil
+	}
+	err := fmt.Errorf("no valid SCTs from a known CT log")
+	if daneconfig.deferFailure() {
+		if daneconfig.DiagError == nil {
+			daneconfig.DiagError = err
+		}
+		return nil
+	}
+	return err
+}
+
+// recordSCTs records the number of Certificate Transparency SCTs that the
+// server presented, either embedded in the EE certificate or in the TLS
+// handshake. SCTs delivered in a stapled OCSP response are not counted.
+// This is informational only, and does not affect authentication.
+func recordSCTs(cs tls.ConnectionState, daneconfig *Config) {
+
+	count := len(cs.SignedCertificateTimestamps)
+	if len(cs.PeerCertificates) > 0 {
+		count += countEmbeddedSCTs(cs.PeerCertificates[0])
+	}
+	daneconfig.SCTCount = count
+	daneconfig.HasSCT = count > 0
+}
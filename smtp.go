@@ -0,0 +1,228 @@
+package dane
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+//
+// MXinfo - a mail exchanger (MX) host of a mail domain.
+//
+type MXinfo struct {
+	Preference uint16
+	Hostname   string
+}
+
+//
+// GetMX returns the mail exchanger hosts of the given mail domain, ordered
+// by preference, and whether the MX RRset was authenticated (per RFC 7672,
+// DANE applies to the MX hosts only if it is). If the domain has no MX
+// records, the domain itself is returned as the implicit MX host. An error
+// is returned if the domain does not exist, or has a null MX record (RFC
+// 7505), indicating that it does not accept mail.
+//
+func GetMX(resolver *Resolver, domain string) ([]*MXinfo, bool, error) {
+
+	var mxlist []*MXinfo
+
+	q := NewQuery(domain, dns.TypeMX, dns.ClassINET)
+	response, err := sendQuery(q, resolver)
+	if err != nil {
+		return nil, false, err
+	}
+	if !responseOK(response) {
+		return nil, false, fmt.Errorf("bad response code to MX query %s: %s", domain,
+			dns.RcodeToString[response.MsgHdr.Rcode])
+	}
+	if response.MsgHdr.Rcode == dns.RcodeNameError {
+		return nil, false, fmt.Errorf("%s: non-existent domain name", domain)
+	}
+	secure := response.MsgHdr.AuthenticatedData
+
+	for _, rr := range response.Answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			if mx.Mx == "." {
+				return nil, secure, fmt.Errorf("%s: null MX, domain does not accept mail", domain)
+			}
+			mxlist = append(mxlist, &MXinfo{Preference: mx.Preference, Hostname: mx.Mx})
+		}
+	}
+	if len(mxlist) == 0 {
+		mxlist = append(mxlist, &MXinfo{Hostname: dns.Fqdn(domain)})
+	}
+	sort.SliceStable(mxlist, func(i, j int) bool {
+		return mxlist[i].Preference < mxlist[j].Preference
+	})
+	return mxlist, secure, nil
+}
+
+//
+// MXResult - the result of checking a single MX host of a mail domain.
+// DANE is set if the host has authenticated TLSA records; Okdane and
+// Okpkix are the DANE and PKIX authentication results of the STARTTLS
+// connection (PKIX being the relevant result for MTA-STS). Config is the
+// dane Config of the last address tried (nil if none could be tried),
+// and Err the error of the check, if any, with ResultType its TLSRPT
+// classification.
+//
+type MXResult struct {
+	MXinfo
+	DANE       bool
+	Okdane     bool
+	Okpkix     bool
+	Config     *Config
+	Err        error
+	ResultType string
+}
+
+//
+// TLSRPT result types (RFC 8460, Section 4.3) of failures, as used in
+// MXResult.
+//
+const (
+	TLSRPTStartTLSNotSupported = "starttls-not-supported"
+	TLSRPTCertHostMismatch     = "certificate-host-mismatch"
+	TLSRPTCertExpired          = "certificate-expired"
+	TLSRPTCertNotTrusted       = "certificate-not-trusted"
+	TLSRPTValidationFailure    = "validation-failure"
+	TLSRPTTLSAInvalid          = "tlsa-invalid"
+	TLSRPTDNSSECInvalid        = "dnssec-invalid"
+	TLSRPTDANERequired         = "dane-required"
+)
+
+//
+// tlsrptResultType classifies the error of an SMTP connection attempt
+// made with the given dane Config (which may be nil) into a TLSRPT result
+// type. Returns an empty string if there was no error.
+//
+func tlsrptResultType(config *Config, err error) string {
+
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrNoTLSA), errors.Is(err, ErrInsecureTLSA):
+		return TLSRPTDANERequired
+	case errors.Is(err, ErrCheckingDisabled):
+		return TLSRPTDNSSECInvalid
+	case errors.Is(err, ErrNoSTARTTLS):
+		return TLSRPTStartTLSNotSupported
+	}
+
+	if config != nil && config.TLSA != nil && len(config.PeerChain) > 0 && !config.Okdane {
+		return daneResultType(config)
+	}
+
+	switch {
+	case errors.As(err, &hostErr):
+		return TLSRPTCertHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return TLSRPTCertExpired
+	case errors.As(err, &invalidErr), errors.As(err, &authorityErr):
+		return TLSRPTCertNotTrusted
+	}
+	return TLSRPTValidationFailure
+}
+
+//
+// daneResultType classifies a DANE authentication failure with the given
+// dane Config into a TLSRPT result type.
+//
+func daneResultType(config *Config) string {
+
+	var usable, mismatch, daneEE bool
+
+	for _, tr := range config.TLSA.Rdata {
+		if tr.validate() == nil {
+			usable = true
+		}
+		if tr.Usage == DaneEE {
+			daneEE = true
+		}
+		if tr.NameMismatch {
+			mismatch = true
+		}
+	}
+	switch {
+	case !usable:
+		return TLSRPTTLSAInvalid
+	case mismatch:
+		return TLSRPTCertHostMismatch
+	case !daneEE && time.Now().After(config.PeerChain[0].NotAfter):
+		// The validity period doesn't matter for DANE-EE (RFC 7671).
+		return TLSRPTCertExpired
+	}
+	return TLSRPTValidationFailure
+}
+
+//
+// SMTPResult - the result of checking the SMTP DANE status of all the
+// MX hosts of a mail domain, for use by mail policy engines and reports,
+// such as for MTA-STS and TLSRPT.
+//
+type SMTPResult struct {
+	Domain   string
+	MXSecure bool
+	MX       []*MXResult
+}
+
+//
+// DANEConsistent returns whether DANE is consistently deployed for the
+// mail domain: the MX RRset is authenticated, and every MX host has TLSA
+// records and was successfully DANE authenticated.
+//
+func (r *SMTPResult) DANEConsistent() bool {
+
+	if !r.MXSecure || len(r.MX) == 0 {
+		return false
+	}
+	for _, mx := range r.MX {
+		if !mx.DANE || !mx.Okdane {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// ConnectSMTPDANE checks the SMTP DANE status of each MX host of the given
+// mail domain: it looks up the MX hosts, and then the TLSA records and
+// addresses of each host, and connects to port 25 with STARTTLS, as
+// ScanHosts does. Failures are classified into TLSRPT result types, for
+// SMTP TLS reporting. The connections are closed before returning. Hosts
+// are checked concurrently. An error is returned only if the MX hosts
+// could not be determined; the errors of each host are in the results.
+//
+func ConnectSMTPDANE(resolver *Resolver, domain string) (*SMTPResult, error) {
+
+	mxlist, secure, err := GetMX(resolver, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SMTPResult{Domain: dns.Fqdn(domain), MXSecure: secure}
+	targets := make([]Target, len(mxlist))
+	for i, mx := range mxlist {
+		targets[i] = Target{Hostname: mx.Hostname, Port: 25, Appname: "smtp"}
+	}
+
+	for i, scan := range ScanHosts(resolver, targets, 0) {
+		mx := &MXResult{MXinfo: *mxlist[i], Config: scan.Config, Err: scan.Err}
+		mx.ResultType = tlsrptResultType(scan.Config, scan.Err)
+		if scan.Config != nil {
+			mx.DANE = scan.Config.TLSA != nil
+			mx.Okdane = scan.Config.Okdane
+			mx.Okpkix = scan.Config.Okpkix
+		}
+		result.MX = append(result.MX, mx)
+	}
+	return result, nil
+}
@@ -0,0 +1,128 @@
+package dane
+
+/*
+ * Note: these test routines may not work unless you adapt this file
+ * to use validating DNS resolvers and appropriately configured DANE TLS
+ * servers you have access to.
+ */
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConnectSMTPDANE(t *testing.T) {
+
+	resolver, err := GetResolver("")
+	if err != nil {
+		t.Fatalf("GetResolver: %s", err)
+	}
+	result, err := ConnectSMTPDANE(resolver, "ietf.org")
+	if err != nil {
+		t.Fatalf("ConnectSMTPDANE: %s", err)
+	}
+	for _, mx := range result.MX {
+		t.Logf("%d %s: DANE %v, Okdane %v, Okpkix %v, err %v", mx.Preference,
+			mx.Hostname, mx.DANE, mx.Okdane, mx.Okpkix, mx.Err)
+	}
+	if !result.DANEConsistent() {
+		t.Fatalf("ConnectSMTPDANE: DANE not consistent for %s", result.Domain)
+	}
+}
+
+func TestGetMXOffline(t *testing.T) {
+
+	resolver := NewResolver(nil)
+	resolver.Exchanger = &stubExchanger{records: []string{
+		"example.com. 300 IN MX 20 mx2.example.com.",
+		"example.com. 300 IN MX 10 mx1.example.com.",
+		"null.example.com. 300 IN MX 0 .",
+	}}
+
+	mxlist, secure, err := GetMX(resolver, "example.com")
+	if err != nil {
+		t.Fatalf("GetMX: %s", err)
+	}
+	if !secure || len(mxlist) != 2 || mxlist[0].Hostname != "mx1.example.com." ||
+		mxlist[1].Preference != 20 {
+		t.Fatalf("GetMX: unexpected result %v %+v", secure, mxlist)
+	}
+
+	mxlist, _, err = GetMX(resolver, "nomx.example.com")
+	if err != nil {
+		t.Fatalf("GetMX: %s", err)
+	}
+	if len(mxlist) != 1 || mxlist[0].Hostname != "nomx.example.com." {
+		t.Fatalf("GetMX: unexpected implicit MX %+v", mxlist)
+	}
+
+	if _, _, err = GetMX(resolver, "null.example.com"); err == nil {
+		t.Fatalf("GetMX: succeeded for null MX")
+	}
+}
+
+func TestDANEConsistentOffline(t *testing.T) {
+
+	ok := &MXResult{DANE: true, Okdane: true}
+	for _, tc := range []struct {
+		result     SMTPResult
+		consistent bool
+	}{
+		{SMTPResult{MXSecure: true, MX: []*MXResult{ok, ok}}, true},
+		{SMTPResult{MXSecure: false, MX: []*MXResult{ok}}, false},
+		{SMTPResult{MXSecure: true, MX: []*MXResult{ok, {DANE: false}}}, false},
+		{SMTPResult{MXSecure: true, MX: []*MXResult{ok, {DANE: true}}}, false},
+		{SMTPResult{MXSecure: true}, false},
+	} {
+		if got := tc.result.DANEConsistent(); got != tc.consistent {
+			t.Fatalf("DANEConsistent(%+v) = %v, want %v", tc.result, got, tc.consistent)
+		}
+	}
+}
+
+func TestTLSRPTResultTypeOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "mx.example.com", false, ca, cakey)
+
+	daneconfig := func(rdata ...*TLSArdata) *Config {
+		config := NewConfig("mx.example.com", "192.0.2.1", 25)
+		config.SetTLSA(&TLSAinfo{Rdata: rdata})
+		for i, tr := range rdata {
+			// Keep the matching results, which SetTLSA clears.
+			config.TLSA.Rdata[i].Checked = tr.Checked
+			config.TLSA.Rdata[i].Message = tr.Message
+			config.TLSA.Rdata[i].NameMismatch = tr.NameMismatch
+		}
+		config.PeerChain = []*x509.Certificate{ee, ca}
+		return config
+	}
+	valid := &TLSArdata{Usage: DaneEE, Selector: 1, Mtype: 1, Data: strings.Repeat("ab", 32)}
+	nameFail := &TLSArdata{Usage: DaneTA, Selector: 1, Mtype: 1, Data: strings.Repeat("ab", 32),
+		Checked: true, NameMismatch: true, Message: "matched TA certificate at depth 1"}
+	authFail := fmt.Errorf("DANE TLS authentication failed")
+
+	for _, tc := range []struct {
+		config   *Config
+		err      error
+		expected string
+	}{
+		{nil, nil, ""},
+		{nil, &DANERequiredError{Hostname: "mx.example.com", Err: ErrNoTLSA}, TLSRPTDANERequired},
+		{nil, fmt.Errorf("%w: _25._tcp.mx.example.com", ErrNoTLSA), TLSRPTDANERequired},
+		{nil, fmt.Errorf("SMTP %w", ErrNoSTARTTLS), TLSRPTStartTLSNotSupported},
+		{daneconfig(&TLSArdata{}), authFail, TLSRPTTLSAInvalid},
+		{daneconfig(valid), authFail, TLSRPTValidationFailure},
+		{daneconfig(nameFail), authFail, TLSRPTCertHostMismatch},
+		{nil, x509.HostnameError{Certificate: ee, Host: "mx.example.net"}, TLSRPTCertHostMismatch},
+		{nil, x509.CertificateInvalidError{Cert: ee, Reason: x509.Expired}, TLSRPTCertExpired},
+		{nil, x509.UnknownAuthorityError{Cert: ee}, TLSRPTCertNotTrusted},
+		{nil, fmt.Errorf("connection refused"), TLSRPTValidationFailure},
+	} {
+		if got := tlsrptResultType(tc.config, tc.err); got != tc.expected {
+			t.Fatalf("tlsrptResultType(%v) = %q, want %q", tc.err, got, tc.expected)
+		}
+	}
+}
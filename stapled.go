@@ -0,0 +1,308 @@
+package dane
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+//
+// rootAnchors - the DS records of the DNS root zone key signing keys
+// (KSK-2017 and KSK-2024), the default trust anchors for validating
+// stapled DNSSEC chains.
+//
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+//
+// RootTrustAnchors returns the DS records of the DNS root zone keys, for
+// use as trust anchors with VerifyDNSSECChain.
+//
+func RootTrustAnchors() []*dns.DS {
+
+	var anchors []*dns.DS
+
+	for _, s := range rootAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(fmt.Sprintf("invalid root trust anchor %q: %s", s, err))
+		}
+		anchors = append(anchors, rr.(*dns.DS))
+	}
+	return anchors
+}
+
+//
+// ParseDNSSECChain parses the data of an RFC 9102 DNSSEC chain TLS
+// extension, and returns the extension support lifetime (in hours) and
+// the DNS resource records of the authentication chain.
+//
+func ParseDNSSECChain(data []byte) (uint16, []dns.RR, error) {
+
+	var rrs []dns.RR
+
+	if len(data) < 4 {
+		return 0, nil, fmt.Errorf("DNSSEC chain extension too short")
+	}
+	lifetime := binary.BigEndian.Uint16(data)
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	chain := data[4:]
+	if len(chain) != length {
+		return 0, nil, fmt.Errorf("DNSSEC chain length %d, expected %d", len(chain), length)
+	}
+
+	for off := 0; off < len(chain); {
+		rr, next, err := dns.UnpackRR(chain, off)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid DNSSEC chain record at offset %d: %s",
+				off, err.Error())
+		}
+		rrs = append(rrs, rr)
+		off = next
+	}
+	return lifetime, rrs, nil
+}
+
+//
+// rrsetKey - owner name (lower case) and type of an RRset.
+//
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+//
+// dnssecChain - the RRsets and RRSIGs of a DNSSEC authentication chain,
+// and the DNSKEY and DS RRsets validated so far.
+//
+type dnssecChain struct {
+	rrsets  map[rrsetKey][]dns.RR
+	rrsigs  map[rrsetKey][]*dns.RRSIG
+	keys    map[string][]*dns.DNSKEY
+	ds      map[string][]*dns.DS
+	now     time.Time
+	updated bool
+}
+
+//
+// newDNSSECChain groups the given records into RRsets, and initializes
+// the validated DS records with the given trust anchors.
+//
+func newDNSSECChain(rrs []dns.RR, anchors []*dns.DS, now time.Time) *dnssecChain {
+
+	c := &dnssecChain{
+		rrsets: make(map[rrsetKey][]dns.RR),
+		rrsigs: make(map[rrsetKey][]*dns.RRSIG),
+		keys:   make(map[string][]*dns.DNSKEY),
+		ds:     make(map[string][]*dns.DS),
+		now:    now,
+	}
+	for _, rr := range rrs {
+		name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name, sig.TypeCovered}
+			c.rrsigs[key] = append(c.rrsigs[key], sig)
+			continue
+		}
+		key := rrsetKey{name, rr.Header().Rrtype}
+		c.rrsets[key] = append(c.rrsets[key], rr)
+	}
+	for _, ds := range anchors {
+		name := strings.ToLower(dns.Fqdn(ds.Hdr.Name))
+		c.ds[name] = append(c.ds[name], ds)
+	}
+	return c
+}
+
+//
+// verify checks that the RRset with the given key has a currently valid
+// signature by one of the validated keys of a zone that signer accepts.
+// Signatures of wildcard expanded records are not accepted, since the
+// proof that no closer match exists is not checked.
+//
+func (c *dnssecChain) verify(key rrsetKey, keys map[string][]*dns.DNSKEY,
+	signer func(string) bool) error {
+
+	rrset := c.rrsets[key]
+	for _, sig := range c.rrsigs[key] {
+		zone := strings.ToLower(dns.Fqdn(sig.SignerName))
+		if !signer(zone) || !sig.ValidityPeriod(c.now) {
+			continue
+		}
+		if int(sig.Labels) < dns.CountLabel(key.name) {
+			continue
+		}
+		for _, k := range keys[zone] {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if sig.Verify(k, rrset) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s/%s: no valid signature", key.name, dns.TypeToString[key.rrtype])
+}
+
+//
+// matchesDS returns whether the DNSKEY is a zone key matching one of the
+// given DS records.
+//
+func matchesDS(k *dns.DNSKEY, dslist []*dns.DS) bool {
+
+	if k.Flags&dns.ZONE == 0 {
+		return false
+	}
+	for _, ds := range dslist {
+		if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+			continue
+		}
+		if kds := k.ToDS(ds.DigestType); kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// validateKeys validates the DNSKEY RRsets of zones with validated DS
+// records, and the DS RRsets signed by zones with validated keys, until
+// no more can be validated.
+//
+func (c *dnssecChain) validateKeys() {
+
+	for c.updated = true; c.updated; {
+		c.updated = false
+		for key, rrset := range c.rrsets {
+			switch key.rrtype {
+			case dns.TypeDNSKEY:
+				c.validateDNSKEY(key, rrset)
+			case dns.TypeDS:
+				c.validateDS(key, rrset)
+			}
+		}
+	}
+}
+
+//
+// validateDNSKEY validates a DNSKEY RRset, which must be signed by one of
+// its keys that matches a validated DS record for the zone.
+//
+func (c *dnssecChain) validateDNSKEY(key rrsetKey, rrset []dns.RR) {
+
+	if _, ok := c.keys[key.name]; ok || c.ds[key.name] == nil {
+		return
+	}
+
+	var zonekeys []*dns.DNSKEY
+	for _, rr := range rrset {
+		zonekeys = append(zonekeys, rr.(*dns.DNSKEY))
+	}
+	for _, k := range zonekeys {
+		if !matchesDS(k, c.ds[key.name]) {
+			continue
+		}
+		err := c.verify(key, map[string][]*dns.DNSKEY{key.name: {k}},
+			func(zone string) bool { return zone == key.name })
+		if err == nil {
+			c.keys[key.name] = zonekeys
+			c.updated = true
+			return
+		}
+	}
+}
+
+//
+// validateDS validates a DS RRset, which must be signed by a validated
+// key of an ancestor zone.
+//
+func (c *dnssecChain) validateDS(key rrsetKey, rrset []dns.RR) {
+
+	if _, ok := c.ds[key.name]; ok {
+		return
+	}
+	err := c.verify(key, c.keys, func(zone string) bool {
+		return zone != key.name && dns.IsSubDomain(zone, key.name)
+	})
+	if err != nil {
+		return
+	}
+	for _, rr := range rrset {
+		c.ds[key.name] = append(c.ds[key.name], rr.(*dns.DS))
+	}
+	c.updated = true
+}
+
+//
+// VerifyDNSSECChain validates the TLSA RRset for the given hostname and
+// port in a DNSSEC authentication chain, such as one stapled by a server
+// in the RFC 9102 TLS extension, and returns the TLSA information for use
+// with Config.SetTLSA, without any DNS queries. The chain must contain the
+// TLSA RRset and its signatures, and the DNSKEY and DS RRsets (with their
+// signatures) from the given trust anchors (the root zone keys if nil) to
+// the zone of the TLSA records. Aliases, wildcards, and proofs of the
+// absence of TLSA records are not supported: an error is returned if the
+// chain does not contain a validated TLSA RRset for the name.
+//
+func VerifyDNSSECChain(rrs []dns.RR, hostname string, port int, anchors []*dns.DS) (*TLSAinfo, error) {
+	return verifyDNSSECChain(rrs, hostname, port, anchors, time.Now())
+}
+
+//
+// verifyDNSSECChain is VerifyDNSSECChain, validating signatures at the
+// given time.
+//
+func verifyDNSSECChain(rrs []dns.RR, hostname string, port int, anchors []*dns.DS,
+	now time.Time) (*TLSAinfo, error) {
+
+	if anchors == nil {
+		anchors = RootTrustAnchors()
+	}
+	qname := dns.Fqdn(fmt.Sprintf("_%d._tcp.%s", port, hostname))
+	key := rrsetKey{strings.ToLower(qname), dns.TypeTLSA}
+
+	c := newDNSSECChain(rrs, anchors, now)
+	if c.rrsets[key] == nil {
+		return nil, fmt.Errorf("%s: no TLSA records in DNSSEC chain", qname)
+	}
+	c.validateKeys()
+	err := c.verify(key, c.keys, func(zone string) bool {
+		return dns.IsSubDomain(zone, key.name)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DNSSEC chain validation failed: %s", err.Error())
+	}
+
+	tlsarrs := c.rrsets[key]
+	for _, sig := range c.rrsigs[key] {
+		tlsarrs = append(tlsarrs, sig)
+	}
+	tlsa := TLSAinfoFromRRs(qname, tlsarrs)
+	if tlsa == nil || len(tlsa.Rdata) == 0 {
+		return nil, fmt.Errorf("%s: no usable TLSA records in DNSSEC chain", qname)
+	}
+	return tlsa, nil
+}
+
+//
+// GetTLSAStapled parses the data of an RFC 9102 DNSSEC chain TLS extension
+// received from a server, validates the chain from the DNS root, and
+// returns the TLSA information for the given hostname and port, as
+// VerifyDNSSECChain does. Note that the crypto/tls package used by this
+// library can neither request the extension nor return its data, so the
+// data must be obtained by other means, such as from another TLS
+// implementation.
+//
+func GetTLSAStapled(data []byte, hostname string, port int) (*TLSAinfo, error) {
+
+	_, rrs, err := ParseDNSSECChain(data)
+	if err != nil {
+		return nil, err
+	}
+	return VerifyDNSSECChain(rrs, hostname, port, nil)
+}
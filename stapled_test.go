@@ -0,0 +1,144 @@
+package dane
+
+import (
+	"crypto"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a DNSSEC signed zone for building test DNSSEC chains.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Generate: %s", err)
+	}
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the RRSIG over the given RRset by the zone's key.
+func (z *testZone) sign(t *testing.T, rrset []dns.RR, now time.Time) *dns.RRSIG {
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  z.key.Algorithm,
+		SignerName: z.name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatalf("Sign: %s", err)
+	}
+	return sig
+}
+
+// makeTestDNSSECChain returns a DNSSEC chain for a TLSA record at
+// _443._tcp.www.example.com, with the root zone's DS as trust anchor.
+func makeTestDNSSECChain(t *testing.T, now time.Time) ([]dns.RR, []*dns.DS) {
+
+	root := newTestZone(t, ".")
+	zone := newTestZone(t, "example.com.")
+
+	ds := zone.key.ToDS(dns.SHA256)
+	tlsa, err := dns.NewRR("_443._tcp.www.example.com. 3600 IN TLSA 3 1 1 " + strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatalf("NewRR: %s", err)
+	}
+
+	var rrs []dns.RR
+	rrs = append(rrs, tlsa, zone.sign(t, []dns.RR{tlsa}, now))
+	rrs = append(rrs, zone.key, zone.sign(t, []dns.RR{zone.key}, now))
+	rrs = append(rrs, ds, root.sign(t, []dns.RR{ds}, now))
+	rrs = append(rrs, root.key, root.sign(t, []dns.RR{root.key}, now))
+	return rrs, []*dns.DS{root.key.ToDS(dns.SHA256)}
+}
+
+func TestVerifyDNSSECChainOffline(t *testing.T) {
+
+	now := time.Now()
+	rrs, anchors := makeTestDNSSECChain(t, now)
+
+	tlsa, err := verifyDNSSECChain(rrs, "www.example.com", 443, anchors, now)
+	if err != nil {
+		t.Fatalf("verifyDNSSECChain: %s", err)
+	}
+	if len(tlsa.Rdata) != 1 || tlsa.Rdata[0].Usage != DaneEE || len(tlsa.RRSIG) != 1 {
+		t.Fatalf("verifyDNSSECChain: unexpected TLSA information: %+v", tlsa)
+	}
+
+	if _, err = verifyDNSSECChain(rrs, "www.example.com", 443, anchors,
+		now.Add(2*time.Hour)); err == nil {
+		t.Fatalf("verifyDNSSECChain: succeeded with expired signatures")
+	}
+	if _, err = verifyDNSSECChain(rrs, "www.example.com", 443,
+		RootTrustAnchors(), now); err == nil {
+		t.Fatalf("verifyDNSSECChain: succeeded with wrong trust anchor")
+	}
+	if _, err = verifyDNSSECChain(rrs[:4], "www.example.com", 443, anchors, now); err == nil {
+		t.Fatalf("verifyDNSSECChain: succeeded without DS records")
+	}
+	if _, err = verifyDNSSECChain(rrs, "www.example.com", 25, anchors, now); err == nil {
+		t.Fatalf("verifyDNSSECChain: succeeded for wrong port")
+	}
+
+	// Tampered TLSA data
+	tampered := append([]dns.RR(nil), rrs...)
+	tampered[0] = dns.Copy(rrs[0])
+	tampered[0].(*dns.TLSA).Certificate = strings.Repeat("cd", 32)
+	if _, err = verifyDNSSECChain(tampered, "www.example.com", 443, anchors, now); err == nil {
+		t.Fatalf("verifyDNSSECChain: succeeded with tampered TLSA record")
+	}
+}
+
+func TestParseDNSSECChainOffline(t *testing.T) {
+
+	rrs, _ := makeTestDNSSECChain(t, time.Now())
+
+	var chain []byte
+	for _, rr := range rrs {
+		buf := make([]byte, dns.Len(rr)+64)
+		off, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			t.Fatalf("PackRR: %s", err)
+		}
+		chain = append(chain, buf[:off]...)
+	}
+	data := make([]byte, 4, 4+len(chain))
+	binary.BigEndian.PutUint16(data, 24)
+	binary.BigEndian.PutUint16(data[2:], uint16(len(chain)))
+	data = append(data, chain...)
+
+	lifetime, parsed, err := ParseDNSSECChain(data)
+	if err != nil {
+		t.Fatalf("ParseDNSSECChain: %s", err)
+	}
+	if lifetime != 24 || len(parsed) != len(rrs) {
+		t.Fatalf("ParseDNSSECChain: lifetime %d, %d records", lifetime, len(parsed))
+	}
+	for i := range rrs {
+		if !dns.IsDuplicate(rrs[i], parsed[i]) {
+			t.Fatalf("ParseDNSSECChain: record %d mismatch: %s", i, parsed[i])
+		}
+	}
+
+	if _, _, err = ParseDNSSECChain(data[:len(data)-1]); err == nil {
+		t.Fatalf("ParseDNSSECChain: succeeded with truncated data")
+	}
+}
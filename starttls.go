@@ -3,14 +3,106 @@ package dane
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/xml"
 	"fmt"
-	"os"
+	"io"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const bufsize = 2048
 
+// Defaults for the STARTTLS dialog: the maximum amount of data read from
+// the server before the TLS handshake, and the dialog timeout in seconds.
+const (
+	defaultMaxPreamble = 64 * 1024
+	defaultTimeoutSTLS = 60
+)
+
+//
+// preambleReader is an io.Reader that fails once more than a given number
+// of bytes have been read, to bound the STARTTLS dialog (and its transcript)
+// with servers that send too much data.
+//
+type preambleReader struct {
+	r         io.Reader
+	remaining int
+}
+
+func (p *preambleReader) Read(b []byte) (int, error) {
+	if p.remaining <= 0 {
+		return 0, fmt.Errorf("too much data from server before STARTTLS")
+	}
+	if len(b) > p.remaining {
+		b = b[:p.remaining]
+	}
+	n, err := p.r.Read(b)
+	p.remaining -= n
+	return n, err
+}
+
+//
+// dialPreamble connects to the server for a STARTTLS dialog, and returns
+// the connection and a reader and writer for the dialog. The amount of data
+// read is bounded by the Config's MaxPreamble, and the dialog must complete
+// within its TimeoutSTLS.
+//
+func dialPreamble(daneconfig *Config) (net.Conn, *bufio.Reader, *bufio.Writer, error) {
+
+	conn, err := getTCPconn(daneconfig)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	timeout := daneconfig.TimeoutSTLS
+	if timeout <= 0 {
+		timeout = defaultTimeoutSTLS
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * time.Duration(timeout)))
+
+	maxPreamble := daneconfig.MaxPreamble
+	if maxPreamble <= 0 {
+		maxPreamble = defaultMaxPreamble
+	}
+	reader := bufio.NewReader(&preambleReader{r: conn, remaining: maxPreamble})
+	writer := bufio.NewWriter(conn)
+	return conn, reader, writer, nil
+}
+
+//
+// preambleHandshake negotiates TLS on the connection, replacing the
+// STARTTLS dialog deadline with the handshake deadline of the Config. The
+// server must not have sent anything after its reply to the STARTTLS
+// command: any such data, already read into the dialog reader, could only
+// have been injected ahead of the TLS session (STARTTLS command
+// injection), so the connection is closed and an error returned, rather
+// than the data being discarded.
+//
+func preambleHandshake(conn net.Conn, reader *bufio.Reader, tlsconfig *tls.Config,
+	daneconfig *Config) (*tls.Conn, error) {
+
+	if n := reader.Buffered(); n > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%d bytes of unexpected data after STARTTLS reply (possible injection)", n)
+	}
+	conn.SetDeadline(time.Time{})
+	return daneconfig.handshake(conn, tlsconfig)
+}
+
+//
+// xmlEscape returns the given string escaped for use in XML text or a
+// quoted attribute value. Characters not permitted in XML (such as NUL)
+// are replaced with the Unicode replacement character.
+//
+func xmlEscape(s string) string {
+
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
 //
 // DoXMPP connects to an XNPP server, issue a STARTTLS command, negotiates
 // TLS and returns a TLS connection. See RFC 6120, Section 5.4.2 for details.
@@ -23,12 +115,10 @@ func DoXMPP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 	buf := make([]byte, bufsize)
 
 	server := daneconfig.Server
-	conn, err := getTCPconn(server.Ipaddr, server.Port, daneconfig.TimeoutTCP)
+	conn, reader, writer, err := dialPreamble(daneconfig)
 	if err != nil {
 		return nil, err
 	}
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
 
 	if daneconfig.Servicename != "" {
 		servicename = daneconfig.Servicename
@@ -43,12 +133,12 @@ func DoXMPP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 		rolename = "server"
 	}
 
-	// send initial stream header
+	// send initial stream header, with the interpolated values escaped
 	outstring := fmt.Sprintf(
 		"<?xml version='1.0'?><stream:stream to='%s' "+
 			"version='1.0' xml:lang='en' xmlns='jabber:%s' "+
 			"xmlns:stream='http://etherx.jabber.org/streams'>",
-		servicename, rolename)
+		xmlEscape(servicename), xmlEscape(rolename))
 	transcript += fmt.Sprintf("send: %s\n", outstring)
 	writer.WriteString(outstring)
 	writer.Flush()
@@ -87,7 +177,7 @@ func DoXMPP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 	}
 
 	daneconfig.Transcript = transcript
-	return TLShandshake(conn, tlsconfig)
+	return preambleHandshake(conn, reader, tlsconfig, daneconfig)
 }
 
 //
@@ -98,15 +188,11 @@ func DoPOP3(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 
 	var line, transcript string
 
-	server := daneconfig.Server
-	conn, err := getTCPconn(server.Ipaddr, server.Port, daneconfig.TimeoutTCP)
+	conn, reader, writer, err := dialPreamble(daneconfig)
 	if err != nil {
 		return nil, err
 	}
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
 	// Read POP3 greeting
 	line, err = reader.ReadString('\n')
 	if err != nil {
@@ -132,52 +218,128 @@ func DoPOP3(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 	}
 
 	daneconfig.Transcript = transcript
-	return TLShandshake(conn, tlsconfig)
+	return preambleHandshake(conn, reader, tlsconfig, daneconfig)
+}
+
+//
+// imapCapabilities returns the capabilities (in upper case) listed in an
+// IMAP response line: either an untagged CAPABILITY response, or a status
+// response with a CAPABILITY response code, such as a greeting of the
+// form "* OK [CAPABILITY IMAP4rev1 STARTTLS ...] ready".
+//
+func imapCapabilities(line string) []string {
+
+	var list string
+
+	upper := strings.ToUpper(line)
+	if i := strings.Index(upper, "[CAPABILITY "); i >= 0 {
+		list = upper[i+len("[CAPABILITY "):]
+		if j := strings.IndexByte(list, ']'); j >= 0 {
+			list = list[:j]
+		}
+	} else if strings.HasPrefix(upper, "* CAPABILITY ") {
+		list = upper[len("* CAPABILITY "):]
+	}
+	return strings.Fields(list)
+}
+
+//
+// imapSTARTTLS returns whether the given IMAP response line advertises
+// the STARTTLS capability.
+//
+func imapSTARTTLS(line string) bool {
+
+	for _, capability := range imapCapabilities(line) {
+		if capability == "STARTTLS" {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// readIMAPResponse reads IMAP response lines, adding them to the
+// transcript, up to and including the tagged completion response for the
+// given command tag. It returns the completion status (OK, NO, or BAD),
+// and all the lines read.
+//
+func readIMAPResponse(reader *bufio.Reader, tag string, transcript *string) (string, []string, error) {
+
+	var lines []string
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		*transcript += fmt.Sprintf("recv: %s\n", line)
+		lines = append(lines, line)
+		if strings.HasPrefix(line, tag+" ") {
+			status := strings.Fields(line[len(tag)+1:])
+			if len(status) == 0 {
+				return "", lines, fmt.Errorf("invalid IMAP response: %s", line)
+			}
+			return strings.ToUpper(status[0]), lines, nil
+		}
+	}
 }
 
 //
 // DoIMAP connects to an IMAP server, issues a STARTTLS command, negotiates
-// TLS, and returns a TLS connection.
+// TLS, and returns a TLS connection. If the server's greeting lists its
+// capabilities, they are used to detect STARTTLS support; otherwise a
+// CAPABILITY command is issued. A PREAUTH greeting is rejected, since
+// STARTTLS cannot be used once the session is already authenticated.
 //
 func DoIMAP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 
 	var gotSTARTTLS bool
 	var line, transcript string
 
-	server := daneconfig.Server
-	conn, err := getTCPconn(server.Ipaddr, server.Port, daneconfig.TimeoutTCP)
+	conn, reader, writer, err := dialPreamble(daneconfig)
 	if err != nil {
 		return nil, err
 	}
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
-	// Read IMAP greeting
+	// Read IMAP greeting, which may list the capabilities
 	line, err = reader.ReadString('\n')
 	if err != nil {
 		return nil, err
 	}
 	line = strings.TrimRight(line, "\r\n")
 	transcript += fmt.Sprintf("recv: %s\n", line)
-
-	// Send Capability command, read response, looking for STARTTLS
-	transcript += "send: . CAPABILITY\n"
-	writer.WriteString(". CAPABILITY\r\n")
-	writer.Flush()
-
-	for {
-		line, err = reader.ReadString('\n')
+	greeting := strings.ToUpper(line)
+	if strings.HasPrefix(greeting, "* PREAUTH") {
+		// RFC 3501 and RFC 2595: STARTTLS is only valid in the
+		// not authenticated state.
+		return nil, fmt.Errorf("IMAP server sent PREAUTH greeting, STARTTLS not permitted: %s", line)
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return nil, fmt.Errorf("invalid IMAP greeting: %s", line)
+	}
+	gotSTARTTLS = imapSTARTTLS(line)
+	tag := 0
+
+	if !gotSTARTTLS && len(imapCapabilities(line)) == 0 {
+		// Send Capability command, read response, looking for STARTTLS
+		tag++
+		command := fmt.Sprintf("a%d CAPABILITY", tag)
+		transcript += fmt.Sprintf("send: %s\n", command)
+		writer.WriteString(command + "\r\n")
+		writer.Flush()
+
+		status, lines, err := readIMAPResponse(reader, fmt.Sprintf("a%d", tag), &transcript)
 		if err != nil {
 			return nil, err
 		}
-		line = strings.TrimRight(line, "\r\n")
-		transcript += fmt.Sprintf("recv: %s\n", line)
-		if strings.HasPrefix(line, "* CAPABILITY") && strings.Contains(line, "STARTTLS") {
-			gotSTARTTLS = true
+		if status != "OK" {
+			return nil, fmt.Errorf("IMAP CAPABILITY command failed")
 		}
-		if strings.HasPrefix(line, ". OK") {
-			break
+		for _, line = range lines {
+			if imapSTARTTLS(line) {
+				gotSTARTTLS = true
+			}
 		}
 	}
 
@@ -185,24 +347,23 @@ func DoIMAP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 		return nil, fmt.Errorf("IMAP STARTTLS capability unavailable")
 	}
 
-	// Send STARTTLS
-	transcript += "send: . STARTTLS\n"
-	writer.WriteString(". STARTTLS\r\n")
+	// Send STARTTLS, and look for OK response
+	tag++
+	command := fmt.Sprintf("a%d STARTTLS", tag)
+	transcript += fmt.Sprintf("send: %s\n", command)
+	writer.WriteString(command + "\r\n")
 	writer.Flush()
 
-	// Look for OK response
-	line, err = reader.ReadString('\n')
+	status, _, err := readIMAPResponse(reader, fmt.Sprintf("a%d", tag), &transcript)
 	if err != nil {
 		return nil, err
 	}
-	line = strings.TrimRight(line, "\r\n")
-	transcript += fmt.Sprintf("recv: %s\n", line)
-	if !strings.HasPrefix(line, ". OK") {
+	if status != "OK" {
 		return nil, fmt.Errorf("STARTTLS failed to negotiate")
 	}
 
 	daneconfig.Transcript = transcript
-	return TLShandshake(conn, tlsconfig)
+	return preambleHandshake(conn, reader, tlsconfig, daneconfig)
 }
 
 //
@@ -213,15 +374,21 @@ func DoIMAP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 func parseSMTPline(line string) (int, string, bool, error) {
 
 	var responseDone = false
+	var rest string
 
+	if len(line) < 3 {
+		return 0, "", responseDone, fmt.Errorf("short SMTP reply line: %q", line)
+	}
 	replycode, err := strconv.Atoi(line[:3])
 	if err != nil {
 		return 0, "", responseDone, fmt.Errorf("invalid reply code: %s", line)
 	}
-	if line[3] != '-' {
+	if len(line) == 3 || line[3] != '-' {
 		responseDone = true
 	}
-	rest := line[4:]
+	if len(line) > 4 {
+		rest = line[4:]
+	}
 	return replycode, rest, responseDone, err
 }
 
@@ -235,15 +402,11 @@ func DoSMTP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 	var line, rest, transcript string
 	var responseDone, gotSTARTTLS bool
 
-	server := daneconfig.Server
-	conn, err := getTCPconn(server.Ipaddr, server.Port, daneconfig.TimeoutTCP)
+	conn, reader, writer, err := dialPreamble(daneconfig)
 	if err != nil {
 		return nil, err
 	}
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
 	// Read possibly multi-line SMTP greeting
 	for {
 		line, err = reader.ReadString('\n')
@@ -265,7 +428,7 @@ func DoSMTP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 	}
 
 	// Send EHLO, read possibly multi-line response, look for STARTTLS
-	hostname, err := os.Hostname()
+	hostname, err := daneconfig.helloName()
 	if err != nil {
 		return nil, err
 	}
@@ -274,30 +437,39 @@ func DoSMTP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 	writer.WriteString(fmt.Sprintf("%s\r\n", ehloCommand))
 	writer.Flush()
 
-	for {
-		line, err = reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		line = strings.TrimRight(line, "\r\n")
-		transcript += fmt.Sprintf("recv: %s\n", line)
-		replycode, rest, responseDone, err = parseSMTPline(line)
+	replycode, lines, err := readSMTPReply(reader, &transcript)
+	if err != nil {
+		return nil, err
+	}
+	if replycode == 500 || replycode == 502 {
+		// EHLO not recognized: a legacy server without ESMTP. Say
+		// HELO, for a complete transcript, but STARTTLS can't be
+		// advertised without ESMTP.
+		heloCommand := fmt.Sprintf("HELO %s", hostname)
+		transcript += fmt.Sprintf("send: %s\n", heloCommand)
+		writer.WriteString(fmt.Sprintf("%s\r\n", heloCommand))
+		writer.Flush()
+		replycode, _, err = readSMTPReply(reader, &transcript)
 		if err != nil {
 			return nil, err
 		}
+		daneconfig.Transcript = transcript
 		if replycode != 250 {
-			return nil, fmt.Errorf("invalid reply code in EHLO response")
+			return nil, fmt.Errorf("invalid reply code (%d) in HELO response", replycode)
 		}
+		return nil, fmt.Errorf("SMTP server doesn't support ESMTP/STARTTLS: %w", ErrNoSTARTTLS)
+	}
+	if replycode != 250 {
+		return nil, fmt.Errorf("invalid reply code (%d) in EHLO response", replycode)
+	}
+	for _, rest = range lines {
 		if strings.Contains(rest, "STARTTLS") {
 			gotSTARTTLS = true
 		}
-		if responseDone {
-			break
-		}
 	}
 
 	if !gotSTARTTLS {
-		return nil, fmt.Errorf("SMTP STARTTLS support not detected")
+		return nil, fmt.Errorf("SMTP %w", ErrNoSTARTTLS)
 	}
 
 	// Send STARTTLS command and read success reply code
@@ -305,13 +477,9 @@ func DoSMTP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 	writer.WriteString("STARTTLS\r\n")
 	writer.Flush()
 
-	line, err = reader.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
-	line = strings.TrimRight(line, "\r\n")
-	transcript += fmt.Sprintf("recv: %s\n", line)
-	replycode, _, _, err = parseSMTPline(line)
+	// The reply may be multi-line: read all of it, so that none of it
+	// is left to be mistaken for the start of the TLS handshake.
+	replycode, _, err = readSMTPReply(reader, &transcript)
 	if err != nil {
 		return nil, err
 	}
@@ -320,7 +488,40 @@ func DoSMTP(tlsconfig *tls.Config, daneconfig *Config) (*tls.Conn, error) {
 	}
 
 	daneconfig.Transcript = transcript
-	return TLShandshake(conn, tlsconfig)
+	return preambleHandshake(conn, reader, tlsconfig, daneconfig)
+}
+
+//
+// readSMTPReply reads a possibly multi-line SMTP reply, adding it to the
+// transcript, and returns its reply code and the text of each line. All
+// the lines of the reply must have the same reply code.
+//
+func readSMTPReply(reader *bufio.Reader, transcript *string) (int, []string, error) {
+
+	var replycode int
+	var lines []string
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		*transcript += fmt.Sprintf("recv: %s\n", line)
+		code, rest, responseDone, err := parseSMTPline(line)
+		if err != nil {
+			return 0, nil, err
+		}
+		if lines != nil && code != replycode {
+			return 0, nil, fmt.Errorf("inconsistent reply codes in SMTP reply: %d, %d",
+				replycode, code)
+		}
+		replycode = code
+		lines = append(lines, rest)
+		if responseDone {
+			return replycode, lines, nil
+		}
+	}
 }
 
 //
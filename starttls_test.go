@@ -7,7 +7,12 @@ package dane
  */
 
 import (
+	"bufio"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -71,3 +76,345 @@ func TestDialStartTLS(t *testing.T) {
 		}) // end t.Run()
 	}
 }
+
+func TestParseSMTPline(t *testing.T) {
+	testCases := []struct {
+		line      string
+		replycode int
+		rest      string
+		done      bool
+		neederror bool
+	}{
+		{"220 mail.example.com ESMTP", 220, "mail.example.com ESMTP", true, false},
+		{"250-STARTTLS", 250, "STARTTLS", false, false},
+		{"250", 250, "", true, false},
+		{"250 ", 250, "", true, false},
+		{"22", 0, "", false, true},
+		{"", 0, "", false, true},
+		{"abc def", 0, "", false, true},
+	}
+	for _, tc := range testCases {
+		replycode, rest, done, err := parseSMTPline(tc.line)
+		if tc.neederror {
+			if err == nil {
+				t.Fatalf("parseSMTPline(%q): expected error", tc.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseSMTPline(%q): %s", tc.line, err)
+		}
+		if replycode != tc.replycode || rest != tc.rest || done != tc.done {
+			t.Fatalf("parseSMTPline(%q) = %d %q %v, want %d %q %v", tc.line,
+				replycode, rest, done, tc.replycode, tc.rest, tc.done)
+		}
+	}
+}
+
+func TestMaxPreambleOffline(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Endless multi-line greeting
+		for {
+			if _, err := conn.Write([]byte("220-mail.example.com ESMTP\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	daneconfig := NewConfig("mail.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("smtp")
+	daneconfig.MaxPreamble = 1024
+	_, err = DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "too much data") {
+		t.Fatalf("DialStartTLS: expected preamble size error, got: %v", err)
+	}
+}
+
+func TestXMLEscapeOffline(t *testing.T) {
+
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"example.com", "example.com"},
+		{"ex'ample.com", "ex&#39;ample.com"},
+		{"<a>&b", "&lt;a&gt;&amp;b"},
+		{"nul\x00name", "nul�name"},
+	} {
+		if got := xmlEscape(tc.in); got != tc.out {
+			t.Fatalf("xmlEscape(%q): got %q, expected %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+// startTestScriptServer starts a scripted line based protocol server (such
+// as SMTP or IMAP) on the loopback address, that sends the first of the
+// given replies as its greeting, and each of the following replies in
+// response to a command. It returns the server address, and a channel on
+// which the received commands are sent.
+func startTestScriptServer(t *testing.T, replies ...string) (*net.TCPAddr, <-chan string) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	return ln.Addr().(*net.TCPAddr), serveTestScript(t, ln, replies)
+}
+
+// serveTestScript serves the scripted replies, as for startTestScriptServer,
+// on the first connection accepted by the given listener, and returns the
+// channel of received commands.
+func serveTestScript(t *testing.T, ln net.Listener, replies []string) <-chan string {
+
+	t.Cleanup(func() { ln.Close() })
+
+	commands := make(chan string, len(replies))
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for i, reply := range replies {
+			if i > 0 {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				commands <- strings.TrimRight(line, "\r\n")
+			}
+			conn.Write([]byte(reply))
+		}
+		close(commands)
+	}()
+	return commands
+}
+
+func TestHelloNameOffline(t *testing.T) {
+
+	addr, commands := startTestScriptServer(t,
+		"220 mail.example.com ESMTP\r\n",
+		"250 mail.example.com\r\n")
+
+	daneconfig := NewConfig("mail.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("smtp")
+	daneconfig.SetHelloName("client.example.net")
+	_, err := DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS support not detected") {
+		t.Fatalf("DialStartTLS: expected no STARTTLS error, got: %v", err)
+	}
+	if line := <-commands; line != "EHLO client.example.net" {
+		t.Fatalf("DialStartTLS: unexpected EHLO command %q", line)
+	}
+}
+
+func TestHELOFallbackOffline(t *testing.T) {
+
+	addr, commands := startTestScriptServer(t,
+		"220 mail.example.com SMTP\r\n",
+		"502 Command not implemented\r\n",
+		"250 mail.example.com\r\n")
+
+	daneconfig := NewConfig("mail.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("smtp")
+	daneconfig.SetHelloName("client.example.net")
+	_, err := DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "doesn't support ESMTP/STARTTLS") {
+		t.Fatalf("DialStartTLS: expected no ESMTP error, got: %v", err)
+	}
+	var sent []string
+	for line := range commands {
+		sent = append(sent, line)
+	}
+	if strings.Join(sent, ",") != "EHLO client.example.net,HELO client.example.net" {
+		t.Fatalf("DialStartTLS: unexpected commands %q", sent)
+	}
+	if !strings.Contains(daneconfig.Transcript, "send: HELO client.example.net\n") {
+		t.Fatalf("DialStartTLS: HELO missing from transcript:\n%s", daneconfig.Transcript)
+	}
+}
+
+func TestSTARTTLSMultilineReplyOffline(t *testing.T) {
+
+	cert, key := makeTestCert(t, "mail.example.com", false, nil, nil)
+	data, _ := ComputeTLSA(1, 1, cert)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("220 mail.example.com ESMTP\r\n"))
+		reader.ReadString('\n')
+		conn.Write([]byte("250-mail.example.com\r\n250 STARTTLS\r\n"))
+		reader.ReadString('\n')
+		conn.Write([]byte("220-Ready to start TLS\r\n220 Go ahead\r\n"))
+		tlsconn := tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{cert.Raw},
+				PrivateKey:  key,
+			}},
+		})
+		tlsconn.Handshake()
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	daneconfig := NewConfig("mail.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("smtp")
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: data}},
+	})
+	conn, err := DialStartTLS(daneconfig)
+	if err != nil {
+		t.Fatalf("DialStartTLS: %s\n%s", err, daneconfig.Transcript)
+	}
+	conn.Close()
+	if !daneconfig.Okdane {
+		t.Fatalf("DialStartTLS: DANE authentication failed")
+	}
+	if !strings.Contains(daneconfig.Transcript, "recv: 220 Go ahead\n") {
+		t.Fatalf("DialStartTLS: STARTTLS reply missing from transcript:\n%s",
+			daneconfig.Transcript)
+	}
+}
+
+func TestIMAPCapabilitiesOffline(t *testing.T) {
+
+	for _, tc := range []struct {
+		line     string
+		starttls bool
+	}{
+		{"* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready", true},
+		{"* OK [capability imap4rev1 starttls] ready", true},
+		{"* OK IMAP4rev1 server ready, STARTTLS soon", false},
+		{"* CAPABILITY IMAP4rev1 STARTTLS AUTH=PLAIN", true},
+		{"* CAPABILITY IMAP4rev1 AUTH=PLAIN", false},
+		{"a1 OK [CAPABILITY IMAP4rev1 STARTTLS] done", true},
+	} {
+		if got := imapSTARTTLS(tc.line); got != tc.starttls {
+			t.Fatalf("imapSTARTTLS(%q) = %v, want %v", tc.line, got, tc.starttls)
+		}
+	}
+}
+
+func TestDoIMAPOffline(t *testing.T) {
+
+	// Capabilities in the greeting: no CAPABILITY command needed.
+	addr, commands := startTestScriptServer(t,
+		"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n",
+		"* BYE not today\r\na1 NO STARTTLS refused\r\n")
+	daneconfig := NewConfig("imap.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("imap")
+	_, err := DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS failed to negotiate") {
+		t.Fatalf("DialStartTLS: expected STARTTLS failure, got: %v", err)
+	}
+	if line := <-commands; line != "a1 STARTTLS" {
+		t.Fatalf("DialStartTLS: unexpected command %q", line)
+	}
+
+	// Capabilities from an untagged CAPABILITY response.
+	addr, commands = startTestScriptServer(t,
+		"* OK ready\r\n",
+		"* CAPABILITY IMAP4rev1 STARTTLS\r\na1 OK CAPABILITY completed\r\n",
+		"a2 BAD STARTTLS refused\r\n")
+	daneconfig = NewConfig("imap.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("imap")
+	_, err = DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS failed to negotiate") {
+		t.Fatalf("DialStartTLS: expected STARTTLS failure, got: %v", err)
+	}
+	var sent []string
+	for line := range commands {
+		sent = append(sent, line)
+	}
+	if strings.Join(sent, ",") != "a1 CAPABILITY,a2 STARTTLS" {
+		t.Fatalf("DialStartTLS: unexpected commands %q", sent)
+	}
+
+	// A PREAUTH greeting must not be followed by STARTTLS.
+	addr, commands = startTestScriptServer(t,
+		"* PREAUTH [CAPABILITY IMAP4rev1 STARTTLS] logged in\r\n")
+	daneconfig = NewConfig("imap.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("imap")
+	_, err = DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "PREAUTH") {
+		t.Fatalf("DialStartTLS: expected PREAUTH error, got: %v", err)
+	}
+	sent = nil
+	for line := range commands {
+		sent = append(sent, line)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("DialStartTLS: unexpected commands after PREAUTH %q", sent)
+	}
+}
+
+func TestSTARTTLSInjectionOffline(t *testing.T) {
+
+	addr, _ := startTestScriptServer(t,
+		"220 mail.example.com ESMTP\r\n",
+		"250-mail.example.com\r\n250 STARTTLS\r\n",
+		"220 Go ahead\r\n250 injected\r\n")
+
+	daneconfig := NewConfig("mail.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("smtp")
+	_, err := DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "possible injection") {
+		t.Fatalf("DialStartTLS: expected injection error, got: %v", err)
+	}
+
+	addr, _ = startTestScriptServer(t,
+		"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n",
+		"a1 OK Begin TLS\r\n* injected\r\n")
+
+	daneconfig = NewConfig("imap.example.com", addr.IP, addr.Port)
+	daneconfig.SetAppName("imap")
+	_, err = DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "possible injection") {
+		t.Fatalf("DialStartTLS: expected injection error, got: %v", err)
+	}
+}
+
+func TestDialTargetUnixOffline(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %s", err)
+	}
+	commands := serveTestScript(t, ln, []string{
+		"220 mail.example.com ESMTP\r\n",
+		"250 mail.example.com\r\n"})
+
+	daneconfig := NewConfig("mail.example.com", "192.0.2.1", 25)
+	daneconfig.SetAppName("smtp")
+	daneconfig.SetHelloName("client.example.net")
+	daneconfig.SetDialTarget("unix", path)
+	_, err = DialStartTLS(daneconfig)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS support not detected") {
+		t.Fatalf("DialStartTLS: expected no STARTTLS error, got: %v", err)
+	}
+	if line := <-commands; line != "EHLO client.example.net" {
+		t.Fatalf("DialStartTLS: unexpected EHLO command %q", line)
+	}
+}
@@ -0,0 +1,129 @@
+package dane
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+//
+// SVCBinfo contains the service binding information from a single
+// HTTPS (or SVCB) resource record that is relevant to DANE: the target
+// name, alternative port, and ALPN protocols. A Priority of 0 indicates
+// an AliasMode record, which has only a target name. A Port of 0 means
+// that the record did not specify a port.
+//
+type SVCBinfo struct {
+	Priority  uint16
+	Target    string
+	Port      int
+	ALPN      []string
+	NoDefault bool
+}
+
+//
+// svcbInfo extracts the service binding information from an SVCB record.
+//
+func svcbInfo(rr *dns.SVCB) *SVCBinfo {
+
+	s := &SVCBinfo{Priority: rr.Priority, Target: rr.Target}
+	for _, kv := range rr.Value {
+		switch v := kv.(type) {
+		case *dns.SVCBAlpn:
+			s.ALPN = append(s.ALPN, v.Alpn...)
+		case *dns.SVCBPort:
+			s.Port = int(v.Port)
+		case *dns.SVCBNoDefaultAlpn:
+			s.NoDefault = true
+		}
+	}
+	return s
+}
+
+//
+// GetSVCB returns the service binding information in the HTTPS records
+// for the given hostname, ordered by priority (AliasMode records first).
+// As with GetTLSA, the response must be authenticated: if it is not, or
+// there are no HTTPS records, no information (nil) is returned.
+//
+func GetSVCB(resolver *Resolver, hostname string) ([]*SVCBinfo, error) {
+
+	var svcb []*SVCBinfo
+
+	q := NewQuery(hostname, dns.TypeHTTPS, dns.ClassINET)
+	response, err := sendQuery(q, resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	if !responseOK(response) {
+		return nil, fmt.Errorf("bad response code to HTTPS query %s: %s", hostname,
+			dns.RcodeToString[response.MsgHdr.Rcode])
+	}
+
+	if !response.MsgHdr.AuthenticatedData {
+		return nil, nil
+	}
+
+	for _, rr := range response.Answer {
+		switch rr := rr.(type) {
+		case *dns.HTTPS:
+			svcb = append(svcb, svcbInfo(&rr.SVCB))
+		case *dns.SVCB:
+			svcb = append(svcb, svcbInfo(rr))
+		}
+	}
+	sort.SliceStable(svcb, func(i, j int) bool {
+		return svcb[i].Priority < svcb[j].Priority
+	})
+	return svcb, nil
+}
+
+//
+// selectSVCB returns the highest priority ServiceMode record that applies
+// to the given hostname itself (a target name of "." or the hostname),
+// since DANE authentication here is of the origin hostname. Returns nil if
+// there is no such record.
+//
+func selectSVCB(svcb []*SVCBinfo, hostname string) *SVCBinfo {
+
+	for _, s := range svcb {
+		if s.Priority == 0 {
+			continue
+		}
+		if s.Target == "." || strings.EqualFold(dns.Fqdn(s.Target), dns.Fqdn(hostname)) {
+			return s
+		}
+	}
+	return nil
+}
+
+//
+// tcpALPN returns the ALPN protocols of the record that can be used over
+// TLS on TCP, i.e. excluding the HTTP/3 (QUIC) protocols.
+//
+func (s *SVCBinfo) tcpALPN() []string {
+
+	var alpn []string
+
+	for _, proto := range s.ALPN {
+		if !strings.HasPrefix(proto, "h3") {
+			alpn = append(alpn, proto)
+		}
+	}
+	if len(s.ALPN) > 0 && !s.NoDefault {
+		// "http/1.1" is the default ALPN for HTTPS records.
+		found := false
+		for _, proto := range alpn {
+			if proto == "http/1.1" {
+				found = true
+			}
+		}
+		if !found {
+			alpn = append(alpn, "http/1.1")
+		}
+	}
+	return alpn
+}
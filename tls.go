@@ -1,12 +1,53 @@
 package dane
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"net"
+	"strings"
+	"time"
 )
 
+// Timings holds the time taken by each stage of establishing a DANE
+// authenticated connection. Stages that were not performed are zero.
+type Timings struct {
+	TLSALookup     time.Duration // TLSA record lookup
+	AddressLookup  time.Duration // address record lookup
+	TCPConnect     time.Duration // TCP connection setup
+	TLSHandshake   time.Duration // TLS handshake (includes authentication)
+	Authentication time.Duration // DANE and PKIX authentication
+}
+
+// CertValidity holds the validity period of a certificate, and whether
+// it was time valid when checked.
+type CertValidity struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+	Valid     bool
+}
+
+// String returns a string representation of CertValidity.
+func (v *CertValidity) String() string {
+	status := "valid"
+	if !v.Valid {
+		status = "NOT valid"
+	}
+	return fmt.Sprintf("%s (%s to %s)", status,
+		v.NotBefore.Format(time.RFC3339), v.NotAfter.Format(time.RFC3339))
+}
+
+// getCertValidity returns the validity period of the given certificate,
+// and whether it is time valid at the given time.
+func getCertValidity(cert *x509.Certificate, now time.Time) *CertValidity {
+	return &CertValidity{
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Valid:     !now.Before(cert.NotBefore) && !now.After(cert.NotAfter),
+	}
+}
+
 // verifyChain performs certificate chain validation of the given chain (list)
 // of certificates. On success it returns a list of verified chains. On failure,
 // it sets error to non-nil with an embedded error string. If "root" is true,
@@ -43,6 +84,66 @@ func verifyChain(certs []*x509.Certificate, config *tls.Config,
 	return verifiedChains, err
 }
 
+// linkedChain checks that each certificate in the given chain is signed
+// by the next one, and that the issuer and subject names link up. Every
+// certificate that issues another must be a CA (with valid basic
+// constraints), within its path length limit, and permitted to sign
+// certificates (if it has a key usage extension), and every certificate
+// but the last (the trust anchor candidate) must be within its validity
+// period. Unlike verifyChain, it does not check name constraints or
+// extended key usage, and doesn't check the validity period of the trust
+// anchor, which are not required for DANE-TA authentication. Returns the
+// chain on success.
+func linkedChain(certs []*x509.Certificate) ([]*x509.Certificate, error) {
+
+	now := time.Now()
+	for i := 0; i < len(certs)-1; i++ {
+		child, parent := certs[i], certs[i+1]
+		if !bytes.Equal(child.RawIssuer, parent.RawSubject) {
+			return nil, fmt.Errorf("certificate at depth %d not issued by next certificate", i)
+		}
+		err := parent.CheckSignature(child.SignatureAlgorithm,
+			child.RawTBSCertificate, child.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("certificate at depth %d: %s", i, err.Error())
+		}
+		if !parent.BasicConstraintsValid || !parent.IsCA {
+			return nil, fmt.Errorf("certificate at depth %d is not a CA", i+1)
+		}
+		if parent.MaxPathLen > 0 || (parent.MaxPathLen == 0 && parent.MaxPathLenZero) {
+			// The number of intermediate CA certificates below the parent.
+			if i > parent.MaxPathLen {
+				return nil, fmt.Errorf("certificate at depth %d exceeds path length limit", i+1)
+			}
+		}
+		if parent.KeyUsage != 0 && parent.KeyUsage&x509.KeyUsageCertSign == 0 {
+			return nil, fmt.Errorf("certificate at depth %d not permitted to sign certificates", i+1)
+		}
+		if now.Before(child.NotBefore) || now.After(child.NotAfter) {
+			return nil, fmt.Errorf("certificate at depth %d is not within its validity period", i)
+		}
+	}
+	return certs, nil
+}
+
+// verifyPinnedSPKI checks the SHA-256 digest of the given certificate's
+// SubjectPublicKeyInfo against the Config's PinnedSPKI hashes, and sets
+// Okpin if one of them matches.
+func verifyPinnedSPKI(cert *x509.Certificate, daneconfig *Config) error {
+
+	digest, err := ComputeTLSA(1, 1, cert)
+	if err != nil {
+		return err
+	}
+	for _, pin := range daneconfig.PinnedSPKI {
+		if strings.EqualFold(pin, digest) {
+			daneconfig.Okpin = true
+			return nil
+		}
+	}
+	return fmt.Errorf("server public key does not match any pinned SPKI hash")
+}
+
 // verifyServer is a custom callback function configure in the tls
 // Config data structure that performs DANE and PKIX authentication of
 // the server certificate as appropriate.
@@ -53,6 +154,20 @@ func verifyServer(rawCerts [][]byte,
 	var err error
 	certs := make([]*x509.Certificate, len(rawCerts))
 
+	start := time.Now()
+	defer func() {
+		daneconfig.Timings.Authentication = time.Since(start)
+	}()
+
+	// Clear the results of any earlier verification with this Config,
+	// so that they can't be mistaken for the results of this one.
+	daneconfig.Okdane = false
+	daneconfig.Okpkix = false
+	daneconfig.Okpin = false
+	daneconfig.DiagError = nil
+	daneconfig.PKIXChains = nil
+	daneconfig.DANEChains = nil
+
 	for i, asn1Data := range rawCerts {
 		cert, err := x509.ParseCertificate(asn1Data)
 		if err != nil {
@@ -62,21 +177,46 @@ func verifyServer(rawCerts [][]byte,
 	}
 
 	daneconfig.PeerChain = certs
-	daneconfig.PKIXChains, err = verifyChain(certs, tlsconfig, true)
-	if err == nil {
-		daneconfig.Okpkix = true
+	daneconfig.LeafSANs = certs[0].DNSNames
+	if daneconfig.Expiry {
+		// Per RFC 7671, DANE-EE authentication does not depend on the
+		// certificate validity period, but it's useful to report.
+		daneconfig.EEValidity = getCertValidity(certs[0], time.Now())
+	}
+	if daneconfig.needPKIX() {
+		daneconfig.PKIXChains, err = verifyChain(certs, tlsconfig, true)
+		if err == nil {
+			daneconfig.Okpkix = true
+		}
+	}
+
+	if len(daneconfig.PinnedSPKI) > 0 {
+		// Pinning mode: the public key pin alone authenticates the
+		// server, independent of TLSA records and PKIX.
+		err = verifyPinnedSPKI(certs[0], daneconfig)
+		if err == nil {
+			err = extraVerify(certs, daneconfig)
+		}
+		if daneconfig.deferFailure() {
+			daneconfig.DiagError = err
+			return nil
+		}
+		return err
 	}
 
 	if !(daneconfig.DANE && daneconfig.TLSA != nil) {
 		if !daneconfig.Okpkix {
-			if daneconfig.DiagMode {
+			if daneconfig.deferFailure() {
 				daneconfig.DiagError = err
 				return nil
 			}
 			return err
 		}
-		err = certs[0].VerifyHostname(tlsconfig.ServerName)
-		if daneconfig.DiagMode {
+		err = daneconfig.verifyName(certs[0])
+		if err == nil {
+			err = extraVerify(certs, daneconfig)
+		}
+		if daneconfig.deferFailure() {
 			daneconfig.DiagError = err
 			return nil
 		}
@@ -87,10 +227,19 @@ func verifyServer(rawCerts [][]byte,
 	// and assign the chain to DANEChains.
 
 	daneChains, err := verifyChain(certs, tlsconfig, false)
+	if err != nil {
+		// Go's chain builder can reject chains that DANE permits (e.g.
+		// an expired trust anchor, or extended key usage restrictions).
+		// If the presented chain links up as a valid CA chain, use it as
+		// the DANE chain instead.
+		if chain, lerr := linkedChain(certs); lerr == nil {
+			daneChains, err = [][]*x509.Certificate{chain}, nil
+		}
+	}
 	if err != nil {
 		if daneconfig.PKIX && daneconfig.Okpkix {
 			daneconfig.DiagError = fmt.Errorf("DANE TLS error: cert chain: %s", err.Error())
-			if daneconfig.DiagMode {
+			if daneconfig.deferFailure() {
 				return nil
 			} else {
 				return daneconfig.DiagError
@@ -102,38 +251,151 @@ func verifyServer(rawCerts [][]byte,
 	AuthenticateAll(daneconfig)
 	if !daneconfig.Okdane {
 		daneconfig.DiagError = fmt.Errorf("DANE TLS authentication failed")
-		if daneconfig.DiagMode {
+		if daneconfig.deferFailure() {
 			return nil
 		} else {
 			return daneconfig.DiagError
 		}
 	}
 
+	if err = extraVerify(certs, daneconfig); err != nil {
+		daneconfig.DiagError = err
+		if daneconfig.deferFailure() {
+			return nil
+		}
+		return err
+	}
 	return nil
 }
 
+// extraVerify runs the Config's ExtraVerify callback, if any, on the
+// server's certificate chain, once it has otherwise been authenticated.
+func extraVerify(certs []*x509.Certificate, daneconfig *Config) error {
+	if daneconfig.ExtraVerify == nil {
+		return nil
+	}
+	if err := daneconfig.ExtraVerify(certs, daneconfig); err != nil {
+		return fmt.Errorf("extra verification failed: %w", err)
+	}
+	return nil
+}
+
+// AuthenticateConnState performs DANE (and PKIX) authentication of the
+// server certificate chain in the given TLS connection state, such as
+// one from a connection established by another library, with the given
+// TLSA RRset information (which may be nil, for PKIX only). No network
+// connection is made by this package. The authentication results are
+// recorded in the given dane Config as they would be by DialTLS, including
+// the status of each record in the Config's copy of the TLSA information.
+// Returns true if the server was authenticated.
+func AuthenticateConnState(state *tls.ConnectionState, tlsa *TLSAinfo, daneconfig *Config) bool {
+
+	daneconfig.ResetResults()
+	daneconfig.TLSA = nil
+	daneconfig.SetTLSA(tlsa)
+
+	if state == nil || len(state.PeerCertificates) == 0 {
+		daneconfig.DiagError = fmt.Errorf("no server certificates in connection state")
+		return false
+	}
+	rawCerts := make([][]byte, len(state.PeerCertificates))
+	for i, cert := range state.PeerCertificates {
+		rawCerts[i] = cert.Raw
+	}
+
+	config := GetTLSconfig(daneconfig)
+	err := verifyServer(rawCerts, state.VerifiedChains, config, daneconfig)
+	recordSCTs(*state, daneconfig)
+	if err == nil {
+		err = checkCT(*state, daneconfig)
+	}
+	if err != nil {
+		daneconfig.DiagError = err
+		return false
+	}
+	return daneconfig.DiagError == nil
+}
+
+// AuthenticateChain is like AuthenticateConnState, but authenticates the
+// given server certificate chain (server certificate first), such as one
+// from ParseCertChainPEM, for offline analysis with saved certificates and
+// TLSA records. The server name to check is the Config's Server name.
+func AuthenticateChain(chain []*x509.Certificate, tlsa *TLSAinfo, daneconfig *Config) bool {
+	return AuthenticateConnState(&tls.ConnectionState{PeerCertificates: chain},
+		tlsa, daneconfig)
+}
+
+// AuthenticateSNI is like AuthenticateConnState, but looks up the TLSA
+// records, using the given resolver, for the server name actually sent in
+// the TLS handshake (the SNI in the connection state) and the given port,
+// rather than for a name decided before connecting. This is useful when
+// the connection target is determined dynamically, for example behind a
+// fronting service. The Config's Server name and port are set to the
+// negotiated name and the given port. If there are no TLSA records, the
+// server is authenticated with PKIX, unless PKIX fallback is disabled in
+// the Config, in which case a DANERequiredError is returned. Returns
+// whether the server was authenticated, and an error if the TLSA records
+// could not be obtained.
+func AuthenticateSNI(resolver *Resolver, state *tls.ConnectionState, port int,
+	daneconfig *Config) (bool, error) {
+
+	if state == nil || state.ServerName == "" {
+		return false, fmt.Errorf("no server name in connection state")
+	}
+	name := state.ServerName
+	if daneconfig.Server == nil {
+		daneconfig.Server = NewServer(name, nil, port)
+	}
+	daneconfig.Server.Name = name
+	daneconfig.Server.Port = port
+
+	tlsa, err := GetTLSA(resolver, name, port)
+	if err != nil {
+		return false, err
+	}
+	if tlsa == nil && !daneconfig.PKIX {
+		return false, &DANERequiredError{Hostname: name, Err: ErrNoTLSA}
+	}
+	return AuthenticateConnState(state, tlsa, daneconfig), nil
+}
+
 // GetTLSconfig takes a dane Config structure, and returns a tls Config
-// initialized with the ServerName, other specified TLS parameters, and a
-// custom server certificate verification callback that performs DANE
-// authentication.
+// initialized with the ServerName (the SNI value if set, otherwise the
+// server name, or none if NoSNI is set), other specified TLS parameters,
+// and a custom server certificate verification callback that performs DANE
+// authentication. Session resumption is disabled unless the Config's
+// Resumption is set; if it is, resumed sessions are authenticated
+// against the Config's TLSA records too.
 func GetTLSconfig(daneconfig *Config) *tls.Config {
 
 	config := new(tls.Config)
 	config.ServerName = daneconfig.Server.Name
+	if daneconfig.SNI != "" {
+		config.ServerName = daneconfig.SNI
+	}
+	if daneconfig.NoSNI {
+		config.ServerName = ""
+	}
 	config.InsecureSkipVerify = true
 	if daneconfig.NoVerify {
 		return config
 	}
+	// Session resumption is disabled unless enabled in the Config, so
+	// that every connection is freshly authenticated with the current
+	// DNS data. Resumption also requires the caller to set the returned
+	// config's ClientSessionCache.
+	config.SessionTicketsDisabled = !daneconfig.Resumption
 	if daneconfig.TLSversion != 0 {
 		config.MinVersion = daneconfig.TLSversion
 		config.MaxVersion = daneconfig.TLSversion
 	}
 	if daneconfig.PKIXRootCA != nil {
 		roots := x509.NewCertPool()
-		_ = roots.AppendCertsFromPEM(daneconfig.PKIXRootCA)
-		// Should emit log warning on failure to parse root CA data here.
-		// Ideally we should return an error but that requires a function
-		// signature change.
+		if !roots.AppendCertsFromPEM(daneconfig.PKIXRootCA) {
+			// Ideally we should return an error but that requires a
+			// function signature change.
+			logf(daneconfig.Logger, "failed to parse PKIX root CA data")
+		}
 		config.RootCAs = roots
 	}
 	if daneconfig.ALPN != nil {
@@ -143,6 +405,54 @@ func GetTLSconfig(daneconfig *Config) *tls.Config {
 		verifiedChains [][]*x509.Certificate) error {
 		return verifyServer(rawCerts, verifiedChains, config, daneconfig)
 	}
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if cs.DidResume {
+			// VerifyPeerCertificate is not called for a resumed
+			// session, so authenticate the session's certificates
+			// against the current TLSA records here.
+			if err := verifyResumed(cs, config, daneconfig); err != nil {
+				return err
+			}
+		}
+		recordSCTs(cs, daneconfig)
+		return checkCT(cs, daneconfig)
+	}
+	return config
+}
+
+// verifyResumed performs DANE (and PKIX) authentication of the server
+// certificates of a resumed TLS session, as verifyServer does during a
+// full handshake.
+func verifyResumed(cs tls.ConnectionState, config *tls.Config, daneconfig *Config) error {
+
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no server certificates in resumed session")
+	}
+	rawCerts := make([][]byte, len(cs.PeerCertificates))
+	for i, cert := range cs.PeerCertificates {
+		rawCerts[i] = cert.Raw
+	}
+	return verifyServer(rawCerts, cs.VerifiedChains, config, daneconfig)
+}
+
+// GetQUICTLSconfig is like GetTLSconfig, but returns a TLS config structure
+// suitable for a QUIC handshake, performed by a QUIC library that accepts
+// a *tls.Config. QUIC requires TLS 1.3, and an ALPN protocol; if the Config
+// has no ALPN strings set, "h3" (HTTP/3) is used. The DANE verification
+// callbacks are the same as for TLS over TCP, so the authentication results
+// are recorded in the Config in the same way. The TLSA records for a QUIC
+// service are published under the UDP transport label, and can be looked
+// up with GetTLSATransport(resolver, hostname, port, "udp").
+func GetQUICTLSconfig(daneconfig *Config) *tls.Config {
+
+	config := GetTLSconfig(daneconfig)
+	config.MinVersion = tls.VersionTLS13
+	if config.MaxVersion != 0 && config.MaxVersion < tls.VersionTLS13 {
+		config.MaxVersion = tls.VersionTLS13
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h3"}
+	}
 	return config
 }
 
@@ -156,23 +466,106 @@ func TLShandshake(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
 	return tlsconn, err
 }
 
+// handshake negotiates TLS on the connection, as TLShandshake does, with
+// a deadline of the Config's handshake timeout, so that a server that
+// accepts the connection but stalls the handshake can't hang the client.
+// The deadline is cleared after a successful handshake.
+func (c *Config) handshake(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+
+	if timeout := c.handshakeTimeout(); timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	tlsconn, err := TLShandshake(conn, config)
+	if err != nil {
+		return tlsconn, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsconn, nil
+}
+
 // DialTLS takes a pointer to an initialized dane Config structure,
 // establishes and returns a TLS connection. The error return parameter
 // is nil on success, and appropriately populated if not.
 //
 // DialTLS obtains a TLS config structure initialized with Dane
-// verification callbacks, and connects to the server network address
-// defined in Config using tls.DialWithDialer().
+// verification callbacks, connects to the server network address defined
+// in Config, and performs the TLS handshake. If the Config has ConnOnFail
+// set and authentication fails, both the connection and an error are
+// returned. The dialer uses the TimeoutTCP, KeepAlive, LocalAddr,
+// DialControl, Network and DialAddress settings of the Config, and the
+// handshake must complete within its TimeoutTLS (or TimeoutTCP, if not
+// set). The connect and handshake times are recorded in the Config's
+// Timings.
 func DialTLS(daneconfig *Config) (*tls.Conn, error) {
 
-	var err error
-	var conn *tls.Conn
-
 	config := GetTLSconfig(daneconfig)
-	dialer := getDialer(daneconfig.TimeoutTCP)
-	conn, err = tls.DialWithDialer(dialer, "tcp",
-		daneconfig.Server.Address(), config)
-	return conn, err
+	dialer := getDialer(daneconfig)
+	network, address := daneconfig.dialTarget()
+
+	start := time.Now()
+	rawconn, err := dialer.Dial(network, address)
+	daneconfig.Timings.TCPConnect = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	conn, err := daneconfig.handshake(rawconn, config)
+	daneconfig.Timings.TLSHandshake = time.Since(start)
+	if err != nil {
+		rawconn.Close()
+		return nil, err
+	}
+	return daneconfig.failedConn(conn)
+}
+
+// DaneConn is a TLS connection established with a dane Config, with
+// accessors for the authentication results recorded in the Config.
+type DaneConn struct {
+	*tls.Conn
+	config *Config
+}
+
+// Config returns the dane Config the connection was established with.
+func (c *DaneConn) Config() *Config {
+	return c.config
+}
+
+// Okdane returns whether the server was DANE authenticated.
+func (c *DaneConn) Okdane() bool {
+	return c.config.Okdane
+}
+
+// Okpkix returns whether the server was PKIX authenticated.
+func (c *DaneConn) Okpkix() bool {
+	return c.config.Okpkix
+}
+
+// TLSAResults returns the TLSA records of the server, with the results
+// of matching them against the server's certificate chain, or nil if the
+// server has no (authenticated) TLSA records.
+func (c *DaneConn) TLSAResults() []*TLSArdata {
+	if c.config.TLSA == nil {
+		return nil
+	}
+	return c.config.TLSA.Rdata
+}
+
+// MatchedTLSA returns the TLSA record that authenticated the server, or
+// nil if none did.
+func (c *DaneConn) MatchedTLSA() *TLSArdata {
+	return c.config.MatchedTLSA
+}
+
+// DialTLS2 is like DialTLS, but returns the connection as a DaneConn,
+// with the authentication results attached.
+func DialTLS2(daneconfig *Config) (*DaneConn, error) {
+
+	conn, err := DialTLS(daneconfig)
+	if conn == nil {
+		return nil, err
+	}
+	return &DaneConn{Conn: conn, config: daneconfig}, err
 }
 
 // DialStartTLS takes a pointer to an initialized dane Config structure,
@@ -191,5 +584,108 @@ func DialStartTLS(daneconfig *Config) (*tls.Conn, error) {
 
 	config := GetTLSconfig(daneconfig)
 	conn, err = StartTLS(config, daneconfig)
-	return conn, err
+	if err != nil {
+		return conn, err
+	}
+	return daneconfig.failedConn(conn)
+}
+
+// DialTLSResolve is like DialTLS (or DialStartTLS if the application name
+// requires STARTTLS), but only requires the server name and port to be set in the Config.
+// It looks up the TLSA records (unless already present in the Config) and
+// the server addresses using the Config's Resolver, or the system default
+// resolver if none is set, and then connects to each address in turn until
+// one succeeds. On return, the Config's Server holds the address of the
+// last server tried. If ConnOnFail is set and no address authenticates, the
+// first connection that failed authentication is returned with its error,
+// and the Config holds its address and results.
+func DialTLSResolve(daneconfig *Config) (*tls.Conn, error) {
+
+	var err error
+	var conn *tls.Conn
+
+	resolver := daneconfig.Resolver
+	if resolver == nil {
+		resolver, err = GetResolver("")
+		if err != nil {
+			return nil, fmt.Errorf("error obtaining resolver address: %s", err.Error())
+		}
+	}
+
+	server := daneconfig.Server
+	if daneconfig.TLSA == nil && daneconfig.DANE {
+		start := time.Now()
+		tlsa, err := GetTLSA(resolver, server.Name, server.Port)
+		daneconfig.Timings.TLSALookup = time.Since(start)
+		if err != nil {
+			return nil, err
+		}
+		daneconfig.SetTLSA(tlsa)
+	}
+	if daneconfig.TLSA == nil && !daneconfig.PKIX {
+		return nil, &DANERequiredError{Hostname: server.Name, Err: ErrNoTLSA}
+	}
+
+	needSecure := (daneconfig.TLSA != nil)
+	start := time.Now()
+	iplist, err := GetAddresses(resolver, server.Name, needSecure)
+	daneconfig.Timings.AddressLookup = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	if len(iplist) == 0 {
+		return nil, fmt.Errorf("%s: no addresses found", server.Name)
+	}
+
+	var failed *tls.Conn
+	var failedErr error
+	var failedConfig Config
+	var failedIP net.IP
+	var failedRdata []TLSArdata
+
+	connerr := &ConnectError{Hostname: server.Name}
+	for _, ip := range iplist {
+		server.Ipaddr = ip
+		daneconfig.resetAttempt()
+		if daneconfig.needsSTARTTLS() {
+			conn, err = DialStartTLS(daneconfig)
+		} else {
+			conn, err = DialTLS(daneconfig)
+		}
+		if err == nil {
+			if failed != nil {
+				failed.Close()
+			}
+			return conn, nil
+		}
+		logf(daneconfig.Logger, "Connection failed to %s: %s",
+			server.Address(), err.Error())
+		connerr.add(server.Address(), err)
+		if conn != nil {
+			// The handshake completed but authentication failed
+			// (with ConnOnFail set): keep the first such connection,
+			// and its results, to return for inspection if no other
+			// address authenticates.
+			if failed != nil {
+				conn.Close()
+				continue
+			}
+			failed, failedErr = conn, err
+			failedConfig, failedIP = *daneconfig, ip
+			if daneconfig.TLSA != nil {
+				for _, tr := range daneconfig.TLSA.Rdata {
+					failedRdata = append(failedRdata, *tr)
+				}
+			}
+		}
+	}
+	if failed != nil {
+		*daneconfig = failedConfig
+		server.Ipaddr = failedIP
+		for i, tr := range failedRdata {
+			*daneconfig.TLSA.Rdata[i] = tr
+		}
+		return failed, failedErr
+	}
+	return nil, connerr
 }
@@ -7,9 +7,30 @@ package dane
  */
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var resolver1, resolver2 *Resolver
@@ -154,3 +175,1201 @@ func TestALPN(t *testing.T) {
 	}
 
 }
+
+func TestGetTLSconfigSNI(t *testing.T) {
+
+	daneconfig := NewConfig("mx.example.com", "192.0.2.1", 25)
+	config := GetTLSconfig(daneconfig)
+	if config.ServerName != "mx.example.com" {
+		t.Fatalf("ServerName %s, expected mx.example.com", config.ServerName)
+	}
+
+	daneconfig.SetSNI("sni.example.net")
+	config = GetTLSconfig(daneconfig)
+	if config.ServerName != "sni.example.net" {
+		t.Fatalf("ServerName %s, expected sni.example.net", config.ServerName)
+	}
+	if daneconfig.referenceName() != "mx.example.com" {
+		t.Fatalf("reference name %s, expected mx.example.com",
+			daneconfig.referenceName())
+	}
+}
+
+func TestGetTLSconfigQUIC(t *testing.T) {
+
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	config := GetQUICTLSconfig(daneconfig)
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("MinVersion %x, expected TLS 1.3", config.MinVersion)
+	}
+	if len(config.NextProtos) != 1 || config.NextProtos[0] != "h3" {
+		t.Fatalf("NextProtos %v, expected [h3]", config.NextProtos)
+	}
+	if config.VerifyPeerCertificate == nil {
+		t.Fatalf("VerifyPeerCertificate not set")
+	}
+
+	daneconfig.SetALPN([]string{"doq"})
+	config = GetQUICTLSconfig(daneconfig)
+	if len(config.NextProtos) != 1 || config.NextProtos[0] != "doq" {
+		t.Fatalf("NextProtos %v, expected [doq]", config.NextProtos)
+	}
+}
+
+func TestReferenceNameServicename(t *testing.T) {
+
+	daneconfig := NewConfig("xmpp1.example.com", "192.0.2.1", 5222)
+	daneconfig.SetServiceName("example.com")
+	if daneconfig.referenceName() != "example.com" {
+		t.Fatalf("reference name %s, expected example.com",
+			daneconfig.referenceName())
+	}
+	config := GetTLSconfig(daneconfig)
+	if config.ServerName != "xmpp1.example.com" {
+		t.Fatalf("ServerName %s, expected xmpp1.example.com", config.ServerName)
+	}
+}
+
+func TestDialTLSResolve(t *testing.T) {
+
+	daneconfig := NewConfig("www.example.com", nil, 443)
+	daneconfig.SetResolver(resolver1)
+	fmt.Printf("## TLS RESOLVE: %s\n", daneconfig.Server.Name)
+	conn, err := DialTLSResolve(daneconfig)
+	if daneconfig.TLSA != nil {
+		daneconfig.TLSA.Results()
+	}
+	if err != nil {
+		fmt.Printf("Result: FAILED: %s\n", err.Error())
+		t.Fatalf("DialTLSResolve: %s.", err)
+	}
+	conn.Close()
+	fmt.Printf("Connected to %s: DANE %v PKIX %v\n\n", daneconfig.Server.Address(),
+		daneconfig.Okdane, daneconfig.Okpkix)
+}
+
+func TestGetCertValidity(t *testing.T) {
+
+	cert, _ := makeTestCert(t, "www.example.com", false, nil, nil)
+
+	v := getCertValidity(cert, time.Now())
+	if !v.Valid {
+		t.Fatalf("certificate not valid now: %s", v)
+	}
+	v = getCertValidity(cert, cert.NotAfter.Add(time.Minute))
+	if v.Valid {
+		t.Fatalf("certificate valid after NotAfter: %s", v)
+	}
+	v = getCertValidity(cert, cert.NotBefore.Add(-time.Minute))
+	if v.Valid {
+		t.Fatalf("certificate valid before NotBefore: %s", v)
+	}
+}
+
+func TestPeerChainPEM(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.PeerChain = []*x509.Certificate{ee, ca}
+	daneconfig.DANEChains = [][]*x509.Certificate{{ee, ca}}
+
+	rest := daneconfig.PeerChainPEM()
+	for _, cert := range daneconfig.PeerChain {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil || !bytes.Equal(block.Bytes, cert.Raw) {
+			t.Fatalf("PeerChainPEM: certificate mismatch")
+		}
+	}
+	if len(daneconfig.VerifiedChainsPEM()) != 1 {
+		t.Fatalf("VerifiedChainsPEM: expected 1 chain")
+	}
+}
+
+func TestVerifyServerChains(t *testing.T) {
+
+	root, rootkey := makeTestCert(t, "Test Root", true, nil, nil)
+	inter, interkey := makeTestCert(t, "Test Intermediate", true, root, rootkey)
+	ee, _ := makeTestCert(t, "www.example.com", false, inter, interkey)
+	rawCerts := [][]byte{ee.Raw, inter.Raw}
+
+	testCases := []struct {
+		name    string
+		usage   uint8
+		ta      *x509.Certificate
+		trusted bool
+		okdane  bool
+	}{
+		{"PKIX-TA root trusted", PkixTA, root, true, true},
+		{"PKIX-TA root untrusted", PkixTA, root, false, false},
+		{"DANE-TA intermediate", DaneTA, inter, false, true},
+		{"DANE-TA unsent root trusted", DaneTA, root, true, true},
+		{"DANE-TA unsent root untrusted", DaneTA, root, false, false},
+	}
+	for _, tc := range testCases {
+		data, err := ComputeTLSA(1, 1, tc.ta)
+		if err != nil {
+			t.Fatalf("%s: ComputeTLSA: %s", tc.name, err)
+		}
+		daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+		daneconfig.SetTLSA(&TLSAinfo{
+			Rdata: []*TLSArdata{{Usage: tc.usage, Selector: 1, Mtype: 1, Data: data}},
+		})
+		daneconfig.NoPKIXfallback()
+		tlsconfig := GetTLSconfig(daneconfig)
+		tlsconfig.RootCAs = x509.NewCertPool()
+		if tc.trusted {
+			tlsconfig.RootCAs.AddCert(root)
+		}
+
+		err = verifyServer(rawCerts, nil, tlsconfig, daneconfig)
+		if daneconfig.Okdane != tc.okdane || (err == nil) != tc.okdane {
+			t.Fatalf("%s: Okdane %v, err %v: %s", tc.name, daneconfig.Okdane,
+				err, daneconfig.TLSA.Rdata[0].Message)
+		}
+		if len(daneconfig.DANEChains) == 0 {
+			t.Fatalf("%s: DANEChains not populated", tc.name)
+		}
+		if tc.trusted && len(daneconfig.PKIXChains) == 0 {
+			t.Fatalf("%s: PKIXChains not populated", tc.name)
+		}
+	}
+}
+
+func TestVerifyServerLinkedChain(t *testing.T) {
+
+	root, rootkey := makeTestCert(t, "Test Root", true, nil, nil)
+	inter, interkey := makeTestCert(t, "Test Intermediate", false, root, rootkey)
+	ee, _ := makeTestCert(t, "www.example.com", false, inter, interkey)
+	other, _ := makeTestCert(t, "Test Intermediate", false, root, rootkey)
+	cainter, cainterkey := makeTestCert(t, "Test CA Intermediate", true, root, rootkey)
+	caee, _ := makeTestCert(t, "www.example.com", false, cainter, cainterkey)
+
+	// A forged certificate for the server name, signed by the holder of
+	// an end entity certificate issued by the trust anchor.
+	leaf, leafkey := makeTestCert(t, "attacker.example.net", false, root, rootkey)
+	forged, _ := makeTestCert(t, "www.example.com", false, leaf, leafkey)
+
+	testCases := []struct {
+		name   string
+		certs  []*x509.Certificate
+		ta     *x509.Certificate
+		okdane bool
+	}{
+		{"CA intermediate", []*x509.Certificate{caee, cainter, root}, root, true},
+		{"non-CA intermediate", []*x509.Certificate{ee, inter, root}, inter, false},
+		{"unlinked intermediate", []*x509.Certificate{ee, other, root}, inter, false},
+		{"forged leaf", []*x509.Certificate{forged, leaf, root}, root, false},
+	}
+	for _, tc := range testCases {
+		data, err := ComputeTLSA(1, 1, tc.ta)
+		if err != nil {
+			t.Fatalf("ComputeTLSA: %s", err)
+		}
+		var rawCerts [][]byte
+		for _, cert := range tc.certs {
+			rawCerts = append(rawCerts, cert.Raw)
+		}
+		daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+		daneconfig.SetTLSA(&TLSAinfo{
+			Rdata: []*TLSArdata{{Usage: DaneTA, Selector: 1, Mtype: 1, Data: data}},
+		})
+		daneconfig.NoPKIXfallback()
+		tlsconfig := GetTLSconfig(daneconfig)
+		tlsconfig.RootCAs = x509.NewCertPool()
+
+		err = verifyServer(rawCerts, nil, tlsconfig, daneconfig)
+		if daneconfig.Okdane != tc.okdane || (err == nil) != tc.okdane {
+			t.Fatalf("%s: Okdane %v, err %v", tc.name, daneconfig.Okdane, err)
+		}
+		if _, err = linkedChain(tc.certs); (err == nil) != tc.okdane {
+			t.Fatalf("%s: linkedChain: %v", tc.name, err)
+		}
+	}
+}
+
+type testLogger struct {
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+
+	logger := new(testLogger)
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.PKIXRootCA = []byte("not a certificate")
+	_ = GetTLSconfig(daneconfig)
+	if len(logger.messages) != 0 {
+		t.Fatalf("Logger: unexpected messages: %v", logger.messages)
+	}
+
+	daneconfig.SetLogger(logger)
+	_ = GetTLSconfig(daneconfig)
+	if len(logger.messages) != 1 {
+		t.Fatalf("Logger: expected 1 message, got %v", logger.messages)
+	}
+}
+
+func TestConfigClone(t *testing.T) {
+
+	template := NewConfig("www.example.com", "192.0.2.1", 443)
+	template.SetALPN([]string{"h2"})
+	template.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: "00"}},
+	})
+	template.Okdane = true
+	template.TLSA.Rdata[0].Checked = true
+	template.DiagError = fmt.Errorf("error")
+
+	c := template.Clone()
+	if c.Okdane || c.DiagError != nil || c.TLSA.Rdata[0].Checked {
+		t.Fatalf("Clone: result fields not reset")
+	}
+	c.Server.Port = 8443
+	c.ALPN[0] = "http/1.1"
+	c.TLSA.Rdata[0].Usage = DaneTA
+	if template.Server.Port != 443 || template.ALPN[0] != "h2" ||
+		template.TLSA.Rdata[0].Usage != DaneEE {
+		t.Fatalf("Clone: template modified through clone")
+	}
+}
+
+func TestDialTLSTimingsOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.PKIXRootCA = CertToPEMBytes(server.Certificate())
+
+	conn, err := DialTLS(daneconfig)
+	if err != nil {
+		t.Fatalf("DialTLS: %s", err)
+	}
+	conn.Close()
+	if !daneconfig.Okpkix {
+		t.Fatalf("DialTLS: PKIX authentication failed")
+	}
+	timings := daneconfig.Timings
+	if timings.TCPConnect == 0 || timings.TLSHandshake == 0 || timings.Authentication == 0 {
+		t.Fatalf("DialTLS: timings not recorded: %+v", timings)
+	}
+}
+
+func TestDialTLSLocalAddrOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.PKIXRootCA = CertToPEMBytes(server.Certificate())
+	daneconfig.SetLocalAddr(&net.TCPAddr{IP: addr.IP})
+	controlled := false
+	daneconfig.SetDialControl(func(network, address string, c syscall.RawConn) error {
+		controlled = true
+		return nil
+	})
+
+	conn, err := DialTLS(daneconfig)
+	if err != nil {
+		t.Fatalf("DialTLS: %s", err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if !local.IP.Equal(addr.IP) {
+		t.Fatalf("DialTLS: local address %s, expected %s", local.IP, addr.IP)
+	}
+	if !controlled {
+		t.Fatalf("DialTLS: dial control function not called")
+	}
+}
+
+func TestDialTLSPinnedSPKIOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	pin, err := ComputeTLSA(1, 1, server.Certificate())
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.SetPinnedSPKI([]string{strings.Repeat("00", 32), strings.ToUpper(pin)})
+	conn, err := DialTLS(daneconfig)
+	if err != nil {
+		t.Fatalf("DialTLS: %s", err)
+	}
+	conn.Close()
+	if !daneconfig.Okpin || daneconfig.Okpkix {
+		t.Fatalf("DialTLS: Okpin %v, Okpkix %v", daneconfig.Okpin, daneconfig.Okpkix)
+	}
+
+	daneconfig = NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.SetPinnedSPKI([]string{strings.Repeat("00", 32)})
+	conn, err = DialTLS(daneconfig)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("DialTLS: succeeded with mismatched pin")
+	}
+	if daneconfig.Okpin {
+		t.Fatalf("DialTLS: Okpin set with mismatched pin")
+	}
+}
+
+func TestAuthenticateConnStateOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(),
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial: %s", err)
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+
+	data, err := ComputeTLSA(1, 1, server.Certificate())
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: data}},
+	}
+
+	daneconfig := NewConfig("example.com", "192.0.2.1", 443)
+	if !AuthenticateConnState(&state, tlsa, daneconfig) {
+		t.Fatalf("AuthenticateConnState: DANE-EE failed: %v", daneconfig.DiagError)
+	}
+	if !daneconfig.Okdane || daneconfig.MatchedTLSA == nil {
+		t.Fatalf("AuthenticateConnState: DANE results not recorded")
+	}
+
+	daneconfig.PKIXRootCA = CertToPEMBytes(server.Certificate())
+	if !AuthenticateConnState(&state, nil, daneconfig) {
+		t.Fatalf("AuthenticateConnState: PKIX failed: %v", daneconfig.DiagError)
+	}
+	if daneconfig.Okdane || !daneconfig.Okpkix {
+		t.Fatalf("AuthenticateConnState: Okdane %v, Okpkix %v",
+			daneconfig.Okdane, daneconfig.Okpkix)
+	}
+
+	tlsa.Rdata[0].Data = strings.Repeat("00", 32)
+	daneconfig = NewConfig("example.com", "192.0.2.1", 443)
+	if AuthenticateConnState(&state, tlsa, daneconfig) {
+		t.Fatalf("AuthenticateConnState: succeeded with mismatched TLSA")
+	}
+}
+
+func TestDialTLSFullCertificateOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The TLSA data is computed from the exact DER bytes that the server
+	// sends, which x509.ParseCertificate keeps as the certificate's Raw
+	// field, so full certificate records match the received bytes.
+	wire := server.TLS.Certificates[0].Certificate[0]
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 0, Mtype: 0,
+			Data: strings.ToUpper(hex.EncodeToString(wire))}},
+	})
+
+	conn, err := DialTLS(daneconfig)
+	if err != nil {
+		t.Fatalf("DialTLS: %s", err)
+	}
+	conn.Close()
+	if !daneconfig.Okdane {
+		t.Fatalf("DialTLS: full certificate TLSA record did not match: %s",
+			daneconfig.TLSA.Rdata[0].Message)
+	}
+	if !bytes.Equal(daneconfig.PeerChain[0].Raw, wire) {
+		t.Fatalf("DialTLS: peer certificate differs from received DER")
+	}
+}
+
+func TestCountEmbeddedSCTs(t *testing.T) {
+
+	sct1 := []byte{0, 3, 1, 2, 3}
+	sct2 := []byte{0, 2, 4, 5}
+	sctlist := append([]byte{0, byte(len(sct1) + len(sct2))}, sct1...)
+	sctlist = append(sctlist, sct2...)
+	value, err := asn1.Marshal(sctlist)
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %s", err)
+	}
+
+	cert, key := makeTestCert(t, "www.example.com", false, nil, nil)
+	if countEmbeddedSCTs(cert) != 0 {
+		t.Fatalf("countEmbeddedSCTs: SCTs found in certificate without them")
+	}
+	template := *cert
+	template.ExtraExtensions = []pkix.Extension{{Id: oidEmbeddedSCTList, Value: value}}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+	if n := countEmbeddedSCTs(cert); n != 2 {
+		t.Fatalf("countEmbeddedSCTs: got %d, expected 2", n)
+	}
+
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	recordSCTs(tls.ConnectionState{
+		PeerCertificates:            []*x509.Certificate{cert},
+		SignedCertificateTimestamps: [][]byte{{1}},
+	}, daneconfig)
+	if !daneconfig.HasSCT || daneconfig.SCTCount != 3 {
+		t.Fatalf("recordSCTs: HasSCT %v, SCTCount %d", daneconfig.HasSCT,
+			daneconfig.SCTCount)
+	}
+}
+
+func TestDialTLSImplicitSMTPOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	data, err := ComputeTLSA(1, 1, server.Certificate())
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+
+	for _, tc := range []struct {
+		usage   uint8
+		appname string
+		okdane  bool
+	}{
+		{PkixEE, "", true},
+		{PkixEE, "smtps", false},
+		{DaneEE, "smtps", true},
+	} {
+		daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+		daneconfig.PKIXRootCA = CertToPEMBytes(server.Certificate())
+		daneconfig.SetAppName(tc.appname)
+		daneconfig.NoPKIXfallback()
+		daneconfig.SetTLSA(&TLSAinfo{
+			Rdata: []*TLSArdata{{Usage: tc.usage, Selector: 1, Mtype: 1, Data: data}},
+		})
+		conn, err := DialTLS(daneconfig)
+		if err == nil {
+			conn.Close()
+		}
+		if daneconfig.Okdane != tc.okdane || (err == nil) != tc.okdane {
+			t.Fatalf("usage %d appname %q: Okdane %v, err %v", tc.usage,
+				tc.appname, daneconfig.Okdane, err)
+		}
+	}
+}
+
+// makeTestSCT returns a TLS encoded SCT for the given log entry, signed
+// by the given log key.
+func makeTestSCT(t *testing.T, key *ecdsa.PrivateKey, log *CTLog, entryType uint16,
+	entry []byte) []byte {
+
+	sct := &signedCertificateTimestamp{
+		logID:     log.ID,
+		timestamp: uint64(time.Now().Add(-time.Minute).UnixMilli()),
+		hashAlg:   4,
+		sigAlg:    3,
+	}
+	digest := sha256.Sum256(sctSignedData(sct, entryType, entry))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("SignASN1: %s", err)
+	}
+	data := append([]byte{0}, sct.logID[:]...)
+	data = append(data, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(data[33:], sct.timestamp)
+	data = append(data, 0, 0, sct.hashAlg, sct.sigAlg, byte(len(sig)>>8), byte(len(sig)))
+	return append(data, sig...)
+}
+
+func TestVerifySCTsOffline(t *testing.T) {
+
+	logkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&logkey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %s", err)
+	}
+	log, err := NewCTLog("test log", spki)
+	if err != nil {
+		t.Fatalf("NewCTLog: %s", err)
+	}
+	otherlog := &CTLog{Key: log.Key}
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	leaf, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+
+	// SCT delivered in the TLS handshake
+	entry := putUint24(nil, len(leaf.Raw))
+	entry = append(entry, leaf.Raw...)
+	cs := tls.ConnectionState{
+		PeerCertificates:            []*x509.Certificate{leaf, ca},
+		SignedCertificateTimestamps: [][]byte{makeTestSCT(t, logkey, log, 0, entry)},
+	}
+	if n := verifiedSCTCount(cs, []*CTLog{log}); n != 1 {
+		t.Fatalf("verifiedSCTCount: TLS SCT: got %d, expected 1", n)
+	}
+	if n := verifiedSCTCount(cs, []*CTLog{otherlog}); n != 0 {
+		t.Fatalf("verifiedSCTCount: unknown log: got %d, expected 0", n)
+	}
+
+	// SCT embedded in the certificate, over the precertificate TBS
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"www.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, cakey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	precert, _ := x509.ParseCertificate(der)
+	issuerKeyHash := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	entry = append([]byte(nil), issuerKeyHash[:]...)
+	entry = putUint24(entry, len(precert.RawTBSCertificate))
+	entry = append(entry, precert.RawTBSCertificate...)
+	sct := makeTestSCT(t, logkey, log, 1, entry)
+	sctlist := []byte{byte((len(sct) + 2) >> 8), byte(len(sct) + 2),
+		byte(len(sct) >> 8), byte(len(sct))}
+	value, _ := asn1.Marshal(append(sctlist, sct...))
+	template.ExtraExtensions = []pkix.Extension{{Id: oidEmbeddedSCTList, Value: value}}
+	der, err = x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, cakey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	tbs, err := precertTBS(cert)
+	if err != nil || !bytes.Equal(tbs, precert.RawTBSCertificate) {
+		t.Fatalf("precertTBS: TBSCertificate mismatch: %v", err)
+	}
+	cs = tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert, ca}}
+	if n := verifiedSCTCount(cs, []*CTLog{log}); n != 1 {
+		t.Fatalf("verifiedSCTCount: embedded SCT: got %d, expected 1", n)
+	}
+
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.SetRequireCT([]*CTLog{otherlog})
+	if checkCT(cs, daneconfig) == nil {
+		t.Fatalf("checkCT: succeeded without a valid SCT")
+	}
+	daneconfig.SetRequireCT([]*CTLog{log})
+	if err := checkCT(cs, daneconfig); err != nil || daneconfig.ValidSCTs != 1 {
+		t.Fatalf("checkCT: %v (ValidSCTs %d)", err, daneconfig.ValidSCTs)
+	}
+}
+
+func TestDialTLSExtraVerifyOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	data, err := ComputeTLSA(1, 1, server.Certificate())
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: data}},
+	}
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	for _, tc := range []struct {
+		serial int64
+		ok     bool
+	}{
+		{server.Certificate().SerialNumber.Int64(), true},
+		{-1, false},
+	} {
+		called := false
+		daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+		daneconfig.SetTLSA(tlsa)
+		daneconfig.SetExtraVerify(func(chain []*x509.Certificate, config *Config) error {
+			called = true
+			if !config.Okdane {
+				return fmt.Errorf("called before DANE authentication")
+			}
+			if chain[0].SerialNumber.Int64() != tc.serial {
+				return fmt.Errorf("unexpected serial number %s", chain[0].SerialNumber)
+			}
+			return nil
+		})
+		conn, err := DialTLS(daneconfig)
+		if conn != nil {
+			conn.Close()
+		}
+		if !called {
+			t.Fatalf("serial %d: ExtraVerify not called", tc.serial)
+		}
+		if (err == nil) != tc.ok {
+			t.Fatalf("serial %d: DialTLS error %v, expected ok %v", tc.serial, err, tc.ok)
+		}
+	}
+}
+
+func TestDialTLSConnOnFailOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1,
+			Data: strings.Repeat("ab", 32)}},
+	}
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.SetTLSA(tlsa)
+	daneconfig.SetConnOnFail(true)
+	conn, err := DialTLS(daneconfig)
+	if conn == nil {
+		t.Fatalf("DialTLS: no connection returned on authentication failure: %v", err)
+	}
+	defer conn.Close()
+	if err == nil {
+		t.Fatalf("DialTLS: no error returned on authentication failure")
+	}
+	if daneconfig.Okdane {
+		t.Fatalf("DialTLS: Okdane set for mismatched TLSA record")
+	}
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 ||
+		!state.PeerCertificates[0].Equal(server.Certificate()) {
+		t.Fatalf("DialTLS: peer certificate not available on returned connection")
+	}
+
+	daneconfig = NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.SetTLSA(tlsa)
+	conn, err = DialTLS(daneconfig)
+	if err == nil || conn != nil {
+		t.Fatalf("DialTLS: expected failure without connection, got %v, %v", conn, err)
+	}
+}
+
+func TestAuthenticateSNIOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	resolver, _, shutdown := startTestDNSServer(t)
+	defer shutdown()
+	resolver.PersistentTCP = true
+	defer resolver.Close()
+
+	getState := func(sni string) *tls.ConnectionState {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(),
+			&tls.Config{InsecureSkipVerify: true, ServerName: sni})
+		if err != nil {
+			t.Fatalf("tls.Dial: %s", err)
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		return &state
+	}
+
+	// The test DNS server's TLSA record does not match the certificate.
+	daneconfig := NewConfig("front.example.net", "192.0.2.1", 8443)
+	ok, err := AuthenticateSNI(resolver, getState("example.com"), 443, daneconfig)
+	if err != nil {
+		t.Fatalf("AuthenticateSNI: %s", err)
+	}
+	if ok || daneconfig.Okdane {
+		t.Fatalf("AuthenticateSNI: succeeded with mismatched TLSA")
+	}
+	if daneconfig.Server.Name != "example.com" || daneconfig.Server.Port != 443 {
+		t.Fatalf("AuthenticateSNI: server not set to negotiated name: %s", daneconfig.Server)
+	}
+	if daneconfig.TLSA == nil || len(daneconfig.TLSA.Rdata) != 1 || !daneconfig.TLSA.Rdata[0].Checked {
+		t.Fatalf("AuthenticateSNI: TLSA records for negotiated name not checked")
+	}
+
+	// No authenticated TLSA records, and PKIX fallback disabled.
+	daneconfig = NewConfig("front.example.net", "192.0.2.1", 8443)
+	daneconfig.NoPKIXfallback()
+	ok, err = AuthenticateSNI(resolver, getState("www.insecure.example.com"), 443, daneconfig)
+	if ok || err == nil {
+		t.Fatalf("AuthenticateSNI: expected failure without TLSA, got %v, %v", ok, err)
+	}
+
+	if _, err = AuthenticateSNI(resolver, &tls.ConnectionState{}, 443, daneconfig); err == nil {
+		t.Fatalf("AuthenticateSNI: expected error without server name")
+	}
+}
+
+func TestResumptionOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	data, err := ComputeTLSA(1, 1, server.Certificate())
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+	good := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: data}},
+	}
+	bad := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1,
+			Data: strings.Repeat("00", 32)}},
+	}
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	cache := tls.NewLRUClientSessionCache(4)
+	dial := func(tlsa *TLSAinfo, resumption bool) (*tls.ConnectionState, *Config, error) {
+		daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+		daneconfig.TLSversion = tls.VersionTLS12
+		daneconfig.SetResumption(resumption)
+		daneconfig.SetTLSA(tlsa)
+		config := GetTLSconfig(daneconfig)
+		config.ClientSessionCache = cache
+		conn, err := tls.Dial("tcp", addr.String(), config)
+		if err != nil {
+			return nil, daneconfig, err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		return &state, daneconfig, nil
+	}
+
+	// Resumption disabled by default
+	for i := 0; i < 2; i++ {
+		state, _, err := dial(good, false)
+		if err != nil {
+			t.Fatalf("dial: %s", err)
+		}
+		if state.DidResume {
+			t.Fatalf("dial: session resumed with resumption disabled")
+		}
+	}
+
+	if _, _, err = dial(good, true); err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	state, daneconfig, err := dial(good, true)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	if !state.DidResume {
+		t.Fatalf("dial: session not resumed")
+	}
+	if !daneconfig.Okdane {
+		t.Fatalf("dial: resumed session not DANE authenticated")
+	}
+
+	// The resumed session must be checked against the current TLSA.
+	if _, _, err = dial(bad, true); err == nil {
+		t.Fatalf("dial: resumed session succeeded with mismatched TLSA")
+	}
+}
+
+func TestDialTLSHandshakeTimeoutOffline(t *testing.T) {
+
+	// A server that accepts the connection but never responds to the
+	// TLS ClientHello.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.SetTimeoutTLS(1)
+
+	start := time.Now()
+	_, err = DialTLS(daneconfig)
+	if err == nil {
+		t.Fatalf("DialTLS: handshake with stalled server succeeded")
+	}
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("DialTLS: expected timeout error, got: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("DialTLS: handshake timeout took %s", elapsed)
+	}
+}
+
+func TestExportKeyingMaterialOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.PKIXRootCA = CertToPEMBytes(server.Certificate())
+
+	if _, err := daneconfig.ExportKeyingMaterial("EXPORTER-test", nil, 32); err == nil {
+		t.Fatalf("ExportKeyingMaterial: succeeded without a connection")
+	}
+
+	conn, err := DialTLS(daneconfig)
+	if err != nil {
+		t.Fatalf("DialTLS: %s", err)
+	}
+	defer conn.Close()
+
+	ekm, err := daneconfig.ExportKeyingMaterial("EXPORTER-test", []byte("ctx"), 32)
+	if err != nil {
+		t.Fatalf("ExportKeyingMaterial: %s", err)
+	}
+	state := conn.ConnectionState()
+	expected, _ := state.ExportKeyingMaterial("EXPORTER-test", []byte("ctx"), 32)
+	if len(ekm) != 32 || !bytes.Equal(ekm, expected) {
+		t.Fatalf("ExportKeyingMaterial: got %x, expected %x", ekm, expected)
+	}
+}
+
+func TestDialTLS2Offline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tlsadata, err := ComputeTLSA(1, 1, server.Certificate())
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: tlsadata}},
+	}
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+	daneconfig.SetTLSA(tlsa)
+
+	conn, err := DialTLS2(daneconfig)
+	if err != nil {
+		t.Fatalf("DialTLS2: %s", err)
+	}
+	defer conn.Close()
+	if conn.Config() != daneconfig || !conn.Okdane() || conn.Okpkix() {
+		t.Fatalf("DialTLS2: unexpected results: Okdane %v, Okpkix %v",
+			conn.Okdane(), conn.Okpkix())
+	}
+	results := conn.TLSAResults()
+	if len(results) != 1 || !results[0].Checked || !results[0].Ok {
+		t.Fatalf("DialTLS2: unexpected TLSA results: %v", results)
+	}
+	if conn.MatchedTLSA() == nil || conn.MatchedTLSA().Data != tlsadata {
+		t.Fatalf("DialTLS2: unexpected matched TLSA: %v", conn.MatchedTLSA())
+	}
+	if len(conn.ConnectionState().PeerCertificates) == 0 {
+		t.Fatalf("DialTLS2: no peer certificates on connection")
+	}
+}
+
+func TestAuthenticateChainOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+
+	pemdata := append(CertToPEMBytes(ee), CertToPEMBytes(ca)...)
+	chain, err := ParseCertChainPEM(pemdata)
+	if err != nil {
+		t.Fatalf("ParseCertChainPEM: %s", err)
+	}
+	if len(chain) != 2 || !chain[0].Equal(ee) || !chain[1].Equal(ca) {
+		t.Fatalf("ParseCertChainPEM: unexpected chain: %v", chain)
+	}
+	if _, err = ParseCertChainPEM([]byte("no certificates")); err == nil {
+		t.Fatalf("ParseCertChainPEM: succeeded without certificates")
+	}
+
+	tadata, _ := ComputeTLSA(0, 1, ca)
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneTA, Selector: 0, Mtype: 1, Data: tadata}},
+	}
+	daneconfig := NewConfig("www.example.com", nil, 443)
+	if !AuthenticateChain(chain, tlsa, daneconfig) || !daneconfig.Okdane {
+		t.Fatalf("AuthenticateChain: DANE-TA authentication failed: %v",
+			daneconfig.DiagError)
+	}
+
+	daneconfig = NewConfig("www.example.org", nil, 443)
+	if AuthenticateChain(chain, tlsa, daneconfig) {
+		t.Fatalf("AuthenticateChain: authenticated chain with wrong name")
+	}
+}
+
+func TestAcceptNamesOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "tenant2.example.com", false, ca, cakey)
+
+	tadata, _ := ComputeTLSA(0, 1, ca)
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneTA, Selector: 0, Mtype: 1, Data: tadata}},
+	}
+	chain := []*x509.Certificate{ee, ca}
+
+	for _, tc := range []struct {
+		accept  []string
+		ok      bool
+		matches []string
+	}{
+		{nil, false, nil},
+		{[]string{"tenant1.example.com", "tenant2.example.com"}, true,
+			[]string{"tenant2.example.com"}},
+		{[]string{"tenant1.example.com", "tenant3.example.com"}, false, nil},
+	} {
+		daneconfig := NewConfig("endpoint.example.com", nil, 443)
+		daneconfig.SetAcceptNames(tc.accept)
+		ok := AuthenticateChain(chain, tlsa, daneconfig)
+		if ok != tc.ok || daneconfig.Okdane != tc.ok {
+			t.Fatalf("accept %v: authenticated %v, expected %v", tc.accept, ok, tc.ok)
+		}
+		if fmt.Sprint(daneconfig.NameMatches) != fmt.Sprint(tc.matches) {
+			t.Fatalf("accept %v: name matches %v, expected %v", tc.accept,
+				daneconfig.NameMatches, tc.matches)
+		}
+		if len(daneconfig.LeafSANs) != 1 || daneconfig.LeafSANs[0] != "tenant2.example.com" {
+			t.Fatalf("accept %v: unexpected leaf SANs %v", tc.accept, daneconfig.LeafSANs)
+		}
+	}
+}
+
+func TestSNIOverrideOffline(t *testing.T) {
+
+	var sni string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	for _, tc := range []struct {
+		name  string
+		sni   string
+		nosni bool
+		sent  string
+		ok    bool
+	}{
+		{"", "example.com", false, "example.com", true},
+		{"example.com", "", true, "", true},
+		{"", "", false, "", false},
+		{"", "www.example.org", false, "www.example.org", false},
+	} {
+		sni = "unset"
+		daneconfig := NewConfig(tc.name, addr.IP, addr.Port)
+		daneconfig.PKIXRootCA = CertToPEMBytes(server.Certificate())
+		daneconfig.SetSNI(tc.sni)
+		daneconfig.SetNoSNI(tc.nosni)
+		conn, err := DialTLS(daneconfig)
+		if conn != nil {
+			conn.Close()
+		}
+		if sni != tc.sent {
+			t.Fatalf("%+v: SNI %q sent", tc, sni)
+		}
+		if (err == nil) != tc.ok {
+			t.Fatalf("%+v: DialTLS error: %v", tc, err)
+		}
+	}
+}
+
+func TestNoPKIXValidationOffline(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	eedata, _ := ComputeTLSA(1, 1, server.Certificate())
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	for _, tc := range []struct {
+		pkix   bool
+		usage  uint8
+		okpkix bool
+	}{
+		{true, DaneEE, true},
+		{false, DaneEE, false},
+		{false, PkixEE, true},
+		{false, DaneTA, true},
+	} {
+		daneconfig := NewConfig("example.com", addr.IP, addr.Port)
+		daneconfig.PKIXRootCA = CertToPEMBytes(server.Certificate())
+		daneconfig.SetTLSA(&TLSAinfo{
+			Rdata: []*TLSArdata{{Usage: tc.usage, Selector: 1, Mtype: 1, Data: eedata}},
+		})
+		if !tc.pkix {
+			daneconfig.NoPKIXfallback()
+		}
+		conn, err := DialTLS(daneconfig)
+		if err != nil {
+			t.Fatalf("%+v: DialTLS: %s", tc, err)
+		}
+		conn.Close()
+		if !daneconfig.Okdane || daneconfig.Okpkix != tc.okpkix {
+			t.Fatalf("%+v: Okdane %v, Okpkix %v", tc, daneconfig.Okdane,
+				daneconfig.Okpkix)
+		}
+		if (daneconfig.PKIXChains != nil) != tc.okpkix {
+			t.Fatalf("%+v: unexpected PKIX chains %v", tc, daneconfig.PKIXChains)
+		}
+	}
+}
+
+// startTestTLSListener starts a TLS server on the given loopback IP address
+// and port (0: any), presenting the given certificate chain, which only
+// completes the handshake. It returns the port listened on.
+func startTestTLSListener(t *testing.T, ip string, port int,
+	chain []*x509.Certificate, key *ecdsa.PrivateKey) int {
+
+	cert := tls.Certificate{PrivateKey: key}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	ln, err := tls.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)),
+		&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Skipf("tls.Listen %s: %s", ip, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialTLSResolveStaleResultsOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	other, otherkey := makeTestCert(t, "other.example.com", false, ca, cakey)
+	selfsigned, selfkey := makeTestCert(t, "www.example.com", false, nil, nil)
+
+	// The first address presents a valid chain for another name, and the
+	// second a self-signed certificate for the server name: neither
+	// should be PKIX authenticated.
+	port := startTestTLSListener(t, "127.0.0.1", 0, []*x509.Certificate{other, ca}, otherkey)
+	startTestTLSListener(t, "127.0.0.2", port, []*x509.Certificate{selfsigned}, selfkey)
+
+	resolver := NewResolver(nil)
+	resolver.IPv6 = false
+	resolver.Exchanger = &stubExchanger{records: []string{
+		"www.example.com. 300 IN A 127.0.0.1",
+		"www.example.com. 300 IN A 127.0.0.2",
+	}}
+
+	daneconfig := NewConfig("www.example.com", nil, port)
+	daneconfig.SetResolver(resolver)
+	daneconfig.PKIXRootCA = CertToPEMBytes(ca)
+	conn, err := DialTLSResolve(daneconfig)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("DialTLSResolve: authenticated %s", daneconfig.Server.Address())
+	}
+	if daneconfig.Okpkix || daneconfig.Okdane {
+		t.Fatalf("DialTLSResolve: stale results: Okpkix %v, Okdane %v",
+			daneconfig.Okpkix, daneconfig.Okdane)
+	}
+}
+
+func TestDialTLSResolveConnOnFailOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	other, otherkey := makeTestCert(t, "other.example.com", false, ca, cakey)
+	good, goodkey := makeTestCert(t, "www.example.com", false, ca, cakey)
+	selfsigned, selfkey := makeTestCert(t, "www.example.com", false, nil, nil)
+
+	port := startTestTLSListener(t, "127.0.0.1", 0, []*x509.Certificate{other, ca}, otherkey)
+	startTestTLSListener(t, "127.0.0.2", port, []*x509.Certificate{good, ca}, goodkey)
+	startTestTLSListener(t, "127.0.0.3", port, []*x509.Certificate{selfsigned}, selfkey)
+
+	for _, tc := range []struct {
+		addrs []string
+		ok    bool
+		addr  string
+		peer  *x509.Certificate
+	}{
+		{[]string{"127.0.0.1", "127.0.0.2"}, true, "127.0.0.2", good},
+		{[]string{"127.0.0.1", "127.0.0.3"}, false, "127.0.0.1", other},
+	} {
+		resolver := NewResolver(nil)
+		resolver.IPv6 = false
+		exchanger := new(stubExchanger)
+		for _, addr := range tc.addrs {
+			exchanger.records = append(exchanger.records, "www.example.com. 300 IN A "+addr)
+		}
+		resolver.Exchanger = exchanger
+
+		daneconfig := NewConfig("www.example.com", nil, port)
+		daneconfig.SetResolver(resolver)
+		daneconfig.PKIXRootCA = CertToPEMBytes(ca)
+		daneconfig.SetConnOnFail(true)
+		conn, err := DialTLSResolve(daneconfig)
+		if conn == nil {
+			t.Fatalf("%v: DialTLSResolve: no connection: %v", tc.addrs, err)
+		}
+		conn.Close()
+		if (err == nil) != tc.ok || (tc.ok && !daneconfig.Okpkix) {
+			t.Fatalf("%v: DialTLSResolve: Okpkix %v, err %v", tc.addrs,
+				daneconfig.Okpkix, err)
+		}
+		if daneconfig.Server.Ipaddr.String() != tc.addr ||
+			!daneconfig.PeerChain[0].Equal(tc.peer) ||
+			!conn.ConnectionState().PeerCertificates[0].Equal(tc.peer) {
+			t.Fatalf("%v: DialTLSResolve: returned %s, expected %s", tc.addrs,
+				daneconfig.Server.Ipaddr, tc.addr)
+		}
+		if !tc.ok && daneconfig.DiagError == nil {
+			t.Fatalf("%v: DialTLSResolve: no DiagError recorded", tc.addrs)
+		}
+	}
+}
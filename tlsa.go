@@ -1,12 +1,18 @@
 package dane
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 // DANE Certificte Usage modes
@@ -19,26 +25,93 @@ const (
 
 // TLSArdata - TLSA rdata structure
 type TLSArdata struct {
-	Usage    uint8  // Certificate Usage
-	Selector uint8  // Selector: 0: full cert, 1: subject public key
-	Mtype    uint8  // Matching Type: 0: full content, 1: SHA256, 2: SHA512
-	Data     string // Certificate association Data field (hex encoding)
-	Checked  bool   // Have we tried to match this TLSA rdata?
-	Ok       bool   // Did it match?
-	Message  string // Diagnostic message for matching
+	Usage        uint8  // Certificate Usage
+	Selector     uint8  // Selector: 0: full cert, 1: subject public key
+	Mtype        uint8  // Matching Type: 0: full content, 1: SHA256, 2: SHA512
+	Data         string // Certificate association Data field (hex encoding)
+	TTL          uint32 // Time to live of the TLSA record, in seconds
+	Checked      bool   // Have we tried to match this TLSA rdata?
+	Ok           bool   // Did it match?
+	Message      string // Diagnostic message for matching
+	NameMismatch bool   // Matched a chain, but the name check failed
 }
 
 // String returns a string representation of the TLSA rdata.
 func (tr *TLSArdata) String() string {
+	data := tr.Data
+	if len(data) > 8 {
+		data = data[0:8]
+	}
 	return fmt.Sprintf("DANE TLSA %d %d %d [%s..]",
-		tr.Usage, tr.Selector, tr.Mtype, tr.Data[0:8])
+		tr.Usage, tr.Selector, tr.Mtype, data)
 }
 
-// TLSAinfo contains details of the TLSA RRset.
+// GenericString returns a zone file representation of the TLSA record
+// with the given owner name and TTL, and this rdata, in the generic RFC
+// 3597 format for unknown RR types ("TYPE52 \# <length> <hex>"), for use
+// with DNS software that doesn't support the TLSA type. The Data field is
+// expected to be valid hex; any invalid trailing part is omitted.
+func (tr *TLSArdata) GenericString(owner string, ttl uint32) string {
+	data, _ := hex.DecodeString(tr.Data)
+	rdata := append([]byte{tr.Usage, tr.Selector, tr.Mtype}, data...)
+	return fmt.Sprintf("%s\t%d\tIN\tTYPE%d\t\\# %d %s", dns.Fqdn(owner), ttl,
+		dns.TypeTLSA, len(rdata), hex.EncodeToString(rdata))
+}
+
+// isPlaceholder returns whether the TLSA rdata is a null "0 0 0" record
+// with empty certificate association data, as sometimes published as a
+// placeholder. Such a record can never match a certificate.
+func (tr *TLSArdata) isPlaceholder() bool {
+	return tr.Usage == PkixTA && tr.Selector == 0 && tr.Mtype == 0 && tr.Data == ""
+}
+
+// RRSIGinfo contains details of a DNSSEC signature (RRSIG) over the
+// TLSA RRset.
+type RRSIGinfo struct {
+	KeyTag     uint16    // Key tag of the signing key
+	Algorithm  uint8     // DNSSEC algorithm number
+	SignerName string    // Signer's name (zone name)
+	Inception  time.Time // Signature inception time
+	Expiration time.Time // Signature expiration time
+}
+
+// TLSAinfo contains details of the TLSA RRset. Query holds the transport
+// details of the DNS query that obtained it, if it was looked up by GetTLSA.
 type TLSAinfo struct {
 	Qname string
 	Alias []string
 	Rdata []*TLSArdata
+	RRSIG []*RRSIGinfo
+	Query *QueryInfo
+}
+
+// SigExpiration returns the earliest expiration time of the RRSIGs over
+// the TLSA RRset, and false if there are no RRSIGs.
+func (t *TLSAinfo) SigExpiration() (time.Time, bool) {
+
+	var expiration time.Time
+
+	for i, sig := range t.RRSIG {
+		if i == 0 || sig.Expiration.Before(expiration) {
+			expiration = sig.Expiration
+		}
+	}
+	return expiration, len(t.RRSIG) > 0
+}
+
+// MinTTL returns the smallest TTL of the TLSA records, which is how long
+// (in seconds, from the time of the lookup) the TLSA RRset may be cached,
+// and false if there are no records.
+func (t *TLSAinfo) MinTTL() (uint32, bool) {
+
+	var ttl uint32
+
+	for i, tr := range t.Rdata {
+		if i == 0 || tr.TTL < ttl {
+			ttl = tr.TTL
+		}
+	}
+	return ttl, len(t.Rdata) > 0
 }
 
 // Copy makes a deep copy of the TLSAinfo structure
@@ -52,8 +125,17 @@ func (t *TLSAinfo) Copy() *TLSAinfo {
 		tr.Selector = r.Selector
 		tr.Mtype = r.Mtype
 		tr.Data = r.Data
+		tr.TTL = r.TTL
 		c.Rdata = append(c.Rdata, tr)
 	}
+	for _, sig := range t.RRSIG {
+		s := *sig
+		c.RRSIG = append(c.RRSIG, &s)
+	}
+	if t.Query != nil {
+		qi := *t.Query
+		c.Query = &qi
+	}
 	return c
 }
 
@@ -63,7 +145,104 @@ func (t *TLSAinfo) Uncheck() {
 		tr.Checked = false
 		tr.Ok = false
 		tr.Message = ""
+		tr.NameMismatch = false
+	}
+}
+
+// Validate checks each TLSA rdata for usability: a known usage, selector
+// and matching type, valid hex encoded data, and the correct digest length
+// for the matching type. It returns a list of errors, one per unusable
+// record, which is empty if all the records are usable.
+func (t *TLSAinfo) Validate() []error {
+
+	var errs []error
+
+	for _, tr := range t.Rdata {
+		if err := tr.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Usable returns whether the TLSA RRset contains at least one usable
+// record. If it doesn't, DANE authentication cannot succeed.
+func (t *TLSAinfo) Usable() bool {
+
+	for _, tr := range t.Rdata {
+		if tr.validate() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns an error if the TLSA rdata is unusable.
+func (tr *TLSArdata) validate() error {
+
+	var digestlen int
+
+	if tr.Usage > DaneEE {
+		return fmt.Errorf("TLSA %d %d %d: unknown usage", tr.Usage, tr.Selector, tr.Mtype)
+	}
+	if tr.Selector > 1 {
+		return fmt.Errorf("TLSA %d %d %d: unknown selector", tr.Usage, tr.Selector, tr.Mtype)
+	}
+	switch tr.Mtype {
+	case 0:
+	case 1:
+		digestlen = sha256.Size
+	case 2:
+		digestlen = sha512.Size
+	default:
+		return fmt.Errorf("TLSA %d %d %d: unknown matching type", tr.Usage, tr.Selector, tr.Mtype)
+	}
+	data, err := hex.DecodeString(tr.Data)
+	if err != nil {
+		return fmt.Errorf("TLSA %d %d %d: invalid data: %s", tr.Usage, tr.Selector, tr.Mtype, err)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("TLSA %d %d %d: empty data", tr.Usage, tr.Selector, tr.Mtype)
+	}
+	if digestlen != 0 && len(data) != digestlen {
+		return fmt.Errorf("TLSA %d %d %d: data length %d, expected %d", tr.Usage,
+			tr.Selector, tr.Mtype, len(data), digestlen)
+	}
+	return nil
+}
+
+// MatchesCert returns the TLSA records whose certificate association data
+// matches the given certificate, irrespective of usage mode. This can be
+// used to check, before deploying a new certificate, that it matches at
+// least one published TLSA record. It does not change the checking state
+// of the records.
+func (t *TLSAinfo) MatchesCert(cert *x509.Certificate) []*TLSArdata {
+
+	var matched []*TLSArdata
+
+	for _, tr := range t.Rdata {
+		hash, err := ComputeTLSA(tr.Selector, tr.Mtype, cert)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(hash, tr.Data) {
+			matched = append(matched, tr)
+		}
 	}
+	return matched
+}
+
+// CoversRollover checks that the TLSA RRset is safe for a certificate
+// rollover: that at least one record matches the currently served
+// certificate (curOK), and at least one matches the staged next
+// certificate (nextOK), so that clients can authenticate the server both
+// before and after the switch. As with MatchesCert, usage modes are not
+// considered: pass the EE certificates to check DANE-EE (e.g. "3 1 1")
+// records, or the issuing CA certificates to check trust anchor records.
+func (t *TLSAinfo) CoversRollover(current, next *x509.Certificate) (curOK, nextOK bool) {
+	curOK = len(t.MatchesCert(current)) > 0
+	nextOK = len(t.MatchesCert(next)) > 0
+	return curOK, nextOK
 }
 
 // Results prints TLSA RRset certificate matching results.
@@ -111,6 +290,11 @@ func (t *TLSAinfo) Print() {
 	for _, tr := range t.Rdata {
 		fmt.Printf("  %d %d %d %s\n", tr.Usage, tr.Selector, tr.Mtype, tr.Data)
 	}
+	for _, sig := range t.RRSIG {
+		fmt.Printf("  RRSIG %d %d %s: %s to %s\n", sig.Algorithm, sig.KeyTag,
+			sig.SignerName, sig.Inception.Format(time.RFC3339),
+			sig.Expiration.Format(time.RFC3339))
+	}
 }
 
 // ComputeTLSA calculates the TLSA rdata hash value for the given certificate
@@ -147,8 +331,31 @@ func ComputeTLSA(selector, mtype uint8, cert *x509.Certificate) (string, error)
 	return hex.EncodeToString(output), nil
 }
 
+// AllTLSAVariants returns the commonly published TLSA records for the
+// given certificate: for usages DANE-EE and DANE-TA (in that order), each
+// of the SPKI and full certificate selectors, with SHA-256 and SHA-512
+// matching types, e.g. "3 1 1", "3 1 2", "3 0 1", ... "2 0 2". Operators
+// can choose the records to publish from these: DANE-EE for the server's
+// certificate, or DANE-TA for its issuing CA certificate.
+func AllTLSAVariants(cert *x509.Certificate) []*TLSArdata {
+
+	var rdata []*TLSArdata
+
+	for _, usage := range []uint8{DaneEE, DaneTA} {
+		for _, selector := range []uint8{1, 0} {
+			for _, mtype := range []uint8{1, 2} {
+				data, _ := ComputeTLSA(selector, mtype, cert)
+				rdata = append(rdata, &TLSArdata{Usage: usage, Selector: selector,
+					Mtype: mtype, Data: data})
+			}
+		}
+	}
+	return rdata
+}
+
 // ChainMatchesTLSA checks that the TLSA record data (tr) has a corresponding
-// match in the certificate chain (chain). Only one TLSA record needs to match
+// match in the certificate chain (chain). The hex encoded data is compared
+// case insensitively. Only one TLSA record needs to match
 // for the chain to be considered matched. However, this function checks all
 // available TLSA records and records the results of the match in the TLSArdata
 // structure. These results can be useful to diagnostic tools using this
@@ -161,6 +368,12 @@ func ChainMatchesTLSA(chain []*x509.Certificate, tr *TLSArdata, daneconfig *Conf
 	var hashMatched bool
 
 	tr.Checked = true
+	if tr.isPlaceholder() {
+		tr.Ok = false
+		tr.Message = "unusable placeholder record"
+		return false
+	}
+
 	switch tr.Usage {
 	case PkixEE, DaneEE:
 		hash, err = ComputeTLSA(tr.Selector, tr.Mtype, chain[0])
@@ -169,7 +382,7 @@ func ChainMatchesTLSA(chain []*x509.Certificate, tr *TLSArdata, daneconfig *Conf
 			tr.Message = err.Error()
 			break
 		}
-		if hash == tr.Data {
+		if strings.EqualFold(hash, tr.Data) {
 			if tr.Usage == DaneEE || daneconfig.Okpkix {
 				Authenticated = true
 				tr.Ok = true
@@ -183,27 +396,35 @@ func ChainMatchesTLSA(chain []*x509.Certificate, tr *TLSArdata, daneconfig *Conf
 			tr.Message = "did not match EE certificate"
 		}
 	case PkixTA, DaneTA:
-		for i, cert := range chain[1:] {
-			hash, err = ComputeTLSA(tr.Selector, tr.Mtype, cert)
+		// The trust anchor is normally an issuer of the EE certificate,
+		// but if the chain consists of a single self-issued certificate,
+		// then that certificate is also the only trust anchor candidate.
+		start := 1
+		if len(chain) == 1 && bytes.Equal(chain[0].RawIssuer, chain[0].RawSubject) {
+			start = 0
+		}
+		for i := start; i < len(chain); i++ {
+			hash, err = ComputeTLSA(tr.Selector, tr.Mtype, chain[i])
 			if err != nil {
-				tr.Ok = false
-				tr.Message = err.Error()
 				break
 			}
-			if hash != tr.Data {
+			if !strings.EqualFold(hash, tr.Data) {
 				continue
 			}
 			hashMatched = true
 			if tr.Usage == DaneTA || daneconfig.Okpkix {
 				Authenticated = true
 				tr.Ok = true
-				tr.Message = fmt.Sprintf("matched TA certificate at depth %d", i+1)
+				tr.Message = fmt.Sprintf("matched TA certificate at depth %d", i)
 			} else {
 				tr.Ok = false
-				tr.Message = fmt.Sprintf("matched TA certificate at depth %d but PKIX failed", i+1)
+				tr.Message = fmt.Sprintf("matched TA certificate at depth %d but PKIX failed", i)
 			}
 		}
-		if !hashMatched {
+		if err != nil {
+			tr.Ok = false
+			tr.Message = err.Error()
+		} else if !hashMatched {
 			tr.Ok = false
 			tr.Message = "did not match any TA certificate"
 		}
@@ -232,6 +453,59 @@ func smtpUsageOK(tr *TLSArdata, daneconfig *Config) bool {
 	return false
 }
 
+// usageAllowed returns whether the TLSA rdata usage mode is permitted by
+// the usage mode policy of the Config, and if not, a message saying why.
+// If the AllowUsages list is set, it determines the policy. Otherwise, for
+// SMTP the RFC 7672 rule in smtpUsageOK applies, and for other applications
+// all usage modes are permitted.
+func usageAllowed(tr *TLSArdata, daneconfig *Config) (bool, string) {
+
+	if len(daneconfig.AllowUsages) == 0 {
+		if daneconfig.isSMTP() && !smtpUsageOK(tr, daneconfig) {
+			return false, "invalid usage mode for smtp"
+		}
+		return true, ""
+	}
+	for _, usage := range daneconfig.AllowUsages {
+		if tr.Usage == usage {
+			return true, ""
+		}
+	}
+	return false, "usage mode not allowed by policy"
+}
+
+// paramAllowed returns whether the given TLSA selector or matching type
+// value is in the allowed list, which permits all values if empty.
+func paramAllowed(value uint8, allowed []uint8) bool {
+
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, v := range allowed {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// policyAllowed returns whether the TLSA rdata is permitted by the usage
+// mode, selector and matching type policy of the Config, and if not, a
+// message saying why.
+func policyAllowed(tr *TLSArdata, daneconfig *Config) (bool, string) {
+
+	if ok, message := usageAllowed(tr, daneconfig); !ok {
+		return false, message
+	}
+	if !paramAllowed(tr.Selector, daneconfig.AllowSelectors) {
+		return false, "selector not allowed by policy"
+	}
+	if !paramAllowed(tr.Mtype, daneconfig.AllowMtypes) {
+		return false, "matching type not allowed by policy"
+	}
+	return true, ""
+}
+
 // AuthenticateSingle performs DANE authentication of a single certificate
 // chain, using a single TLSA resource data. Returns true or false accordingly.
 func AuthenticateSingle(chain []*x509.Certificate, tr *TLSArdata, daneconfig *Config) bool {
@@ -240,9 +514,9 @@ func AuthenticateSingle(chain []*x509.Certificate, tr *TLSArdata, daneconfig *Co
 
 	tr.Checked = true
 
-	if daneconfig.Appname == "smtp" && !smtpUsageOK(tr, daneconfig) {
+	if ok, message := policyAllowed(tr, daneconfig); !ok {
 		tr.Ok = false
-		tr.Message = "invalid usage mode for smtp"
+		tr.Message = message
 		return false
 	}
 
@@ -254,11 +528,12 @@ func AuthenticateSingle(chain []*x509.Certificate, tr *TLSArdata, daneconfig *Co
 		return true
 	}
 
-	err = chain[0].VerifyHostname(daneconfig.Server.Name)
+	err = daneconfig.verifyName(chain[0])
 	if err == nil {
 		return true
 	} else {
 		tr.Ok = false
+		tr.NameMismatch = true
 		tr.Message += " but name check failed"
 		return false
 	}
@@ -266,30 +541,158 @@ func AuthenticateSingle(chain []*x509.Certificate, tr *TLSArdata, daneconfig *Co
 
 // AuthenticateAll performs DANE authentication of a set of certificate chains.
 // The TLSA RRset information is expected to be pre-initialized in the dane
-// Config structure.
+// Config structure, along with the certificate chains, which verifyServer()
+// populates during the TLS handshake: DANE-EE records are matched against
+// the PeerChain (as presented by the server), PKIX-TA and PKIX-EE records
+// against the PKIXChains (verified to a trusted root), and DANE-TA records
+// against the DANEChains (verified with the last presented certificate as
+// the trust anchor) as well as the PKIXChains, and the DANE chains extended
+// with any issuing trust anchor from the DANERootCA setting.
+//
+// All the TLSA records are checked, in the order given by the PreferUsage
+// setting of the Config (if any), and the first one that authenticates the
+// server is recorded in MatchedTLSA. Records with usage modes, selectors
+// or matching types that are not in the AllowUsages, AllowSelectors or
+// AllowMtypes settings of the Config (if any) are marked as checked, but
+// are not matched.
 func AuthenticateAll(daneconfig *Config) {
 
-	var chains [][]*x509.Certificate
+	var chains []sourceChain
 
 	daneconfig.Okdane = false
+	daneconfig.MatchedTLSA = nil
+	daneconfig.ChainChecks = nil
 
-	for _, tr := range daneconfig.TLSA.Rdata {
-		if tr.Usage == DaneEE {
-			if AuthenticateSingle(daneconfig.PeerChain, tr, daneconfig) {
-				daneconfig.Okdane = true
-			}
-			continue
-		}
+	for _, tr := range orderByUsage(daneconfig.TLSA.Rdata, daneconfig.PreferUsage) {
 		switch tr.Usage {
+		case DaneEE:
+			chains = sourceChains("peer", [][]*x509.Certificate{daneconfig.PeerChain})
 		case DaneTA:
-			chains = daneconfig.DANEChains
+			// Also try the PKIX validated chains, which terminate at a
+			// root from the system (or PKIXRootCA) store. This allows
+			// DANE-TA to match a root certificate that the server did
+			// not send (RFC 7671, Section 5.2.2).
+			chains = sourceChains("dane", daneconfig.DANEChains)
+			chains = append(chains, sourceChains("pkix", daneconfig.PKIXChains)...)
+			chains = append(chains, sourceChains("anchor", anchorChains(daneconfig))...)
 		case PkixEE, PkixTA:
-			chains = daneconfig.PKIXChains
+			chains = sourceChains("pkix", daneconfig.PKIXChains)
+		default:
+			// AuthenticateSingle will record the invalid usage mode
+			chains = sourceChains("peer", [][]*x509.Certificate{daneconfig.PeerChain})
 		}
-		for _, chain := range chains {
-			if AuthenticateSingle(chain, tr, daneconfig) {
-				daneconfig.Okdane = true
+		for _, sc := range chains {
+			ok := AuthenticateSingle(sc.chain, tr, daneconfig)
+			daneconfig.ChainChecks = append(daneconfig.ChainChecks, &ChainCheck{
+				Source:  sc.source,
+				Index:   sc.index,
+				Chain:   sc.chain,
+				TLSA:    tr,
+				Ok:      ok,
+				Message: tr.Message,
+			})
+			if ok {
+				if !daneconfig.Okdane {
+					daneconfig.Okdane = true
+					daneconfig.MatchedTLSA = tr
+				}
+				break
+			}
+		}
+	}
+}
+
+// ChainCheck records the result of matching a TLSA record against one of
+// the certificate chains of the server, in AuthenticateAll. Source is the
+// kind of chain: "peer" (the PeerChain), "dane" (DANEChains), "pkix"
+// (PKIXChains) or "anchor" (a DANE chain extended with a DANERootCA trust
+// anchor), and Index its position among the chains of that kind.
+type ChainCheck struct {
+	Source  string              // Kind of chain
+	Index   int                 // Index of the chain among those of its kind
+	Chain   []*x509.Certificate // The certificate chain
+	TLSA    *TLSArdata          // The TLSA record matched against the chain
+	Ok      bool                // Whether the record authenticated the chain
+	Message string              // Diagnostic message for the match
+}
+
+// String returns a string representation of the chain check, e.g.
+// "chain dane#1 (2 0 1 ...): OK matched TA certificate at depth 1".
+func (c *ChainCheck) String() string {
+	result := "FAIL"
+	if c.Ok {
+		result = "OK"
+	}
+	return fmt.Sprintf("chain %s#%d (%s): %s %s", c.Source, c.Index, c.TLSA,
+		result, c.Message)
+}
+
+// sourceChain is a certificate chain, with its kind and index, as
+// recorded in a ChainCheck.
+type sourceChain struct {
+	source string
+	index  int
+	chain  []*x509.Certificate
+}
+
+// sourceChains labels the given chains with their kind and index.
+func sourceChains(source string, chains [][]*x509.Certificate) []sourceChain {
+
+	var result []sourceChain
+
+	for i, chain := range chains {
+		result = append(result, sourceChain{source, i, chain})
+	}
+	return result
+}
+
+// anchorChains returns the DANE chains of the Config extended with the
+// candidate trust anchors in its DANERootCA that issued the last
+// certificate of each chain.
+func anchorChains(daneconfig *Config) [][]*x509.Certificate {
+
+	var chains [][]*x509.Certificate
+
+	if daneconfig.DANERootCA == nil {
+		return nil
+	}
+	anchors := pemCertificates(daneconfig.DANERootCA)
+	for _, chain := range daneconfig.DANEChains {
+		tail := chain[len(chain)-1]
+		for _, anchor := range anchors {
+			if anchor.Equal(tail) || !bytes.Equal(tail.RawIssuer, anchor.RawSubject) {
+				continue
+			}
+			if tail.CheckSignatureFrom(anchor) != nil {
+				continue
+			}
+			extended := append(chain[:len(chain):len(chain)], anchor)
+			chains = append(chains, extended)
+		}
+	}
+	return chains
+}
+
+// orderByUsage returns the TLSA records ordered by the position of their
+// usage mode in the given preference list. Records with usage modes not
+// in the list follow, and records otherwise retain their original order.
+func orderByUsage(rdata []*TLSArdata, prefer []uint8) []*TLSArdata {
+
+	if len(prefer) == 0 {
+		return rdata
+	}
+	rank := func(tr *TLSArdata) int {
+		for i, usage := range prefer {
+			if tr.Usage == usage {
+				return i
 			}
 		}
+		return len(prefer)
 	}
+	ordered := make([]*TLSArdata, len(rdata))
+	copy(ordered, rdata)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rank(ordered[i]) < rank(ordered[j])
+	})
+	return ordered
 }
@@ -0,0 +1,675 @@
+package dane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// makeTestCert creates a certificate for the given common name, signed
+// by the given issuer (or self-signed if the issuer is nil).
+func makeTestCert(t *testing.T, cn string, isCA bool, issuer *x509.Certificate,
+	issuerKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{cn}
+	}
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer,
+		&key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+	return cert, key
+}
+
+func TestChainMatchesTLSAShortChains(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+	selfsigned, _ := makeTestCert(t, "self.example.com", false, nil, nil)
+
+	testCases := []struct {
+		name  string
+		chain []*x509.Certificate
+		ta    *x509.Certificate
+		match bool
+	}{
+		{"1-element self-issued", []*x509.Certificate{selfsigned}, selfsigned, true},
+		{"2-element issuer", []*x509.Certificate{ee, ca}, ca, true},
+		{"2-element leaf as TA", []*x509.Certificate{ee, ca}, ee, false},
+		{"1-element wrong TA", []*x509.Certificate{selfsigned}, ca, false},
+		{"1-element not self-issued", []*x509.Certificate{ee}, ee, false},
+	}
+	for _, tc := range testCases {
+		data, err := ComputeTLSA(1, 1, tc.ta)
+		if err != nil {
+			t.Fatalf("%s: ComputeTLSA: %s", tc.name, err)
+		}
+		tr := &TLSArdata{Usage: DaneTA, Selector: 1, Mtype: 1, Data: data}
+		daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+		if ChainMatchesTLSA(tc.chain, tr, daneconfig) != tc.match {
+			t.Fatalf("%s: expected match %v: %s", tc.name, tc.match, tr.Message)
+		}
+	}
+}
+
+func TestDaneTAUnsentRoot(t *testing.T) {
+
+	root, rootkey := makeTestCert(t, "Test Root", true, nil, nil)
+	inter, interkey := makeTestCert(t, "Test Intermediate", true, root, rootkey)
+	ee, _ := makeTestCert(t, "www.example.com", false, inter, interkey)
+
+	data, err := ComputeTLSA(1, 1, root)
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneTA, Selector: 1, Mtype: 1, Data: data}},
+	})
+	daneconfig.PeerChain = []*x509.Certificate{ee, inter}
+	daneconfig.DANEChains = [][]*x509.Certificate{{ee, inter}}
+
+	AuthenticateAll(daneconfig)
+	if daneconfig.Okdane {
+		t.Fatalf("DANE-TA matched root without a chain containing it")
+	}
+
+	daneconfig.TLSA.Uncheck()
+	daneconfig.PKIXChains = [][]*x509.Certificate{{ee, inter, root}}
+	AuthenticateAll(daneconfig)
+	if !daneconfig.Okdane {
+		t.Fatalf("DANE-TA failed to match unsent root: %s",
+			daneconfig.TLSA.Rdata[0].Message)
+	}
+}
+
+func TestDANERootCAOffline(t *testing.T) {
+
+	root, rootkey := makeTestCert(t, "Test Root", true, nil, nil)
+	other, _ := makeTestCert(t, "Test Root", true, nil, nil)
+	inter, interkey := makeTestCert(t, "Test Intermediate", true, root, rootkey)
+	ee, _ := makeTestCert(t, "www.example.com", false, inter, interkey)
+
+	data, err := ComputeTLSA(1, 1, root)
+	if err != nil {
+		t.Fatalf("ComputeTLSA: %s", err)
+	}
+	for _, tc := range []struct {
+		anchors []*x509.Certificate
+		ok      bool
+	}{
+		{nil, false},
+		{[]*x509.Certificate{other}, false},
+		{[]*x509.Certificate{other, root}, true},
+	} {
+		daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+		daneconfig.SetTLSA(&TLSAinfo{
+			Rdata: []*TLSArdata{{Usage: DaneTA, Selector: 1, Mtype: 1, Data: data}},
+		})
+		if tc.anchors != nil {
+			daneconfig.SetDANERootCA(certsToPEMBytes(tc.anchors))
+		}
+		daneconfig.PeerChain = []*x509.Certificate{ee, inter}
+		daneconfig.DANEChains = [][]*x509.Certificate{{ee, inter}}
+		AuthenticateAll(daneconfig)
+		if daneconfig.Okdane != tc.ok {
+			t.Fatalf("%d anchors: Okdane %v, expected %v", len(tc.anchors),
+				daneconfig.Okdane, tc.ok)
+		}
+	}
+}
+
+func TestChainMatchesTLSAFullValue(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+	chain := []*x509.Certificate{ee, ca}
+
+	testCases := []struct {
+		usage    uint8
+		selector uint8
+		cert     *x509.Certificate
+		upper    bool
+	}{
+		{DaneEE, 0, ee, false},
+		{DaneEE, 1, ee, false},
+		{DaneEE, 0, ee, true},
+		{DaneTA, 0, ca, false},
+		{DaneTA, 1, ca, true},
+	}
+	for _, tc := range testCases {
+		data, err := ComputeTLSA(tc.selector, 0, tc.cert)
+		if err != nil {
+			t.Fatalf("ComputeTLSA: %s", err)
+		}
+		if tc.upper {
+			data = strings.ToUpper(data)
+		}
+		tr := &TLSArdata{Usage: tc.usage, Selector: tc.selector, Mtype: 0, Data: data}
+		daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+		if !ChainMatchesTLSA(chain, tr, daneconfig) {
+			t.Fatalf("%d %d 0 (upper %v): no match: %s", tc.usage, tc.selector,
+				tc.upper, tr.Message)
+		}
+	}
+}
+
+func TestTLSAinfoValidate(t *testing.T) {
+
+	sha256hex := strings.Repeat("ab", 32)
+	sha512hex := strings.Repeat("cd", 64)
+
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{
+			{Usage: 3, Selector: 1, Mtype: 1, Data: sha256hex},
+			{Usage: 2, Selector: 0, Mtype: 2, Data: sha512hex},
+			{Usage: 3, Selector: 1, Mtype: 0, Data: "3059"},
+			{Usage: 4, Selector: 1, Mtype: 1, Data: sha256hex},
+			{Usage: 3, Selector: 2, Mtype: 1, Data: sha256hex},
+			{Usage: 3, Selector: 1, Mtype: 3, Data: sha256hex},
+			{Usage: 3, Selector: 1, Mtype: 1, Data: sha512hex},
+			{Usage: 3, Selector: 1, Mtype: 1, Data: "xyz"},
+			{Usage: 3, Selector: 1, Mtype: 0, Data: ""},
+		},
+	}
+	errs := tlsa.Validate()
+	if len(errs) != 6 {
+		t.Fatalf("Validate: got %d errors, expected 6: %v", len(errs), errs)
+	}
+	if !tlsa.Usable() {
+		t.Fatalf("Usable: expected true")
+	}
+	tlsa.Rdata = tlsa.Rdata[3:]
+	if tlsa.Usable() {
+		t.Fatalf("Usable: expected false")
+	}
+}
+
+func TestMatchesCert(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	current, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+	next, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+
+	eedata, _ := ComputeTLSA(1, 1, current)
+	tadata, _ := ComputeTLSA(0, 2, ca)
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{
+			{Usage: DaneEE, Selector: 1, Mtype: 1, Data: eedata},
+			{Usage: DaneTA, Selector: 0, Mtype: 2, Data: tadata},
+		},
+	}
+
+	if matched := tlsa.MatchesCert(current); len(matched) != 1 || matched[0] != tlsa.Rdata[0] {
+		t.Fatalf("MatchesCert: current certificate: %v", matched)
+	}
+	if matched := tlsa.MatchesCert(next); len(matched) != 0 {
+		t.Fatalf("MatchesCert: next certificate matched: %v", matched)
+	}
+	if matched := tlsa.MatchesCert(ca); len(matched) != 1 || matched[0] != tlsa.Rdata[1] {
+		t.Fatalf("MatchesCert: CA certificate: %v", matched)
+	}
+}
+
+func TestPreferUsage(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+
+	tadata, _ := ComputeTLSA(1, 1, ca)
+	eedata, _ := ComputeTLSA(1, 1, ee)
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{
+			{Usage: DaneTA, Selector: 1, Mtype: 1, Data: tadata},
+			{Usage: DaneEE, Selector: 1, Mtype: 1, Data: eedata},
+		},
+	}
+
+	for _, tc := range []struct {
+		prefer []uint8
+		usage  uint8
+	}{
+		{nil, DaneTA},
+		{[]uint8{DaneEE}, DaneEE},
+		{[]uint8{DaneEE, DaneTA}, DaneEE},
+		{[]uint8{PkixTA, DaneTA}, DaneTA},
+	} {
+		daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+		daneconfig.SetTLSA(tlsa)
+		daneconfig.SetPreferUsage(tc.prefer)
+		daneconfig.PeerChain = []*x509.Certificate{ee, ca}
+		daneconfig.DANEChains = [][]*x509.Certificate{{ee, ca}}
+		AuthenticateAll(daneconfig)
+		if !daneconfig.Okdane || daneconfig.MatchedTLSA == nil {
+			t.Fatalf("prefer %v: authentication failed", tc.prefer)
+		}
+		if daneconfig.MatchedTLSA.Usage != tc.usage {
+			t.Fatalf("prefer %v: matched usage %d, expected %d", tc.prefer,
+				daneconfig.MatchedTLSA.Usage, tc.usage)
+		}
+		if !daneconfig.TLSA.Rdata[0].Ok || !daneconfig.TLSA.Rdata[1].Ok {
+			t.Fatalf("prefer %v: not all records checked", tc.prefer)
+		}
+	}
+}
+
+func TestAllowUsagesOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+
+	tadata, _ := ComputeTLSA(1, 1, ca)
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneTA, Selector: 1, Mtype: 1, Data: tadata}},
+	}
+
+	for _, tc := range []struct {
+		allow []uint8
+		ok    bool
+	}{
+		{nil, true},
+		{[]uint8{DaneTA, DaneEE}, true},
+		{[]uint8{DaneEE}, false},
+	} {
+		daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+		daneconfig.SetTLSA(tlsa)
+		daneconfig.SetAllowUsages(tc.allow)
+		daneconfig.PeerChain = []*x509.Certificate{ee, ca}
+		daneconfig.DANEChains = [][]*x509.Certificate{{ee, ca}}
+		AuthenticateAll(daneconfig)
+		if daneconfig.Okdane != tc.ok {
+			t.Fatalf("allow %v: Okdane %v, expected %v", tc.allow,
+				daneconfig.Okdane, tc.ok)
+		}
+		if !daneconfig.TLSA.Rdata[0].Checked {
+			t.Fatalf("allow %v: record not marked checked", tc.allow)
+		}
+	}
+}
+
+func TestAllowSelectorsMtypesOffline(t *testing.T) {
+
+	ee, _ := makeTestCert(t, "www.example.com", false, nil, nil)
+
+	spki256, _ := ComputeTLSA(1, 1, ee)
+	cert512, _ := ComputeTLSA(0, 2, ee)
+	tlsa := &TLSAinfo{
+		Rdata: []*TLSArdata{
+			{Usage: DaneEE, Selector: 0, Mtype: 2, Data: cert512},
+			{Usage: DaneEE, Selector: 1, Mtype: 1, Data: spki256},
+		},
+	}
+
+	for _, tc := range []struct {
+		selectors []uint8
+		mtypes    []uint8
+		matched   *TLSArdata
+		message   string
+	}{
+		{nil, nil, tlsa.Rdata[0], ""},
+		{[]uint8{1}, nil, tlsa.Rdata[1], "selector not allowed by policy"},
+		{nil, []uint8{1}, tlsa.Rdata[1], "matching type not allowed by policy"},
+		{[]uint8{0}, []uint8{1}, nil, "matching type not allowed by policy"},
+	} {
+		daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+		daneconfig.SetTLSA(tlsa)
+		daneconfig.SetAllowSelectors(tc.selectors)
+		daneconfig.SetAllowMtypes(tc.mtypes)
+		daneconfig.PeerChain = []*x509.Certificate{ee}
+		AuthenticateAll(daneconfig)
+		if daneconfig.Okdane != (tc.matched != nil) {
+			t.Fatalf("%v/%v: Okdane %v", tc.selectors, tc.mtypes, daneconfig.Okdane)
+		}
+		if tc.matched != nil && daneconfig.MatchedTLSA.String() != tc.matched.String() {
+			t.Fatalf("%v/%v: matched %s, expected %s", tc.selectors, tc.mtypes,
+				daneconfig.MatchedTLSA, tc.matched)
+		}
+		if tc.message != "" && daneconfig.TLSA.Rdata[0].Message != tc.message {
+			t.Fatalf("%v/%v: message %q, expected %q", tc.selectors, tc.mtypes,
+				daneconfig.TLSA.Rdata[0].Message, tc.message)
+		}
+	}
+}
+
+func TestChainChecksOffline(t *testing.T) {
+
+	root, rootkey := makeTestCert(t, "Test Root", true, nil, nil)
+	inter, interkey := makeTestCert(t, "Test Intermediate", true, root, rootkey)
+	ee, _ := makeTestCert(t, "www.example.com", false, inter, interkey)
+
+	rootdata, _ := ComputeTLSA(0, 1, root)
+	stale, _ := ComputeTLSA(1, 1, inter) // DANE-EE record that doesn't match
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{
+			{Usage: DaneEE, Selector: 1, Mtype: 1, Data: stale},
+			{Usage: DaneTA, Selector: 0, Mtype: 1, Data: rootdata},
+		},
+	})
+	daneconfig.PeerChain = []*x509.Certificate{ee, inter}
+	daneconfig.DANEChains = [][]*x509.Certificate{{ee, inter}, {ee, inter, root}}
+	AuthenticateAll(daneconfig)
+	if !daneconfig.Okdane {
+		t.Fatalf("AuthenticateAll: DANE authentication failed")
+	}
+
+	checks := daneconfig.ChainChecks
+	expected := []struct {
+		source string
+		index  int
+		ok     bool
+	}{
+		{"peer", 0, false},
+		{"dane", 0, false},
+		{"dane", 1, true},
+	}
+	if len(checks) != len(expected) {
+		t.Fatalf("AuthenticateAll: %d chain checks, expected %d", len(checks),
+			len(expected))
+	}
+	for i, e := range expected {
+		c := checks[i]
+		if c.Source != e.source || c.Index != e.index || c.Ok != e.ok {
+			t.Fatalf("chain check %d: %s, expected %s#%d ok %v", i, c,
+				e.source, e.index, e.ok)
+		}
+	}
+	if s := checks[2].String(); !strings.HasSuffix(s, "OK matched TA certificate at depth 2") {
+		t.Fatalf("chain check: unexpected string %q", s)
+	}
+}
+
+func TestUsagePolicyOffline(t *testing.T) {
+
+	pkixee := &TLSArdata{Usage: PkixEE, Selector: 1, Mtype: 1}
+	daneee := &TLSArdata{Usage: DaneEE, Selector: 1, Mtype: 1}
+
+	for _, tc := range []struct {
+		appname string
+		anymode bool
+		allow   []uint8
+		tr      *TLSArdata
+		ok      bool
+	}{
+		{"", false, nil, pkixee, true},
+		{"smtp", false, nil, pkixee, false},
+		{"smtps", false, nil, pkixee, false},
+		{"smtp", false, nil, daneee, true},
+		{"smtp", true, nil, pkixee, true},
+		{"smtp", false, []uint8{PkixEE}, pkixee, true},
+		{"smtp", false, []uint8{PkixEE}, daneee, false},
+		{"imap", false, []uint8{DaneEE}, pkixee, false},
+	} {
+		daneconfig := NewConfig("mx.example.com", "192.0.2.1", 25)
+		daneconfig.SetAppName(tc.appname)
+		daneconfig.SMTPAnyMode = tc.anymode
+		daneconfig.SetAllowUsages(tc.allow)
+		if ok, message := usageAllowed(tc.tr, daneconfig); ok != tc.ok {
+			t.Fatalf("%+v: usageAllowed %v (%s), expected %v", tc, ok, message, tc.ok)
+		}
+	}
+}
+
+func TestPrintChainOffline(t *testing.T) {
+
+	root, rootkey := makeTestCert(t, "Test Root", true, nil, nil)
+	inter, interkey := makeTestCert(t, "Test Intermediate", true, root, rootkey)
+	ee, _ := makeTestCert(t, "www.example.com", false, inter, interkey)
+
+	eedata, _ := ComputeTLSA(1, 1, ee)
+	rootdata, _ := ComputeTLSA(0, 1, root)
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{
+			{Usage: DaneEE, Selector: 1, Mtype: 1, Data: eedata},
+			{Usage: DaneTA, Selector: 0, Mtype: 1, Data: rootdata},
+		},
+	})
+	daneconfig.PeerChain = []*x509.Certificate{ee, inter}
+	daneconfig.PKIXChains = [][]*x509.Certificate{{ee, inter, root}}
+	daneconfig.MatchedTLSA = daneconfig.TLSA.Rdata[0]
+
+	var b strings.Builder
+	daneconfig.PrintChain(&b)
+	out := b.String()
+	for _, s := range []string{
+		"0 Subject: CN=www.example.com\n",
+		"<- matched by TLSA 3 1 1 (authenticated)\n",
+		"2 Subject: CN=Test Root (not sent by server)\n",
+		"<- matched by TLSA 2 0 1\n",
+		"SPKI SHA-256: " + eedata + "\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("PrintChain: output missing %q:\n%s", s, out)
+		}
+	}
+}
+
+func TestDaneFailureReasonOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+	other, _ := makeTestCert(t, "other.example.com", false, ca, cakey)
+	otherdata, _ := ComputeTLSA(1, 1, other)
+
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.PeerChain = []*x509.Certificate{ee, ca}
+	if reason := daneconfig.DaneFailureReason(); !strings.Contains(reason, "no authenticated TLSA") {
+		t.Fatalf("no TLSA: unexpected reason %q", reason)
+	}
+
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: otherdata}},
+	})
+	AuthenticateAll(daneconfig)
+	if daneconfig.Okdane {
+		t.Fatalf("Okdane set for non-matching TLSA record")
+	}
+	if reason := daneconfig.DaneFailureReason(); !strings.Contains(reason, "none matched: 3 1 1") {
+		t.Fatalf("no match: unexpected reason %q", reason)
+	}
+
+	eedata, _ := ComputeTLSA(1, 1, ee)
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: eedata}},
+	})
+	AuthenticateAll(daneconfig)
+	if reason := daneconfig.DaneFailureReason(); reason != "" {
+		t.Fatalf("match: unexpected reason %q", reason)
+	}
+
+	daneconfig = NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.DANE = false
+	if reason := daneconfig.DaneFailureReason(); !strings.Contains(reason, "PKIX only") {
+		t.Fatalf("PKIX only: unexpected reason %q", reason)
+	}
+}
+
+func TestNameMismatchOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+	other, _ := makeTestCert(t, "other.example.com", false, ca, cakey)
+	cadata, _ := ComputeTLSA(1, 1, ca)
+
+	daneconfig := NewConfig("mail.example.com", "192.0.2.1", 25)
+	tr := &TLSArdata{Usage: DaneTA, Selector: 1, Mtype: 1, Data: cadata}
+	if AuthenticateSingle([]*x509.Certificate{ee, ca}, tr, daneconfig) {
+		t.Fatalf("AuthenticateSingle: authenticated with wrong name")
+	}
+	if !tr.NameMismatch {
+		t.Fatalf("AuthenticateSingle: name mismatch not recorded: %s", tr.Message)
+	}
+
+	// A later non-matching chain does not clear the mismatch.
+	AuthenticateSingle([]*x509.Certificate{other}, tr, daneconfig)
+	if !tr.NameMismatch {
+		t.Fatalf("AuthenticateSingle: name mismatch cleared by later chain")
+	}
+	(&TLSAinfo{Rdata: []*TLSArdata{tr}}).Uncheck()
+	if tr.NameMismatch {
+		t.Fatalf("Uncheck: name mismatch not cleared")
+	}
+}
+
+func TestPlaceholderTLSAOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+
+	tr := &TLSArdata{Usage: PkixTA, Selector: 0, Mtype: 0, Data: ""}
+	if tr.String() != "DANE TLSA 0 0 0 [..]" {
+		t.Fatalf("String: unexpected %q", tr.String())
+	}
+
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.Okpkix = true
+	if ChainMatchesTLSA([]*x509.Certificate{ee, ca}, tr, daneconfig) {
+		t.Fatalf("ChainMatchesTLSA: placeholder record matched")
+	}
+	if !tr.Checked || tr.Ok || tr.Message != "unusable placeholder record" {
+		t.Fatalf("ChainMatchesTLSA: unexpected result %v %v %q",
+			tr.Checked, tr.Ok, tr.Message)
+	}
+}
+
+func TestResetResultsOffline(t *testing.T) {
+
+	ca, cakey := makeTestCert(t, "Test CA", true, nil, nil)
+	ee, _ := makeTestCert(t, "www.example.com", false, ca, cakey)
+	eedata, _ := ComputeTLSA(1, 1, ee)
+
+	daneconfig := NewConfig("www.example.com", "192.0.2.1", 443)
+	daneconfig.SetTLSA(&TLSAinfo{
+		Rdata: []*TLSArdata{{Usage: DaneEE, Selector: 1, Mtype: 1, Data: eedata}},
+	})
+	daneconfig.PeerChain = []*x509.Certificate{ee, ca}
+	daneconfig.Okpkix = true
+	daneconfig.DiagError = ErrNoTLSA
+	AuthenticateAll(daneconfig)
+	if !daneconfig.Okdane || daneconfig.MatchedTLSA == nil {
+		t.Fatalf("AuthenticateAll: DANE-EE failed")
+	}
+
+	daneconfig.ResetResults()
+	if daneconfig.Okdane || daneconfig.Okpkix || daneconfig.MatchedTLSA != nil ||
+		daneconfig.PeerChain != nil || daneconfig.DiagError != nil {
+		t.Fatalf("ResetResults: results not cleared")
+	}
+	if daneconfig.TLSA == nil || daneconfig.TLSA.Rdata[0].Checked {
+		t.Fatalf("ResetResults: TLSA records not kept unchecked")
+	}
+}
+
+func TestGenericStringOffline(t *testing.T) {
+
+	data := strings.Repeat("ab", 32)
+	tr := &TLSArdata{Usage: DaneEE, Selector: 1, Mtype: 1, Data: data}
+	s := tr.GenericString("_443._tcp.www.example.com", 3600)
+	expected := "_443._tcp.www.example.com.\t3600\tIN\tTYPE52\t\\# 35 030101" + data
+	if s != expected {
+		t.Fatalf("GenericString: got %q, expected %q", s, expected)
+	}
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("dns.NewRR(%q): %s", s, err)
+	}
+	tlsa, ok := rr.(*dns.TLSA)
+	if !ok {
+		t.Fatalf("dns.NewRR: not a TLSA record: %s", rr)
+	}
+	if tlsa.Usage != tr.Usage || tlsa.Selector != tr.Selector ||
+		tlsa.MatchingType != tr.Mtype || tlsa.Certificate != data {
+		t.Fatalf("dns.NewRR: TLSA record mismatch: %s", tlsa)
+	}
+}
+
+func TestCoversRolloverOffline(t *testing.T) {
+
+	current, _ := makeTestCert(t, "www.example.com", false, nil, nil)
+	next, _ := makeTestCert(t, "www.example.com", false, nil, nil)
+	curdata, _ := ComputeTLSA(1, 1, current)
+	nextdata, _ := ComputeTLSA(1, 1, next)
+
+	for _, tc := range []struct {
+		data          []string
+		curOK, nextOK bool
+	}{
+		{[]string{curdata, nextdata}, true, true},
+		{[]string{curdata}, true, false},
+		{[]string{nextdata}, false, true},
+		{nil, false, false},
+	} {
+		tlsa := new(TLSAinfo)
+		for _, data := range tc.data {
+			tlsa.Rdata = append(tlsa.Rdata,
+				&TLSArdata{Usage: DaneEE, Selector: 1, Mtype: 1, Data: data})
+		}
+		curOK, nextOK := tlsa.CoversRollover(current, next)
+		if curOK != tc.curOK || nextOK != tc.nextOK {
+			t.Fatalf("CoversRollover: got %v, %v, want %v, %v", curOK, nextOK,
+				tc.curOK, tc.nextOK)
+		}
+	}
+}
+
+func TestAllTLSAVariantsOffline(t *testing.T) {
+
+	cert, _ := makeTestCert(t, "www.example.com", false, nil, nil)
+
+	rdata := AllTLSAVariants(cert)
+	if len(rdata) != 8 {
+		t.Fatalf("AllTLSAVariants: %d records, expected 8", len(rdata))
+	}
+	if tr := rdata[0]; tr.Usage != DaneEE || tr.Selector != 1 || tr.Mtype != 1 {
+		t.Fatalf("AllTLSAVariants: first record %s, expected 3 1 1", tr)
+	}
+	seen := make(map[string]bool)
+	for _, tr := range rdata {
+		key := fmt.Sprintf("%d %d %d", tr.Usage, tr.Selector, tr.Mtype)
+		if seen[key] {
+			t.Fatalf("AllTLSAVariants: duplicate record %s", key)
+		}
+		seen[key] = true
+		if err := tr.validate(); err != nil {
+			t.Fatalf("AllTLSAVariants: invalid record %s: %s", tr, err)
+		}
+		expected, _ := ComputeTLSA(tr.Selector, tr.Mtype, cert)
+		if tr.Data != expected {
+			t.Fatalf("AllTLSAVariants: record %s has wrong data", key)
+		}
+	}
+}
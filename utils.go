@@ -3,6 +3,7 @@ package dane
 import (
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
@@ -23,25 +24,35 @@ func addressString(ipaddress net.IP, port int) string {
 }
 
 //
-// getTCPDialer returns a net.Dialer object, initialized with the given
-// timeout (in seconds).
+// getDialer returns a net.Dialer object, initialized with the TCP timeout,
+// keepalive period, local address and socket control function of the
+// given dane Config.
 //
-func getDialer(timeout int) *net.Dialer {
+func getDialer(daneconfig *Config) *net.Dialer {
 
 	dialer := new(net.Dialer)
-	dialer.Timeout = time.Second * time.Duration(timeout)
+	dialer.Timeout = time.Second * time.Duration(daneconfig.TimeoutTCP)
+	if daneconfig.KeepAlive < 0 {
+		dialer.KeepAlive = -1
+	} else {
+		dialer.KeepAlive = time.Second * time.Duration(daneconfig.KeepAlive)
+	}
+	dialer.LocalAddr = daneconfig.LocalAddr
+	dialer.Control = daneconfig.DialControl
 	return dialer
 }
 
 //
-// getTCPconn establishes a TCP connection to the given address and port.
-// Returns a TCP connection (net.Conn) on success. Populates error on
-// failure.
+// getTCPconn establishes a TCP connection to the server address and port
+// in the given dane Config (or to its dial target, if set, which may be a
+// Unix domain socket). Returns a connection (net.Conn) on success.
+// Populates error on failure.
 //
-func getTCPconn(address net.IP, port int, timeout int) (net.Conn, error) {
+func getTCPconn(daneconfig *Config) (net.Conn, error) {
 
-	dialer := getDialer(timeout)
-	conn, err := dialer.Dial("tcp", addressString(address, port))
+	dialer := getDialer(daneconfig)
+	network, address := daneconfig.dialTarget()
+	conn, err := dialer.Dial(network, address)
 	return conn, err
 }
 
@@ -57,3 +68,76 @@ func CertToPEMBytes(cert *x509.Certificate) []byte {
 	}
 	return pem.EncodeToMemory(block)
 }
+
+//
+// certsToPEMBytes returns the concatenated PEM encoding of the given list
+// of x.509 certificates.
+//
+func certsToPEMBytes(certs []*x509.Certificate) []byte {
+
+	var out []byte
+
+	for _, cert := range certs {
+		out = append(out, CertToPEMBytes(cert)...)
+	}
+	return out
+}
+
+//
+// ParseCertChainPEM parses a certificate chain, such as one saved from a
+// server, from the given PEM data, and returns the certificates in the
+// order they appear (which should be the server's certificate first).
+// Blocks other than certificates are skipped. An error is returned if a
+// certificate fails to parse, or if there are no certificates.
+//
+func ParseCertChainPEM(data []byte) ([]*x509.Certificate, error) {
+
+	certs, err := decodeCertificates(data, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in PEM data")
+	}
+	return certs, nil
+}
+
+//
+// pemCertificates returns the x.509 certificates in the given PEM data.
+// Blocks that are not certificates, or fail to parse, are skipped.
+//
+func pemCertificates(data []byte) []*x509.Certificate {
+
+	certs, _ := decodeCertificates(data, false)
+	return certs
+}
+
+//
+// decodeCertificates returns the x.509 certificates in the given PEM
+// data, in order, skipping blocks that are not certificates. If strict is
+// set, a certificate that fails to parse is an error; otherwise it is
+// skipped.
+//
+func decodeCertificates(data []byte, strict bool) ([]*x509.Certificate, error) {
+
+	var certs []*x509.Certificate
+	var block *pem.Block
+
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("certificate %d: %w", len(certs), err)
+			}
+			continue
+		}
+		certs = append(certs, cert)
+	}
+}
@@ -47,7 +47,11 @@
 //
 // Also, per RFC 7672, Section 3.1.3, for SMTP STARTTLS the library ignores
 // PKIX-* mode TLSA records, since they are not recommended for use. This can
-// also be overridden by setting the SMTPAnyMode option.
+// also be overridden by setting the SMTPAnyMode option. The same applies to
+// SMTP over implicit TLS (port 465) with DialTLS(), if the application name
+// is set to "smtps". More generally, the TLSA usage modes accepted for any
+// application can be restricted with the AllowUsages option, which takes
+// precedence over the SMTP rule.
 //
 // After calling DialTLSA() or DialStartTLSA(), the dane.Config structure
 // is populated with additional diagnostic information, such as DANE and
@@ -59,16 +63,26 @@
 // fails (rather than an error), but will populate the dane.Config's DiagError
 // member with the appropriate error instead.
 //
+// The package does not print diagnostic output itself. A Logger (such as a
+// *log.Logger) can be set on the dane.Config or Resolver to receive it.
+//
 // The ConnectByName(), ConnectByNameAsync(), and ConnectByNameAsync2() functions
 // are simpler all-in-one functions that take a hostname and port argument, and then
 // lookup up TLSA records, connect to the first address associated with the hostname
 // that results in an authenticated connection, and returns the associated TLS connection
-// object.
+// object. ConnectByNameResolver() and ConnectByNameAsyncResolver() take an
+// explicit Resolver, whose IPv4 and IPv6 settings can be used to restrict the
+// address families that are tried.
+//
+// ScanHosts() checks a list of host, port (and optional STARTTLS application)
+// targets concurrently using a shared resolver, and returns the DANE and PKIX
+// authentication results for each. Connections are not kept open.
 //
 // GetHttpClient() returns a HTTP client structure (net/http.Client) configured to
 // do DANE authentication of a HTTPS server. The "pkixfallback" boolean argument
 // specifies whether or not to fallback to PKIX authentication if there are no secure
-// TLSA records published for the server.
+// TLSA records published for the server. DaneDialTLSContext() returns the
+// underlying dial function, for use with an existing net/http.Transport.
 //
 
 package dane